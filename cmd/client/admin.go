@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+	"tunnel/pkg/cert"
+
+	"github.com/slackhq/nebula"
+	nebulaConfig "github.com/slackhq/nebula/config"
+)
+
+// admin is the local admin API of the client
+type admin struct {
+	ctrl    func() *nebula.Control
+	connCfg *nebulaConfig.C
+	// nil in TUN mode
+	forwards *forwards
+}
+
+func (a *admin) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", a.status)
+	mux.HandleFunc("GET /tunnels", a.tunnels)
+	mux.HandleFunc("GET /forwards", a.listForwards)
+	mux.HandleFunc("POST /forwards", a.addForward)
+	mux.HandleFunc("DELETE /forwards", a.removeForward)
+	return localOnly(mux)
+}
+
+type lighthouseStatus struct {
+	VpnAddr   string `json:"vpn_addr"`
+	Reachable bool   `json:"reachable"`
+	Remote    string `json:"remote,omitempty"`
+}
+
+type statusOutput struct {
+	NodeName      string             `json:"node_name"`
+	OverlayIPs    []string           `json:"overlay_ips"`
+	CertNotAfter  time.Time          `json:"cert_not_after"`
+	CertExpiresIn string             `json:"cert_expires_in"`
+	Lighthouses   []lighthouseStatus `json:"lighthouses"`
+	Tunnels       int                `json:"tunnels"`
+}
+
+func (a *admin) status(w http.ResponseWriter, r *http.Request) {
+	info, err := cert.Inspect(a.connCfg.GetString("pki.cert", ""))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	out := statusOutput{
+		NodeName:      info.Name,
+		OverlayIPs:    []string{},
+		CertNotAfter:  info.NotAfter,
+		CertExpiresIn: time.Until(info.NotAfter).Round(time.Second).String(),
+		Lighthouses:   []lighthouseStatus{},
+	}
+	for _, n := range info.Networks {
+		ip, _, _ := strings.Cut(n, "/")
+		out.OverlayIPs = append(out.OverlayIPs, ip)
+	}
+
+	ctrl := a.ctrl()
+	for _, host := range a.connCfg.GetStringSlice("lighthouse.hosts", []string{}) {
+		lh := lighthouseStatus{VpnAddr: host}
+		if addr, err := netip.ParseAddr(host); err == nil && ctrl != nil {
+			if h := ctrl.GetHostInfoByVpnAddr(addr, false); h != nil {
+				lh.Reachable = true
+				if h.CurrentRemote.IsValid() {
+					lh.Remote = h.CurrentRemote.String()
+				}
+			}
+		}
+		out.Lighthouses = append(out.Lighthouses, lh)
+	}
+	if ctrl != nil {
+		out.Tunnels = len(ctrl.ListHostmapHosts(false))
+	}
+
+	writeJSON(w, http.StatusOK, out)
+}
+
+type tunnelInfo struct {
+	Name           string   `json:"name"`
+	VpnAddrs       []string `json:"vpn_addrs"`
+	Remote         string   `json:"remote,omitempty"`
+	RelayedThrough []string `json:"relayed_through,omitempty"`
+	MessageCounter uint64   `json:"message_counter"`
+}
+
+func (a *admin) tunnels(w http.ResponseWriter, r *http.Request) {
+	tunnels := []tunnelInfo{}
+	if ctrl := a.ctrl(); ctrl != nil {
+		for _, h := range ctrl.ListHostmapHosts(false) {
+			t := tunnelInfo{
+				VpnAddrs:       []string{},
+				MessageCounter: h.MessageCounter,
+			}
+			if h.Cert != nil {
+				t.Name = h.Cert.Name()
+			}
+			for _, addr := range h.VpnAddrs {
+				t.VpnAddrs = append(t.VpnAddrs, addr.String())
+			}
+			if h.CurrentRemote.IsValid() {
+				t.Remote = h.CurrentRemote.String()
+			}
+			for _, relay := range h.CurrentRelaysToMe {
+				t.RelayedThrough = append(t.RelayedThrough, relay.String())
+			}
+			tunnels = append(tunnels, t)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"tunnels": tunnels})
+}
+
+func (a *admin) listForwards(w http.ResponseWriter, r *http.Request) {
+	if a.forwards == nil {
+		writeJSON(w, http.StatusOK, map[string]any{"forwards": []forwardInfo{}})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"forwards": a.forwards.list()})
+}
+
+type forwardInput struct {
+	Mapping string `json:"mapping"`
+}
+
+func (a *admin) addForward(w http.ResponseWriter, r *http.Request) {
+	if a.forwards == nil {
+		http.Error(w, "port mappings are not supported in TUN mode", http.StatusConflict)
+		return
+	}
+
+	var input forwardInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := a.forwards.add(strings.TrimSpace(input.Mapping)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"forwards": a.forwards.list()})
+}
+
+// removeForward takes the mapping as mapping query parameter
+func (a *admin) removeForward(w http.ResponseWriter, r *http.Request) {
+	if a.forwards == nil {
+		http.Error(w, "port mappings are not supported in TUN mode", http.StatusConflict)
+		return
+	}
+
+	err := a.forwards.remove(strings.TrimSpace(r.URL.Query().Get("mapping")))
+	if errors.Is(err, errForwardNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"forwards": a.forwards.list()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
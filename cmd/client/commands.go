@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"tunnel/internal/config"
+	"tunnel/pkg/api"
+	"tunnel/pkg/cert"
+
+	nebulaConfig "github.com/slackhq/nebula/config"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"run", "enroll unless enrolled and run the tunnel (default)", run},
+	{"enroll", "enroll with the server and save the connection config", enrollCmd},
+	{"status", "show the status of the running client or the enrolled cert", status},
+	{"renew", "renew the node certificate", renewCmd},
+	{"leave", "deregister from the server, releasing the node addresses", leave},
+	{"cert inspect", "inspect the node certificate: cert inspect [flags] [cert.pem]", certInspect},
+}
+
+// runCommand runs the subcommand args start with, run if args start with a
+// flag or are empty
+func runCommand(args []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		args = append([]string{"run"}, args...)
+	}
+
+	for _, cmd := range commands {
+		words := strings.Fields(cmd.name)
+		if len(args) >= len(words) && slices.Equal(args[:len(words)], words) {
+			if err := cmd.run(args[len(words):]); err != nil {
+				log.Fatalf("%s: %v", cmd.name, err)
+			}
+			return
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command %q, commands:\n", strings.Join(args, " "))
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %s\t%s\n", cmd.name, cmd.usage)
+	}
+	w.Flush()
+	os.Exit(2)
+}
+
+// ServerConfig is the part of Config needed to talk to the server once
+// enrolled
+type ServerConfig struct {
+	APIAddr           string `env:"API_ADDR" flag:"api-addr" default:"http://127.0.0.1:8080" validate:"required" usage:"tunnel server http api addr"`
+	ConnectionCfgPath string `env:"CONN_CFG_PATH" flag:"conn-cfg-path" default:"conn.yaml" validate:"required" usage:"path to the tunnel connection data"`
+
+	APICABundle    string        `env:"API_CA_BUNDLE" flag:"api-ca-bundle" usage:"PEM file of the CAs the server's HTTPS certificate is verified with (system CAs if empty)"`
+	APIPins        []string      `env:"API_PINS" flag:"api-pin" validate:"spki_pin" usage:"sha256/BASE64 hashes of the public key of the server's HTTPS certificate, without API_CA_BUNDLE the pins alone are trusted"`
+	APIMaxAttempts int           `env:"API_MAX_ATTEMPTS" flag:"api-max-attempts" default:"5" usage:"attempts of API calls failing with network errors or 5xx responses, with exponential backoff in between (enrollment is only retried while the server is unreachable)"`
+	APITimeout     time.Duration `env:"API_TIMEOUT" flag:"api-timeout" default:"10s" usage:"timeout of a single API request"`
+}
+
+func init() {
+	config.RegisterValidator("spki_pin", func(value any) error {
+		for _, pin := range value.([]string) {
+			if _, err := api.ParseSPKIPin(pin); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	config.RegisterValidator("local_addr", func(value any) error {
+		return checkLocalAddr(value.(string))
+	})
+}
+
+func (cfg ServerConfig) client() (*api.Client, error) {
+	tlsConfig, err := api.ClientTLSConfig(cfg.APICABundle, cfg.APIPins)
+	if err != nil {
+		return nil, fmt.Errorf("api TLS config: %w", err)
+	}
+	return api.NewClient(cfg.APIAddr, tlsConfig, cfg.APIMaxAttempts, cfg.APITimeout), nil
+}
+
+// interruptible is cancelled on ctrl+c, ending the retries of API calls
+func interruptible() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+}
+
+func loadEnrolled(name string, cfg any, connCfgPath *string, args []string) (*nebulaConfig.C, error) {
+	if err := config.LoadConfig(flag.NewFlagSet(name, flag.ExitOnError), cfg, args); err != nil {
+		return nil, err
+	}
+
+	connCfg := nebulaConfig.NewC(nil)
+	if err := connCfg.Load(*connCfgPath); err != nil {
+		return nil, fmt.Errorf("load conn cfg %s, not enrolled?: %w", *connCfgPath, err)
+	}
+	return connCfg, nil
+}
+
+func enrollCmd(args []string) error {
+	cfg := Config{}
+	if err := config.LoadConfig(flag.NewFlagSet("enroll", flag.ExitOnError), &cfg, args); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(cfg.ConnectionCfgPath); err == nil {
+		return fmt.Errorf("already enrolled, %s exists", cfg.ConnectionCfgPath)
+	}
+
+	client, err := cfg.client()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	connCfg := nebulaConfig.NewC(nil)
+	if err := enroll(ctx, client, cfg, connCfg); err != nil {
+		return err
+	}
+
+	info, err := cert.Inspect(connCfg.GetString("pki.cert", ""))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("enrolled as %s (%s), saved to %s\n", info.Name, strings.Join(info.Networks, ","), cfg.ConnectionCfgPath)
+	return nil
+}
+
+func renewCmd(args []string) error {
+	cfg := ServerConfig{}
+	connCfg, err := loadEnrolled("renew", &cfg, &cfg.ConnectionCfgPath, args)
+	if err != nil {
+		return err
+	}
+
+	client, err := cfg.client()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	if err := renew(ctx, client, cfg.ConnectionCfgPath, connCfg); err != nil {
+		return err
+	}
+
+	info, err := cert.Inspect(connCfg.GetString("pki.cert", ""))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("renewed, valid until %s\n", info.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+type statusConfig struct {
+	ConnectionCfgPath string `env:"CONN_CFG_PATH" flag:"conn-cfg-path" default:"conn.yaml" validate:"required" usage:"path to the tunnel connection data"`
+	AdminListenAddr   string `env:"ADMIN_LISTEN_ADDR" flag:"admin-listen-addr" usage:"admin API of the running client, host:port or unix:/path/to/socket"`
+}
+
+func status(args []string) error {
+	cfg := statusConfig{}
+	connCfg, err := loadEnrolled("status", &cfg, &cfg.ConnectionCfgPath, args)
+	if err != nil {
+		return err
+	}
+
+	var out statusOutput
+	if cfg.AdminListenAddr != "" {
+		out, err = runningStatus(cfg.AdminListenAddr)
+		if err == nil {
+			return printJSON(out)
+		}
+		log.Printf("[WARN] client not reachable, showing the enrolled cert: %v", err)
+	}
+
+	// the client doesn't run or has no admin API, what the cert says only
+	info, err := cert.Inspect(connCfg.GetString("pki.cert", ""))
+	if err != nil {
+		return err
+	}
+	out = statusOutput{
+		NodeName:      info.Name,
+		OverlayIPs:    []string{},
+		CertNotAfter:  info.NotAfter,
+		CertExpiresIn: time.Until(info.NotAfter).Round(time.Second).String(),
+		Lighthouses:   []lighthouseStatus{},
+	}
+	for _, n := range info.Networks {
+		ip, _, _ := strings.Cut(n, "/")
+		out.OverlayIPs = append(out.OverlayIPs, ip)
+	}
+	for _, host := range connCfg.GetStringSlice("lighthouse.hosts", []string{}) {
+		out.Lighthouses = append(out.Lighthouses, lighthouseStatus{VpnAddr: host})
+	}
+	return printJSON(out)
+}
+
+func runningStatus(adminAddr string) (statusOutput, error) {
+	var out statusOutput
+
+	client, baseURL := localClient(adminAddr)
+	resp, err := client.Get(baseURL + "/status")
+	if err != nil {
+		return out, fmt.Errorf("making http request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return out, fmt.Errorf("reading response body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return out, fmt.Errorf("non-OK status code: %d, response body: %s", resp.StatusCode, body)
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return out, fmt.Errorf("unmarshaling JSON response: %w", err)
+	}
+	return out, nil
+}
+
+func leave(args []string) error {
+	cfg := ServerConfig{}
+	connCfg, err := loadEnrolled("leave", &cfg, &cfg.ConnectionCfgPath, args)
+	if err != nil {
+		return err
+	}
+
+	client, err := cfg.client()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	if err := client.Leave(ctx, connCfg.GetString("pki.cert", ""), connCfg.GetString("pki.key", "")); err != nil {
+		return err
+	}
+
+	// the cert is blocklisted and the addresses are gone, enroll anew
+	if err := os.Remove(cfg.ConnectionCfgPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove conn cfg %s: %w", cfg.ConnectionCfgPath, err)
+	}
+
+	fmt.Println("left, enroll again with a new token to rejoin")
+	return nil
+}
+
+func printJSON(v any) error {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
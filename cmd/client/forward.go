@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/service"
+)
+
+type forwardStats struct {
+	Active int64  `json:"active"`
+	Total  uint64 `json:"total"`
+}
+
+type forwardCounters struct {
+	active atomic.Int64
+	total  atomic.Uint64
+}
+
+func (c *forwardCounters) stats() forwardStats {
+	return forwardStats{Active: c.active.Load(), Total: c.total.Load()}
+}
+
+// tcpForward forwards a port of the overlay address to a local address,
+// like the inbound TCP forward of port_forwarder but counting connections
+type tcpForward struct {
+	port        int
+	dialAddress string
+
+	counters *forwardCounters
+}
+
+func (f tcpForward) ConfigDescriptor() string {
+	return fmt.Sprintf("inbound.tcp.%d.%s", f.port, f.dialAddress)
+}
+
+func (f tcpForward) SetupPortForwarding(tunService *service.Service, l *logrus.Logger) (io.Closer, error) {
+	listener, err := tunService.Listen("tcp", fmt.Sprintf(":%d", f.port))
+	if err != nil {
+		return nil, err
+	}
+	l.Infof("TCP port forwarding to '%v': listening on outside TCP addr: ':%d'", f.dialAddress, f.port)
+
+	fwd := &tcpForwarder{
+		tcpForward: f,
+		l:          l,
+		listener:   listener,
+		conns:      map[net.Conn]bool{},
+	}
+	fwd.wg.Add(1)
+	go fwd.accept()
+	return fwd, nil
+}
+
+type tcpForwarder struct {
+	tcpForward
+	l        *logrus.Logger
+	listener net.Listener
+
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+}
+
+func (fwd *tcpForwarder) accept() {
+	defer fwd.wg.Done()
+	for {
+		conn, err := fwd.listener.Accept()
+		if err != nil {
+			return
+		}
+		fwd.wg.Add(1)
+		go fwd.handle(conn)
+	}
+}
+
+func (fwd *tcpForwarder) handle(outside net.Conn) {
+	defer fwd.wg.Done()
+	defer outside.Close()
+
+	local, err := net.Dial("tcp", fwd.dialAddress)
+	if err != nil {
+		fwd.l.Debugf("dialing %s for forwarded port %d: %v", fwd.dialAddress, fwd.port, err)
+		return
+	}
+	defer local.Close()
+
+	fwd.track(outside, local)
+	defer fwd.untrack(outside, local)
+	fwd.counters.total.Add(1)
+	fwd.counters.active.Add(1)
+	defer fwd.counters.active.Add(-1)
+
+	done := make(chan struct{}, 2)
+	pipe := func(to, from net.Conn) {
+		io.Copy(to, from)
+		// unblock the other direction
+		to.Close()
+		from.Close()
+		done <- struct{}{}
+	}
+	go pipe(local, outside)
+	go pipe(outside, local)
+	<-done
+	<-done
+}
+
+func (fwd *tcpForwarder) track(conns ...net.Conn) {
+	fwd.mu.Lock()
+	defer fwd.mu.Unlock()
+	for _, c := range conns {
+		if fwd.closed {
+			c.Close()
+			continue
+		}
+		fwd.conns[c] = true
+	}
+}
+
+func (fwd *tcpForwarder) untrack(conns ...net.Conn) {
+	fwd.mu.Lock()
+	defer fwd.mu.Unlock()
+	for _, c := range conns {
+		delete(fwd.conns, c)
+	}
+}
+
+// Close stops accepting and drops the established connections
+func (fwd *tcpForwarder) Close() error {
+	err := fwd.listener.Close()
+
+	fwd.mu.Lock()
+	fwd.closed = true
+	for c := range fwd.conns {
+		c.Close()
+	}
+	fwd.mu.Unlock()
+
+	fwd.wg.Wait()
+	return err
+}
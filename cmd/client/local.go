@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+	"tunnel/pkg/health"
+)
+
+const localClientTimeout = 5 * time.Second
+
+func healthHandler(healthChecker *health.Checker) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", healthChecker.Liveness)
+	mux.HandleFunc("GET /readyz", healthChecker.Readiness)
+	return mux
+}
+
+// serveLocal serves the endpoints meant for the machine the client runs on
+// at addr, a host:port or unix:/path/to/socket
+func serveLocal(name, addr string, handler http.Handler) {
+	listener, err := listenLocal(addr)
+	if err != nil {
+		log.Fatalf("listen for %s at %s: %v", name, addr, err)
+	}
+
+	go func() {
+		if err := http.Serve(listener, handler); err != nil {
+			log.Fatalf("serving %s at %s: %v", name, addr, err)
+		}
+	}()
+}
+
+func listenLocal(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	// left over by a previous run
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("remove stale socket: %w", err)
+	}
+	return listenSocket(path)
+}
+
+// checkLocalAddr accepts unix sockets and loopback host:port addresses only,
+// for endpoints nobody else on the network may reach
+func checkLocalAddr(addr string) error {
+	if strings.HasPrefix(addr, "unix:") {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if !isLoopbackHost(host) {
+		return fmt.Errorf("%s is not a loopback address", host)
+	}
+	return nil
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
+
+// localOnly rejects requests with a Host other than the loopback or unix
+// socket ones, which is what DNS rebinding sends, and POSTs not declared as
+// JSON, which is what cross-origin forms send without a preflight
+func localOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if host != "unix" && !isLoopbackHost(strings.Trim(host, "[]")) {
+			http.Error(w, "invalid host "+r.Host, http.StatusForbidden)
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				http.Error(w, "content type must be application/json", http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// localClient returns a client and the base URL for the endpoints served by
+// serveLocal at addr
+func localClient(addr string) (*http.Client, string) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return &http.Client{Timeout: localClientTimeout}, "http://" + addr
+	}
+
+	return &http.Client{
+		Timeout: localClientTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}, "http://unix"
+}
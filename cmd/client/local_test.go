@@ -0,0 +1,88 @@
+//go:build unix
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckLocalAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		ok   bool
+	}{
+		{"127.0.0.1:8081", true},
+		{"[::1]:8081", true},
+		{"localhost:8081", true},
+		{"unix:/run/tunnel/admin.sock", true},
+		{"0.0.0.0:8081", false},
+		{":8081", false},
+		{"[::]:8081", false},
+		{"192.168.1.10:8081", false},
+		{"example.com:8081", false},
+		{"127.0.0.1", false},
+	}
+	for _, tc := range tests {
+		if err := checkLocalAddr(tc.addr); (err == nil) != tc.ok {
+			t.Errorf("checkLocalAddr(%q) = %v, want ok %v", tc.addr, err, tc.ok)
+		}
+	}
+}
+
+func TestLocalOnly(t *testing.T) {
+	handler := localOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name        string
+		method      string
+		host        string
+		contentType string
+		want        int
+	}{
+		{"get", http.MethodGet, "127.0.0.1:8081", "", http.StatusOK},
+		{"get ipv6", http.MethodGet, "[::1]:8081", "", http.StatusOK},
+		{"get unix socket", http.MethodGet, "unix", "", http.StatusOK},
+		{"get localhost", http.MethodGet, "localhost:8081", "", http.StatusOK},
+		{"rebound host", http.MethodGet, "attacker.example.com:8081", "", http.StatusForbidden},
+		{"post json", http.MethodPost, "127.0.0.1:8081", "application/json; charset=utf-8", http.StatusOK},
+		{"post form", http.MethodPost, "127.0.0.1:8081", "text/plain", http.StatusUnsupportedMediaType},
+		{"post without content type", http.MethodPost, "127.0.0.1:8081", "", http.StatusUnsupportedMediaType},
+		{"delete", http.MethodDelete, "127.0.0.1:8081", "", http.StatusOK},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "/forwards", strings.NewReader(`{}`))
+			req.Host = tc.host
+			if tc.contentType != "" {
+				req.Header.Set("Content-Type", tc.contentType)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tc.want {
+				t.Errorf("status code = %d, want %d", rec.Code, tc.want)
+			}
+		})
+	}
+}
+
+func TestListenLocalSocketPermissions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	listener, err := listenLocal("unix:" + path)
+	if err != nil {
+		t.Fatalf("listenLocal: %v", err)
+	}
+	defer listener.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat socket: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("socket permissions = %o, want 600", perm)
+	}
+}
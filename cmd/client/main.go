@@ -1,21 +1,30 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
+	"time"
 	"tunnel/internal/config"
 	"tunnel/pkg/api"
+	"tunnel/pkg/cert"
 	"tunnel/pkg/configurer"
+	"tunnel/pkg/health"
 
 	"github.com/joho/godotenv"
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula"
+	nebulaCert "github.com/slackhq/nebula/cert"
 	nebulaConfig "github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/overlay"
 	"github.com/slackhq/nebula/port_forwarder"
@@ -25,13 +34,33 @@ import (
 )
 
 type Config struct {
-	APIAddr          string `env:"API_ADDR" flag:"api-addr" default:"http://127.0.0.1:8080" usage:"tunnel server http api addr"`
-	NebulaListenAddr string `env:"NEBULA_LISTEN_ADDR" flag:"nebula-listen-addr" default:"0.0.0.0:4243" usage:"nebula tunnel control listen address"`
+	ServerConfig
 
-	ConnectionCfgPath string   `env:"CONN_CFG_PATH" flag:"conn-cfg-path" default:"conn.yaml" usage:"path to the tunnel connection data"`
-	PortMappings      []string `env:"PORT_MAPPINGS" flag:"port-mapping" usage:"PORT:DIAL_ADDRESS:tcp/udp/both formatted port mappings"`
+	NebulaListenAddr string        `env:"NEBULA_LISTEN_ADDR" flag:"nebula-listen-addr" default:"0.0.0.0:4243" usage:"nebula tunnel control listen address"`
+	LocalListenAddr  string        `env:"LOCAL_LISTEN_ADDR" flag:"local-listen-addr" default:"127.0.0.1:4280" usage:"listen address of the local health endpoints (leave empty to disable)"`
+	AdminListenAddr  string        `env:"ADMIN_LISTEN_ADDR" flag:"admin-listen-addr" validate:"local_addr" usage:"enables the local admin API at this loopback host:port or unix:/path/to/socket"`
+	CertMinValidity  time.Duration `env:"CERT_MIN_VALIDITY" flag:"cert-min-validity" default:"1h" usage:"readiness fails when the node certificate expires within this duration"`
 
-	Token string `env:"TOKEN" flag:"token" default:"" usage:"one-time/master token used for initial connection"`
+	PortMappings     []string `env:"PORT_MAPPINGS" flag:"port-mapping" usage:"PORT:DIAL_ADDRESS:tcp/udp/both formatted port mappings"`
+	PortMappingsFile string   `env:"PORT_MAPPINGS_FILE" flag:"port-mappings-file" usage:"file with additional port mappings, one per line, applied on change or SIGHUP"`
+	UnsafeNetworks   []string `env:"UNSAFE_NETWORKS" flag:"unsafe-network" usage:"local networks to expose to the server on enrollment (must be allowlisted by the server, requires TUN_DEV_NAME)"`
+	TUNDevName       string   `env:"TUN_DEV_NAME" flag:"tun-dev-name" usage:"use a kernel tun device with this name instead of the userspace stack (disables port mappings)"`
+
+	NodeName        string `env:"NODE_NAME" flag:"node-name" usage:"node name to enroll with (random if empty)"`
+	IdentityKeyPath string `env:"IDENTITY_KEY_PATH" flag:"identity-key-path" default:"identity.key" usage:"machine identity key, created on first enrollment; keep it apart from the conn cfg so a re-enrolling machine gets its previous address back (empty to enroll without one)"`
+
+	Token        string `env:"TOKEN" flag:"token" default:"" secret:"true" usage:"one-time/master token used for initial connection"`
+	RenewOnStart bool   `env:"RENEW_ON_START" flag:"renew-on-start" default:"true" usage:"renew the node certificate under the server's active CA on start"`
+}
+
+const mappingsWatchInterval = 2 * time.Second
+
+func (cfg Config) Validate() error {
+	// enrolling is the only use of the token
+	if _, err := os.Stat(cfg.ConnectionCfgPath); os.IsNotExist(err) && cfg.Token == "" {
+		return fmt.Errorf("TOKEN (--token) is required to enroll, %s doesn't exist", cfg.ConnectionCfgPath)
+	}
+	return nil
 }
 
 func main() {
@@ -40,9 +69,14 @@ func main() {
 		log.Printf("[WARN] loading .env: %v", err)
 	}
 
+	runCommand(os.Args[1:])
+}
+
+// run enrolls the node unless already enrolled and runs the tunnel
+func run(args []string) error {
 	cfg := Config{}
-	if err = config.LoadConfig(&cfg); err != nil {
-		log.Fatalf("failed to parse config: %v", err)
+	if err := config.LoadConfig(flag.NewFlagSet("run", flag.ExitOnError), &cfg, args); err != nil {
+		return fmt.Errorf("failed to parse config: %w", err)
 	}
 
 	l := logrus.New()
@@ -50,64 +84,83 @@ func main() {
 
 	connCfg := nebulaConfig.NewC(l)
 
+	client, err := cfg.client()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := interruptible()
+	defer cancel()
+
 	_, connCfgErr := os.Stat(cfg.ConnectionCfgPath)
 	if os.IsNotExist(connCfgErr) {
-		// TODO security, move that call to the api package
-		req, err := http.NewRequest(http.MethodGet, cfg.APIAddr+"/connect", nil)
-		if err != nil {
-			log.Fatalf("creating http request: %v", err)
+		if len(cfg.UnsafeNetworks) > 0 && cfg.TUNDevName == "" {
+			log.Printf("[WARN] unsafe networks requested without TUN_DEV_NAME, they won't be routed")
 		}
-
-		req.Header.Set("Authorization", "Bearer "+cfg.Token)
-
-		client := &http.Client{}
-		resp, err := client.Do(req)
-
-		if err != nil {
-			log.Fatalf("making http request: %v", err)
+		if err := enroll(ctx, client, cfg, connCfg); err != nil {
+			return fmt.Errorf("enroll: %w", err)
 		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			log.Fatalf("non-OK status code: %d", resp.StatusCode)
+	} else {
+		if err := connCfg.Load(cfg.ConnectionCfgPath); err != nil {
+			return fmt.Errorf("load conn cfg %s: %w", cfg.ConnectionCfgPath, err)
 		}
 
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			log.Fatalf("reading response body: %v", err)
+		if cfg.RenewOnStart {
+			if err := renew(ctx, client, cfg.ConnectionCfgPath, connCfg); err != nil {
+				log.Printf("[WARN] renewing certificate: %v", err)
+			}
 		}
+	}
 
-		var output api.ConnectGetOutput
-		if err := json.Unmarshal(body, &output); err != nil {
-			log.Fatalf("unmarshaling JSON response: %v\nresponse Body: %s", err, body)
-		}
+	var nebulaCtrl atomic.Pointer[nebula.Control]
+	healthChecker := &health.Checker{}
+	healthChecker.Add("cert", health.CertValidity(func() string {
+		return connCfg.GetString("pki.cert", "")
+	}, cfg.CertMinValidity))
+	healthChecker.Add("nebula", health.Nebula(nebulaCtrl.Load))
+	if cfg.TUNDevName != "" {
+		healthChecker.Add("tun", health.TUN(nebulaCtrl.Load))
+	}
+	if cfg.LocalListenAddr != "" {
+		serveLocal("health endpoints", cfg.LocalListenAddr, healthHandler(healthChecker))
+	}
 
-		connCfg.LoadString(output.ConnectionConfig)
+	if err := configurer.ApplyListen(connCfg, cfg.NebulaListenAddr); err != nil {
+		return fmt.Errorf("apply listen params: %w", err)
+	}
 
-		connCfgBytes, err := yaml.Marshal(connCfg.Settings)
+	if cfg.TUNDevName != "" {
+		if len(cfg.PortMappings) > 0 || cfg.PortMappingsFile != "" {
+			log.Printf("[WARN] port mappings are ignored in TUN mode")
+		}
+		if err := configurer.ApplyTUN(connCfg, cfg.TUNDevName); err != nil {
+			return fmt.Errorf("apply tun params: %w", err)
+		}
+
+		ctrl, err := nebula.Main(connCfg, false, "tunnel", l, nil)
 		if err != nil {
-			log.Fatal("marshal yaml conn cfg: %v", err)
+			return fmt.Errorf("nebula main: %w", err)
 		}
-		if err := os.WriteFile(cfg.ConnectionCfgPath, connCfgBytes, 0644); err != nil {
-			log.Fatalf("save conn cfg to %s: %v", cfg.ConnectionCfgPath, err)
+		ctrl.Start()
+		nebulaCtrl.Store(ctrl)
+		if cfg.AdminListenAddr != "" {
+			serveLocal("admin API", cfg.AdminListenAddr, (&admin{
+				ctrl:    nebulaCtrl.Load,
+				connCfg: connCfg,
+			}).handler())
 		}
-	} else {
-		connCfg.Load(cfg.ConnectionCfgPath)
-	}
 
-	err = configurer.ApplyListen(connCfg, cfg.NebulaListenAddr)
-	if err != nil {
-		log.Fatalf("apply listen params: %v", err)
-	}
+		signalChannel := make(chan os.Signal, 1)
+		signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
+		fmt.Println("Running, press ctrl+c to shutdown...")
+		<-signalChannel
 
-	err = configurer.ApplyPortMappings(connCfg, cfg.PortMappings)
-	if err != nil {
-		log.Fatalf("apply port mappings: %v", err)
+		ctrl.Stop()
+		return nil
 	}
 
 	ctrl, err := nebula.Main(connCfg, false, "tunnel", l, overlay.NewUserDeviceFromConfig)
 	if err != nil {
-		log.Fatalf("nebula main: %v", err)
+		return fmt.Errorf("nebula main: %w", err)
 	}
 
 	service, err := service.New(ctrl)
@@ -117,22 +170,216 @@ func main() {
 	}
 
 	fwdList := port_forwarder.NewPortForwardingList()
-	if err := port_forwarder.ParseConfig(l, connCfg, fwdList); err != nil {
-		util.LogWithContextIfNeeded("Failed to parse port forwarder config", err, l)
-		os.Exit(1)
-	}
 	pfService, err := port_forwarder.ConstructFromInitialFwdList(service, l, &fwdList)
 	if err != nil {
 		util.LogWithContextIfNeeded("Failed to start", err, l)
 		os.Exit(1)
 	}
 
-	pfService.Activate()
+	fwds := &forwards{
+		l:         l,
+		pfService: pfService,
+
+		static: cfg.PortMappings,
+		file:   cfg.PortMappingsFile,
+
+		notify: func(ports []api.ServicePort) error {
+			return client.PutServices(context.Background(), connCfg.GetString("pki.cert", ""), connCfg.GetString("pki.key", ""), ports)
+		},
+	}
+	if err := fwds.start(); err != nil {
+		return fmt.Errorf("apply port mappings: %w", err)
+	}
+	nebulaCtrl.Store(ctrl)
+	if cfg.AdminListenAddr != "" {
+		serveLocal("admin API", cfg.AdminListenAddr, (&admin{
+			ctrl:     nebulaCtrl.Load,
+			connCfg:  connCfg,
+			forwards: fwds,
+		}).handler())
+	}
+
+	stop := make(chan struct{})
+	go fwds.watch(mappingsWatchInterval, stop)
 
 	signalChannel := make(chan os.Signal, 1)
 	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
 	fmt.Println("Running, press ctrl+c to shutdown...")
 	<-signalChannel
 
+	close(stop)
 	service.CloseAndWait()
+	return nil
+}
+
+// enroll requests a connection config from the server with the token and
+// saves it to the conn cfg path
+func enroll(ctx context.Context, client *api.Client, cfg Config, connCfg *nebulaConfig.C) error {
+	var identityKey string
+	if cfg.IdentityKeyPath != "" {
+		var err error
+		if identityKey, err = loadIdentityKey(cfg.IdentityKeyPath); err != nil {
+			return fmt.Errorf("identity key: %w", err)
+		}
+	}
+
+	output, err := client.Connect(ctx, cfg.Token, identityKey, api.ConnectGetInput{
+		UnsafeNetworks: cfg.UnsafeNetworks,
+		Name:           cfg.NodeName,
+	})
+	switch {
+	case errors.Is(err, api.ErrTokenExpired):
+		return fmt.Errorf("the token has expired, ask for a new one: %w", err)
+	case errors.Is(err, api.ErrUnauthorized):
+		return fmt.Errorf("the token is invalid or already used: %w", err)
+	case err != nil:
+		return err
+	}
+
+	if err := connCfg.LoadString(output.ConnectionConfig); err != nil {
+		return fmt.Errorf("load conn cfg: %w", err)
+	}
+
+	return saveConnCfg(cfg.ConnectionCfgPath, connCfg)
+}
+
+func renew(ctx context.Context, client *api.Client, connCfgPath string, connCfg *nebulaConfig.C) error {
+	output, err := client.Renew(ctx, connCfg.GetString("pki.cert", ""), connCfg.GetString("pki.key", ""))
+	if err != nil {
+		return err
+	}
+
+	(*connCfg).Settings["pki"] = map[string]any{
+		"cert": output.Cert,
+		"key":  connCfg.GetString("pki.key", ""),
+		"ca":   output.CA,
+	}
+
+	return saveConnCfg(connCfgPath, connCfg)
+}
+
+func saveConnCfg(path string, connCfg *nebulaConfig.C) error {
+	connCfgBytes, err := yaml.Marshal(connCfg.Settings)
+	if err != nil {
+		return fmt.Errorf("marshal yaml conn cfg: %w", err)
+	}
+	if err := os.WriteFile(path, connCfgBytes, 0644); err != nil {
+		return fmt.Errorf("save conn cfg to %s: %w", path, err)
+	}
+	return nil
+}
+
+func certInspect(args []string) error {
+	fs := flag.NewFlagSet("cert inspect", flag.ExitOnError)
+	connCfgPath := fs.String("conn-cfg-path", envOr("CONN_CFG_PATH", "conn.yaml"), "path to the tunnel connection data")
+	remote := fs.Bool("remote", false, "verify with the server (requires master token)")
+	apiAddr := fs.String("api-addr", envOr("API_ADDR", "http://127.0.0.1:8080"), "tunnel server http api addr")
+	token := fs.String("token", os.Getenv("TOKEN"), "master token used for remote verification")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s cert inspect [flags] [cert.pem]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	connCfg := nebulaConfig.NewC(nil)
+	if err := connCfg.Load(*connCfgPath); err != nil && fs.NArg() == 0 {
+		return fmt.Errorf("load conn cfg %s: %w", *connCfgPath, err)
+	}
+
+	certPEM := connCfg.GetString("pki.cert", "")
+	if fs.NArg() > 0 {
+		b, err := os.ReadFile(fs.Arg(0))
+		if err != nil {
+			return fmt.Errorf("read cert: %w", err)
+		}
+		certPEM = string(b)
+	}
+
+	var output api.CertOutput
+	if *remote {
+		reqBody, err := json.Marshal(api.CertVerifyPostInput{Cert: certPEM})
+		if err != nil {
+			return fmt.Errorf("marshaling JSON request: %w", err)
+		}
+		req, err := http.NewRequest(http.MethodPost, *apiAddr+"/certs/verify", bytes.NewReader(reqBody))
+		if err != nil {
+			return fmt.Errorf("creating http request: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+*token)
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("making http request: %w", err)
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("reading response body: %w", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("non-OK status code: %d, response body: %s", resp.StatusCode, body)
+		}
+		if err := json.Unmarshal(body, &output); err != nil {
+			return fmt.Errorf("unmarshaling JSON response: %w", err)
+		}
+	} else {
+		info, err := cert.Inspect(certPEM)
+		if err != nil {
+			return err
+		}
+		output.Info = *info
+
+		if caPEM := connCfg.GetString("pki.ca", ""); caPEM != "" {
+			if _, err := cert.VerifyWithBundle(caPEM, certPEM); err != nil {
+				output.VerifyError = err.Error()
+			} else {
+				output.Trusted = true
+			}
+		}
+	}
+
+	return printJSON(output)
+}
+
+func envOr(name, def string) string {
+	if val, ok := os.LookupEnv(name); ok {
+		return val
+	}
+	return def
+}
+
+// loadIdentityKey returns the machine identity key PEM at path, generating
+// one on first use. Its fingerprint is the hardware ID of the machine.
+func loadIdentityKey(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err == nil {
+		return string(b), nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	keyPair, err := cert.GenerateKeyPair(nebulaCert.Curve_CURVE25519)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.WriteString(keyPair.KeyPEM); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	hardwareID, err := cert.KeyFingerprint(keyPair.CertPEM)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("[INFO] created identity key %s, hardware ID %s", path, hardwareID)
+	return keyPair.KeyPEM, nil
 }
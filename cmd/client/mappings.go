@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"tunnel/pkg/api"
+	"tunnel/pkg/configurer"
+
+	"github.com/sirupsen/logrus"
+	nebulaConfig "github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/port_forwarder"
+)
+
+// forwards keeps the port forwarder in sync with the configured mappings:
+// PORT_MAPPINGS plus the lines of PORT_MAPPINGS_FILE, re-read when the file
+// changes or on SIGHUP, and the changes made through the admin API. The
+// server's service catalog is told about every change.
+type forwards struct {
+	l         *logrus.Logger
+	pfService *port_forwarder.PortForwardingService
+
+	static []string
+	file   string
+
+	// notifies the server of the forwarded ports, calls are serialized by
+	// notifyMu so the last one carries the latest ports
+	notify   func(ports []api.ServicePort) error
+	notifyMu sync.Mutex
+
+	fileStat os.FileInfo
+
+	mu      sync.Mutex
+	current []string
+	// admin API changes, kept until restart
+	added    []string
+	removed  map[string]bool
+	counters map[string]*forwardCounters
+}
+
+// load returns the mappings as configured right now, f.mu must be held
+func (f *forwards) load() ([]string, error) {
+	configured := slices.Clone(f.static)
+	if f.file != "" {
+		fileMappings, err := readMappingsFile(f.file)
+		if err != nil {
+			return nil, err
+		}
+		configured = append(configured, fileMappings...)
+	}
+
+	mappings := []string{}
+	for _, m := range append(configured, f.added...) {
+		if !f.removed[m] && !slices.Contains(mappings, m) {
+			mappings = append(mappings, m)
+		}
+	}
+	return mappings, nil
+}
+
+// apply opens the forwards of new mappings and closes the ones of removed
+// mappings, established forwards of unchanged mappings are kept. f.mu must
+// be held.
+func (f *forwards) apply(mappings []string) error {
+	fwdList := port_forwarder.NewPortForwardingList()
+	udpMappings := []string{}
+	for _, mapping := range mappings {
+		m, err := configurer.ParsePortMapping(mapping)
+		if err != nil {
+			return err
+		}
+		for _, proto := range m.Protocols {
+			switch proto {
+			case "tcp":
+				fwd := tcpForward{port: m.ListenPort, dialAddress: m.DialAddress}
+				fwd.counters = f.countersOf(fwd.ConfigDescriptor())
+				fwdList.AddConfig(fwd)
+			case "udp":
+				udpMappings = append(udpMappings, fmt.Sprintf("%d:%s:udp", m.ListenPort, m.DialAddress))
+			}
+		}
+	}
+
+	c := nebulaConfig.NewC(f.l)
+	if err := configurer.ApplyPortMappings(c, udpMappings); err != nil {
+		return err
+	}
+	if err := port_forwarder.ParseConfig(f.l, c, fwdList); err != nil {
+		return fmt.Errorf("parse port forwarder config: %w", err)
+	}
+
+	if err := f.pfService.ApplyChangesByNewFwdList(&fwdList); err != nil {
+		return fmt.Errorf("apply port forwards: %w", err)
+	}
+	f.current = mappings
+	return nil
+}
+
+// notifyServices tells the server about the current ports, f.mu must not be
+// held as the call goes over the network
+func (f *forwards) notifyServices() {
+	if f.notify == nil {
+		return
+	}
+	f.notifyMu.Lock()
+	defer f.notifyMu.Unlock()
+
+	f.mu.Lock()
+	ports := servicePorts(f.current)
+	f.mu.Unlock()
+
+	if err := f.notify(ports); err != nil {
+		log.Printf("[WARN] updating service catalog: %v", err)
+	}
+}
+
+func (f *forwards) countersOf(descriptor string) *forwardCounters {
+	if f.counters == nil {
+		f.counters = map[string]*forwardCounters{}
+	}
+	c, ok := f.counters[descriptor]
+	if !ok {
+		c = &forwardCounters{}
+		f.counters[descriptor] = c
+	}
+	return c
+}
+
+// start applies the configured mappings
+func (f *forwards) start() error {
+	f.mu.Lock()
+	mappings, err := f.load()
+	if err == nil {
+		err = f.apply(mappings)
+	}
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	f.notifyServices()
+	return nil
+}
+
+func (f *forwards) reload() error {
+	changed, err := f.reapply()
+	if err != nil || !changed {
+		return err
+	}
+
+	f.notifyServices()
+	return nil
+}
+
+// reapply applies the configured mappings if they changed, telling whether
+// they did
+func (f *forwards) reapply() (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	mappings, err := f.load()
+	if err != nil {
+		return false, fmt.Errorf("loading port mappings: %w", err)
+	}
+	if slices.Equal(mappings, f.current) {
+		return false, nil
+	}
+
+	if err := f.apply(mappings); err != nil {
+		return false, err
+	}
+	log.Printf("[INFO] applied %d port mappings", len(mappings))
+	return true, nil
+}
+
+// add forwards mapping until restart
+func (f *forwards) add(mapping string) error {
+	if _, err := configurer.ParsePortMapping(mapping); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	delete(f.removed, mapping)
+	if !slices.Contains(f.added, mapping) {
+		f.added = append(f.added, mapping)
+	}
+	f.mu.Unlock()
+
+	return f.reload()
+}
+
+// remove stops forwarding mapping until restart, even if it's configured
+func (f *forwards) remove(mapping string) error {
+	f.mu.Lock()
+	if !slices.Contains(f.current, mapping) {
+		f.mu.Unlock()
+		return errForwardNotFound
+	}
+	f.added = slices.DeleteFunc(f.added, func(m string) bool { return m == mapping })
+	if f.removed == nil {
+		f.removed = map[string]bool{}
+	}
+	f.removed[mapping] = true
+	f.mu.Unlock()
+
+	return f.reload()
+}
+
+var errForwardNotFound = errors.New("port mapping not forwarded")
+
+type forwardInfo struct {
+	Mapping     string   `json:"mapping"`
+	ListenPort  int      `json:"listen_port"`
+	DialAddress string   `json:"dial_address"`
+	Protocols   []string `json:"protocols"`
+	// connections of the TCP forward, UDP is connectionless
+	Connections *forwardStats `json:"connections,omitempty"`
+}
+
+func (f *forwards) list() []forwardInfo {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	infos := []forwardInfo{}
+	for _, mapping := range f.current {
+		m, err := configurer.ParsePortMapping(mapping)
+		if err != nil {
+			continue
+		}
+		info := forwardInfo{
+			Mapping:     mapping,
+			ListenPort:  m.ListenPort,
+			DialAddress: m.DialAddress,
+			Protocols:   m.Protocols,
+		}
+		if slices.Contains(m.Protocols, "tcp") {
+			fwd := tcpForward{port: m.ListenPort, dialAddress: m.DialAddress}
+			stats := f.countersOf(fwd.ConfigDescriptor()).stats()
+			info.Connections = &stats
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// watch reloads on SIGHUP and when the mappings file changes
+func (f *forwards) watch(interval time.Duration, stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hup:
+			log.Printf("[INFO] caught SIGHUP, reloading port mappings")
+			if err := f.reload(); err != nil {
+				log.Printf("[WARN] %v", err)
+			}
+		case <-ticker.C:
+			if !f.fileChanged() {
+				continue
+			}
+			if err := f.reload(); err != nil {
+				log.Printf("[WARN] %v", err)
+			}
+		}
+	}
+}
+
+func (f *forwards) fileChanged() bool {
+	if f.file == "" {
+		return false
+	}
+	stat, err := os.Stat(f.file)
+	if err != nil {
+		if f.fileStat != nil {
+			log.Printf("[WARN] port mappings file: %v", err)
+		}
+		changed := f.fileStat != nil
+		f.fileStat = nil
+		return changed
+	}
+	changed := f.fileStat == nil ||
+		!stat.ModTime().Equal(f.fileStat.ModTime()) ||
+		stat.Size() != f.fileStat.Size()
+	f.fileStat = stat
+	return changed
+}
+
+// readMappingsFile reads one mapping per line, skipping empty lines and #
+// comments
+func readMappingsFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	mappings := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		mappings = append(mappings, line)
+	}
+	return mappings, scanner.Err()
+}
+
+func servicePorts(mappings []string) []api.ServicePort {
+	ports := []api.ServicePort{}
+	for _, mapping := range mappings {
+		m, err := configurer.ParsePortMapping(mapping)
+		if err != nil {
+			continue
+		}
+		for _, proto := range m.Protocols {
+			p := api.ServicePort{Port: m.ListenPort, Protocol: proto}
+			if !slices.Contains(ports, p) {
+				ports = append(ports, p)
+			}
+		}
+	}
+	return ports
+}
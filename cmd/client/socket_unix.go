@@ -0,0 +1,17 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenSocket creates the socket with the umask cleared of group and other
+// bits, so there's no window in which anyone but the owner can connect
+func listenSocket(path string) (net.Listener, error) {
+	old := syscall.Umask(0177)
+	defer syscall.Umask(old)
+
+	return net.Listen("unix", path)
+}
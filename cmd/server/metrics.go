@@ -0,0 +1,122 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+	"tunnel/pkg/api"
+	"tunnel/pkg/ipam"
+	"tunnel/pkg/metrics"
+
+	gometrics "github.com/rcrowley/go-metrics"
+
+	mp "github.com/nbrownus/go-metrics-prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/slackhq/nebula"
+)
+
+var (
+	ipamUtilizationDesc = prometheus.NewDesc(
+		"tunnel_ipam_utilization_percent",
+		"Percentage of the addresses of a network that can't be handed out anymore.",
+		[]string{"pool", "network"}, nil,
+	)
+	ipamUsedDesc = prometheus.NewDesc(
+		"tunnel_ipam_addresses_used",
+		"Addresses of a network held by nodes or passed by the allocation cursor.",
+		[]string{"pool", "network"}, nil,
+	)
+	ipamFreeDesc = prometheus.NewDesc(
+		"tunnel_ipam_addresses_free",
+		"Addresses of a network that can still be handed out.",
+		[]string{"pool", "network"}, nil,
+	)
+	nodesOnlineDesc = prometheus.NewDesc(
+		"tunnel_nodes_online",
+		"Nodes the server has an established tunnel to.",
+		nil, nil,
+	)
+	nodeTxMessagesDesc = prometheus.NewDesc(
+		"tunnel_node_tx_messages_total",
+		"Messages, data and tunnel control alike, the server sent to a node over the current tunnel. Restarts with every new tunnel.",
+		[]string{"node", "vpn_addrs"}, nil,
+	)
+)
+
+// ipamCollector reports the network usage at scrape time
+type ipamCollector struct {
+	ipamService ipam.IPAMService
+	nodeService api.NodeService
+}
+
+func (c ipamCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ipamUtilizationDesc
+	ch <- ipamUsedDesc
+	ch <- ipamFreeDesc
+}
+
+func (c ipamCollector) Collect(ch chan<- prometheus.Metric) {
+	nodes, err := c.nodeService.ListActive()
+	if err != nil {
+		log.Printf("[WARN] metrics: list nodes: %v", err)
+		return
+	}
+	var leases []string
+	for _, n := range nodes {
+		leases = append(leases, n.IPs...)
+	}
+	usage, err := c.ipamService.Usage(leases)
+	if err != nil {
+		log.Printf("[WARN] metrics: ipam usage: %v", err)
+		return
+	}
+
+	for _, n := range usage.Networks {
+		pool := n.Pool
+		if pool == "" {
+			pool = "default"
+		}
+		ch <- prometheus.MustNewConstMetric(ipamUtilizationDesc, prometheus.GaugeValue, n.Utilization, pool, n.NetworkCIDR)
+		ch <- prometheus.MustNewConstMetric(ipamUsedDesc, prometheus.GaugeValue, float64(n.Used), pool, n.NetworkCIDR)
+		ch <- prometheus.MustNewConstMetric(ipamFreeDesc, prometheus.GaugeValue, float64(n.Free), pool, n.NetworkCIDR)
+	}
+}
+
+// hostmapCollector reports the tunnels of the embedded nebula instance.
+// Nebula counts neither bytes nor received messages per host, the only per
+// host counter is the nonce of the messages sent over the tunnel. Traffic
+// totals over all nodes are in the nebula_messages_* metrics.
+type hostmapCollector struct {
+	ctrl *nebula.Control
+}
+
+func (c hostmapCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- nodesOnlineDesc
+	ch <- nodeTxMessagesDesc
+}
+
+func (c hostmapCollector) Collect(ch chan<- prometheus.Metric) {
+	online := 0
+	for _, h := range c.ctrl.ListHostmapHosts(false) {
+		if h.Cert == nil {
+			continue
+		}
+		online++
+
+		addrs := make([]string, 0, len(h.VpnAddrs))
+		for _, a := range h.VpnAddrs {
+			addrs = append(addrs, a.String())
+		}
+		ch <- prometheus.MustNewConstMetric(nodeTxMessagesDesc, prometheus.CounterValue, float64(h.MessageCounter), h.Cert.Name(), strings.Join(addrs, ","))
+	}
+	ch <- prometheus.MustNewConstMetric(nodesOnlineDesc, prometheus.GaugeValue, float64(online))
+}
+
+// registerNebulaMetrics exposes the go-metrics nebula records (messages,
+// handshakes, firewall drops, ...) next to our own ones
+func registerNebulaMetrics(ctrl *nebula.Control, interval time.Duration) {
+	metrics.Registry.MustRegister(hostmapCollector{ctrl: ctrl})
+
+	p := mp.NewPrometheusProvider(gometrics.DefaultRegistry, "nebula", "", metrics.Registry, interval)
+	go p.UpdatePrometheusMetrics()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log"
+	"time"
+	"tunnel/pkg/events"
+
+	"github.com/slackhq/nebula"
+)
+
+// presenceWatcher emits online/offline events for nodes the server gains
+// or loses a tunnel to
+type presenceWatcher struct {
+	ctrl         *nebula.Control
+	eventService events.EventService
+
+	online map[string]bool
+}
+
+func (w *presenceWatcher) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		w.poll()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *presenceWatcher) poll() {
+	current := map[string]bool{}
+	for _, h := range w.ctrl.ListHostmapHosts(false) {
+		if h.Cert != nil {
+			current[h.Cert.Name()] = true
+		}
+	}
+
+	for name := range current {
+		if !w.online[name] {
+			w.publish(events.TypeNodeOnline, name)
+		}
+	}
+	for name := range w.online {
+		if !current[name] {
+			w.publish(events.TypeNodeOffline, name)
+		}
+	}
+	w.online = current
+}
+
+func (w *presenceWatcher) publish(eventType, name string) {
+	if _, err := w.eventService.Publish(eventType, name, nil); err != nil {
+		log.Printf("[WARN] publishing %s event for %s: %v", eventType, name, err)
+	}
+}
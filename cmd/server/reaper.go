@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+	"tunnel/pkg/api"
+	"tunnel/pkg/events"
+	"tunnel/pkg/ipam"
+)
+
+// leaseReaper tears down nodes whose lease has ended: their certs get
+// revoked, their addresses released and their unsafe routes removed
+type leaseReaper struct {
+	nodeService  api.NodeService
+	ipamService  ipam.IPAMService
+	eventService events.EventService
+
+	// how long before the lease end the expiring event is emitted
+	warnBefore time.Duration
+
+	serverConfigChanged func() error
+}
+
+func (r leaseReaper) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.reap(); err != nil {
+			log.Printf("[WARN] reaping expired leases: %v", err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r leaseReaper) reap() error {
+	now := time.Now()
+
+	expiring, err := r.nodeService.ExpiringLeases(now.Add(r.warnBefore))
+	if err != nil {
+		return fmt.Errorf("list expiring leases: %w", err)
+	}
+	for _, n := range expiring {
+		if n.LeaseEndsAt.After(now) {
+			if _, err := r.eventService.Publish(events.TypeNodeLeaseExpiring, n.Name, map[string]any{
+				"lease_ends_at": n.LeaseEndsAt,
+				"ips":           n.IPs,
+			}); err != nil {
+				log.Printf("[WARN] publishing lease expiring event for %s: %v", n.Name, err)
+			}
+		}
+		if err := r.nodeService.MarkLeaseWarned(n.Name); err != nil {
+			return fmt.Errorf("mark lease of %s warned: %w", n.Name, err)
+		}
+	}
+
+	expired, err := r.nodeService.ExpiredLeases(now)
+	if err != nil {
+		return fmt.Errorf("list expired leases: %w", err)
+	}
+	// a failing node must not keep the revoked ones in the server config
+	revoked := 0
+	for _, n := range expired {
+		if _, err := api.RevokeNode(r.nodeService, r.ipamService, n.Name); err != nil {
+			log.Printf("[WARN] revoking %s: %v", n.Name, err)
+			continue
+		}
+		revoked++
+		log.Printf("[INFO] lease of %s ended, revoked and released %v", n.Name, n.IPs)
+
+		if _, err := r.eventService.Publish(events.TypeNodeLeaseExpired, n.Name, map[string]any{
+			"lease_ends_at":   n.LeaseEndsAt,
+			"ips":             n.IPs,
+			"unsafe_networks": n.UnsafeNetworks,
+		}); err != nil {
+			log.Printf("[WARN] publishing lease expired event for %s: %v", n.Name, err)
+		}
+	}
+
+	// drop the blocklisted certs and routes of the expired nodes from the
+	// server config
+	if revoked > 0 && r.serverConfigChanged != nil {
+		if err := r.serverConfigChanged(); err != nil {
+			return fmt.Errorf("apply server config: %w", err)
+		}
+	}
+
+	if revoked < len(expired) {
+		return fmt.Errorf("%d of %d expired nodes not revoked", len(expired)-revoked, len(expired))
+	}
+	return nil
+}
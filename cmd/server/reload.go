@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"tunnel/internal/config"
+	"tunnel/pkg/api"
+
+	"github.com/joho/godotenv"
+	nebulaConfig "github.com/slackhq/nebula/config"
+)
+
+// reloader reloads the Config on SIGHUP or through the API. Only the
+// fields in liveFields and the nebula conn cfg are applied, other changes
+// are reported as requiring a restart.
+type reloader struct {
+	mu   sync.Mutex
+	cfg  Config
+	args []string
+
+	envKeys map[string]bool
+
+	settings      *api.Settings
+	reloadConnCfg func() error
+}
+
+var liveFields = map[string]bool{
+	"CORSAllowOrigins":        true,
+	"UnsafeNetworksAllowlist": true,
+	"Blocklist":               true,
+	"CARetireGrace":           true,
+}
+
+func (r *reloader) run(stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hup:
+			log.Printf("[INFO] caught SIGHUP, reloading config")
+			result, err := r.reload()
+			if err != nil {
+				log.Printf("[WARN] reloading config: %v", err)
+				continue
+			}
+			log.Printf("[INFO] reloaded config, applied: %s", strings.Join(result.Applied, ", "))
+			if len(result.RestartRequired) > 0 {
+				log.Printf("[WARN] changed settings requiring a restart: %s", strings.Join(result.RestartRequired, ", "))
+			}
+		}
+	}
+}
+
+func (r *reloader) reload() (*api.ReloadResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// keys removed from .env stay set
+	env, err := godotenv.Read()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: reading .env: %v", api.ErrInvalidConfig, err)
+	}
+	for k, v := range env {
+		if !r.envKeys[k] {
+			os.Setenv(k, v)
+		}
+	}
+
+	cfg := Config{}
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	if err := config.LoadConfig(fs, &cfg, r.args); err != nil {
+		return nil, fmt.Errorf("%w: %v", api.ErrInvalidConfig, err)
+	}
+	allowlist, err := parseAllowlist(cfg.UnsafeNetworksAllowlist)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unsafe networks allowlist: %v", api.ErrInvalidConfig, err)
+	}
+
+	result := &api.ReloadResult{
+		Applied:         []string{},
+		RestartRequired: []string{},
+	}
+	running := reflect.ValueOf(&r.cfg).Elem()
+	loaded := reflect.ValueOf(cfg)
+	for i := 0; i < running.NumField(); i++ {
+		if reflect.DeepEqual(running.Field(i).Interface(), loaded.Field(i).Interface()) {
+			continue
+		}
+		field := running.Type().Field(i)
+		if liveFields[field.Name] {
+			result.Applied = append(result.Applied, field.Tag.Get("env"))
+		} else {
+			result.RestartRequired = append(result.RestartRequired, field.Tag.Get("env"))
+		}
+	}
+
+	previous := r.settings.Set(api.SettingsValues{
+		AllowedOrigins:          cfg.CORSAllowOrigins,
+		UnsafeNetworksAllowlist: allowlist,
+		Blocklist:               cfg.Blocklist,
+		CARetireGrace:           cfg.CARetireGrace,
+	})
+	if err := r.reloadConnCfg(); err != nil {
+		r.settings.Set(previous)
+		return nil, fmt.Errorf("%w: conn cfg: %v", api.ErrInvalidConfig, err)
+	}
+	result.Applied = append(result.Applied, r.cfg.ConnectionCfgPath)
+
+	for i := 0; i < running.NumField(); i++ {
+		if liveFields[running.Type().Field(i).Name] {
+			running.Field(i).Set(loaded.Field(i))
+		}
+	}
+	return result, nil
+}
+
+func environKeys() map[string]bool {
+	keys := map[string]bool{}
+	for _, kv := range os.Environ() {
+		k, _, _ := strings.Cut(kv, "=")
+		keys[k] = true
+	}
+	return keys
+}
+
+// loadConnCfg loads the nebula config from path without remembering the
+// path, so nebula doesn't reload it on SIGHUP behind our back
+func loadConnCfg(c *nebulaConfig.C, path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return c.LoadString(string(raw))
+}
+
+func parseAllowlist(networks []string) ([]netip.Prefix, error) {
+	allowlist := []netip.Prefix{}
+	for _, n := range networks {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(n))
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry %s: %w", n, err)
+		}
+		allowlist = append(allowlist, prefix.Masked())
+	}
+	return allowlist, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+	"tunnel/pkg/api"
+)
+
+const (
+	certWatchInterval = 10 * time.Second
+
+	selfSignedValidity    = 365 * 24 * time.Hour
+	selfSignedRenewBefore = 30 * 24 * time.Hour
+)
+
+type TLSConfig struct {
+	Mode         string   `env:"MODE" flag:"mode" default:"off" validate:"oneof=off files self-signed" usage:"API TLS: off, files (the cert and key files, reloaded on change) or self-signed (generated into those files, renewed with the same key)"`
+	CertPath     string   `env:"CERT_PATH" flag:"cert-path" default:"api.crt" usage:"path to the API TLS certificate chain"`
+	KeyPath      string   `env:"KEY_PATH" flag:"key-path" default:"api.key" usage:"path to the API TLS key"`
+	Hosts        []string `env:"HOSTS" flag:"host" default:"localhost,127.0.0.1,::1" usage:"DNS names and IPs of the self-signed certificate"`
+	ClientCAPath string   `env:"CLIENT_CA_PATH" flag:"client-ca-path" usage:"CAs of operator client certificates, which authenticate like the master token, from anywhere (mutual TLS)"`
+}
+
+func (cfg Config) Validate() error {
+	var errs []error
+	if cfg.TLS.Mode == "off" && cfg.TLS.ClientCAPath != "" {
+		errs = append(errs, fmt.Errorf("TLS_CLIENT_CA_PATH (--tls-client-ca-path) requires TLS_MODE files or self-signed"))
+	}
+	// receivers couldn't tell forged events from ours
+	if len(cfg.Webhooks) > 0 && cfg.WebhookSecret == "" {
+		errs = append(errs, fmt.Errorf("WEBHOOK_SECRET (--webhook-secret) is required with WEBHOOKS (--webhook)"))
+	}
+	return errors.Join(errs...)
+}
+
+// apiTLS returns the TLS config of the API listener and the reloader of its
+// certificate, nil for both with TLS off
+func apiTLS(cfg TLSConfig) (*tls.Config, *api.CertReloader, error) {
+	if cfg.Mode == "off" {
+		log.Printf("[WARN] API TLS is off, enrollments send node keys in plain text")
+		return nil, nil, nil
+	}
+
+	var ensureSelfSigned func() error
+	if cfg.Mode == "self-signed" {
+		ensureSelfSigned = func() error {
+			return api.EnsureSelfSigned(cfg.CertPath, cfg.KeyPath, cfg.Hosts, selfSignedValidity, selfSignedRenewBefore)
+		}
+		if err := ensureSelfSigned(); err != nil {
+			return nil, nil, err
+		}
+	}
+	certReloader, err := api.NewCertReloader(cfg.CertPath, cfg.KeyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	// renewed before it expires while the server keeps running
+	certReloader.Renew = ensureSelfSigned
+	leaf := certReloader.Leaf()
+	log.Printf("[INFO] API TLS certificate %s valid until %s, clients can pin it with API_PINS=%s",
+		api.CertFingerprint(leaf), leaf.NotAfter.Format(time.RFC3339), api.SPKIPin(leaf))
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certReloader.GetCertificate,
+	}
+
+	if cfg.ClientCAPath != "" {
+		bundle, err := os.ReadFile(cfg.ClientCAPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("read client CAs: %w", err)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(bundle) {
+			return nil, nil, fmt.Errorf("no certificates found in %s", cfg.ClientCAPath)
+		}
+		// nodes authenticate with tokens and nebula certs, not client certs
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		tlsConfig.ClientCAs = clientCAs
+	}
+
+	return tlsConfig, certReloader, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"tunnel/internal/config"
+	"tunnel/pkg/cert"
+
+	"github.com/joho/godotenv"
+)
+
+type Config struct {
+	SocketPath string `env:"SIGNER_SOCKET" flag:"signer-socket" default:"signer.sock" validate:"required" usage:"unix socket to serve signing requests on"`
+	Backend    string `env:"SIGNER_BACKEND" flag:"signer-backend" default:"file" validate:"oneof=file pkcs11" usage:"signing key backend (file/pkcs11)"`
+
+	CAKeyPath           string `env:"CA_KEY_PATH" flag:"ca-key-path" default:"ca.key" usage:"path to the ca.key file"`
+	CAKeyPassphrase     string `env:"CA_KEY_PASSPHRASE" secret:"true" usage:"passphrase used to unlock the ca.key file (prompted for if empty and stdin is a terminal)"`
+	CAKeyPassphraseFile string `env:"CA_KEY_PASSPHRASE_FILE" flag:"ca-key-passphrase-file" usage:"path to the file containing the ca.key passphrase"`
+	CAPKCS11URI         string `env:"CA_PKCS11_URI" flag:"ca-pkcs11-uri" usage:"PKCS#11 URI of the CA key (pkcs11 backend)"`
+}
+
+func main() {
+	err := godotenv.Load()
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("[WARN] loading .env: %v", err)
+	}
+
+	cfg := Config{}
+	if err = config.LoadConfig(flag.CommandLine, &cfg, os.Args[1:]); err != nil {
+		log.Fatalf("failed to parse config: %v", err)
+	}
+
+	var signer cert.Signer
+	switch cfg.Backend {
+	case "file":
+		caKeyPEM, err := os.ReadFile(cfg.CAKeyPath)
+		if err != nil {
+			log.Fatalf("read CA key from %s: %v", cfg.CAKeyPath, err)
+		}
+		passphrase, err := cert.ResolvePassphrase(cfg.CAKeyPassphrase, cfg.CAKeyPassphraseFile, cert.IsEncryptedKeyPEM(caKeyPEM))
+		if err != nil {
+			log.Fatalf("CA key passphrase: %v", err)
+		}
+		signer, err = cert.NewKeySigner(caKeyPEM, passphrase)
+		if err != nil {
+			log.Fatalf("load CA key: %v", err)
+		}
+	case "pkcs11":
+		p11Signer, err := cert.NewPKCS11Signer(cfg.CAPKCS11URI)
+		if err != nil {
+			log.Fatalf("open PKCS#11 CA signer: %v", err)
+		}
+		defer p11Signer.Close()
+		signer = p11Signer
+	default:
+		log.Fatalf("unknown signer backend: %s", cfg.Backend)
+	}
+
+	if err := os.Remove(cfg.SocketPath); err != nil && !os.IsNotExist(err) {
+		log.Fatalf("remove stale socket %s: %v", cfg.SocketPath, err)
+	}
+	listener, err := listenSocket(cfg.SocketPath)
+	if err != nil {
+		log.Fatalf("listen at %s: %v", cfg.SocketPath, err)
+	}
+
+	go func() {
+		if err := cert.ServeSigner(listener, signer); err != nil {
+			log.Fatalf("serving at %s: %v", cfg.SocketPath, err)
+		}
+	}()
+
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
+	fmt.Printf("Serving %s CA signer at %s, press ctrl+c to shutdown...\n", signer.Curve(), cfg.SocketPath)
+	<-signalChannel
+
+	listener.Close()
+}
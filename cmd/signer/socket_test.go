@@ -0,0 +1,26 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenSocketPermissions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "signer.sock")
+	l, err := listenSocket(path)
+	if err != nil {
+		t.Fatalf("listenSocket: %v", err)
+	}
+	defer l.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat socket: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("socket permissions = %o, want 600", perm)
+	}
+}
@@ -1,36 +1,52 @@
 package config
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"reflect"
-	"strconv"
 	"strings"
 )
 
-type StringSliceValue struct {
-	Target *[]string
-}
-
-func NewStringSliceValue(s *[]string) *StringSliceValue {
-	return &StringSliceValue{Target: s}
-}
+// FileEnv and FileFlag name the env variable and the flag pointing at the
+// optional YAML/JSON config file, PrintFlag the flag dumping the loaded
+// config with the secrets redacted
+const (
+	FileEnv   = "CONFIG_FILE"
+	FileFlag  = "config"
+	PrintFlag = "print-config"
+)
 
-func (s *StringSliceValue) String() string {
-	if s.Target == nil {
-		return ""
-	}
-	return strings.Join(*s.Target, ",")
-}
+// field is a leaf of a config struct with its env variable, flag and key
+// path in the config file resolved
+type field struct {
+	value reflect.Value
+	env   string
+	flag  string
+	key   []string
+	def   string
+	usage string
 
-func (s *StringSliceValue) Set(value string) error {
-	*s.Target = append(*s.Target, value)
-	return nil
+	// validate tag, see validate
+	validate string
+	// secret fields are redacted when printed and read from the file named
+	// by the env variable suffixed with _FILE when the env variable is unset
+	secret  bool
+	fileEnv string
 }
 
-func LoadConfig(cfg interface{}) error {
+// LoadConfig fills cfg from, in increasing precedence, the default tags, the
+// config file, the env variables and args, and registers the fields as flags
+// of fs. Nested structs prefix the env variables (with _), flags (with -)
+// and file keys (as a nested object) of their fields with their own tags,
+// embedded ones share their fields without a prefix.
+//
+// The loaded config is validated by the validate tags and, if cfg
+// implements Validator, its Validate method. All problems are reported at
+// once in the returned error.
+func LoadConfig(fs *flag.FlagSet, cfg interface{}, args []string) error {
 	configValue := reflect.ValueOf(cfg)
 	if configValue.Kind() != reflect.Ptr {
 		return fmt.Errorf(
@@ -47,66 +63,227 @@ func LoadConfig(cfg interface{}) error {
 		)
 	}
 
-	configType := configValue.Type()
+	fields := collect(configValue, "", "", nil)
 
-	for i := 0; i < configType.NumField(); i++ {
-		field := configType.Field(i)
+	// secrets get a _FILE variant unless the config has a field by that name
+	envs := map[string]bool{}
+	for _, f := range fields {
+		envs[f.env] = true
+	}
+	for i, f := range fields {
+		if f.secret && f.env != "" && !envs[f.env+"_FILE"] {
+			fields[i].fileEnv = f.env + "_FILE"
+		}
+	}
 
-		flagName := field.Tag.Get("flag")
-		envName := field.Tag.Get("env")
-		defaultValue := field.Tag.Get("default")
-		usage := field.Tag.Get("usage")
+	for _, f := range fields {
+		if f.def == "" {
+			continue
+		}
+		if err := setString(f.value, f.def); err != nil {
+			return fmt.Errorf("default of %s: %w", f.describe(), err)
+		}
+	}
 
-		fieldValue := configValue.Field(i)
+	var errs []error
 
-		if val, ok := os.LookupEnv(envName); ok {
-			switch field.Type.Kind() {
-			case reflect.String, reflect.Bool:
-				defaultValue = val
-			case reflect.Slice:
-				if field.Type.Elem().Kind() == reflect.String {
-					if len(val) > 0 {
-						stringSlice := strings.Split(val, ",")
-						fieldValue.Set(reflect.ValueOf(stringSlice))
-					}
-				}
-			}
+	filePath := fileArg(args)
+	if filePath == "" {
+		filePath = os.Getenv(FileEnv)
+	}
+	if fs.Lookup(FileFlag) == nil {
+		fs.String(FileFlag, filePath, "YAML or JSON config file, overridden by env variables and flags (env "+FileEnv+")")
+	}
+	if filePath != "" {
+		if err := loadFile(filePath, fields); err != nil {
+			errs = append(errs, fmt.Errorf("config file %s: %w", filePath, err))
+		}
+	}
+
+	for _, f := range fields {
+		if err := loadEnv(f); err != nil {
+			errs = append(errs, err)
 		}
+	}
+
+	for _, f := range fields {
+		if f.flag == "" {
+			continue
+		}
+		switch ptr := f.value.Addr().Interface().(type) {
+		case *string:
+			fs.StringVar(ptr, f.flag, *ptr, f.usage)
+		case *bool:
+			fs.BoolVar(ptr, f.flag, *ptr, f.usage)
+		default:
+			fs.Var(&flagValue{value: f.value}, f.flag, f.usage)
+		}
+	}
+	var printConfig *bool
+	if fs.Lookup(PrintFlag) == nil {
+		printConfig = fs.Bool(PrintFlag, false, "print the loaded config with the secrets redacted and exit")
+	}
 
-		switch field.Type.Kind() {
-		case reflect.String:
-			defVal := defaultValue
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
 
-			ptr := fieldValue.Addr().Interface().(*string)
-			flag.StringVar(ptr, flagName, defVal, usage)
+	errs = append(errs, validate(fields)...)
+	if v, ok := cfg.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
 
-		case reflect.Bool:
-			defVal, err := strconv.ParseBool(defaultValue)
+	if printConfig != nil && *printConfig {
+		if err := dump(os.Stdout, fields); err != nil {
+			errs = append(errs, err)
+		}
+		if err := errors.Join(errs...); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid config:\n%v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	return errors.Join(errs...)
+}
+
+// loadEnv sets f from its env variable or, for secrets, the file its _FILE
+// variant points at
+func loadEnv(f field) error {
+	if f.env == "" {
+		return nil
+	}
+
+	val, ok := os.LookupEnv(f.env)
+	if f.fileEnv != "" {
+		if path, fileOk := os.LookupEnv(f.fileEnv); fileOk {
+			if ok {
+				return fmt.Errorf("%s: both %s and %s are set", f.describe(), f.env, f.fileEnv)
+			}
+			b, err := os.ReadFile(path)
 			if err != nil {
-				defVal = false
+				return fmt.Errorf("%s: %w", f.describe(), err)
 			}
+			val, ok = strings.TrimRight(string(b), "\r\n"), true
+		}
+	}
+	if !ok {
+		return nil
+	}
+
+	if err := setString(f.value, val); err != nil {
+		return fmt.Errorf("%s: %w", f.describe(), err)
+	}
+	return nil
+}
+
+func collect(v reflect.Value, envPrefix, flagPrefix string, keyPrefix []string) []field {
+	var fields []field
+
+	for i := 0; i < v.NumField(); i++ {
+		structField := v.Type().Field(i)
+		if !structField.IsExported() {
+			continue
+		}
 
-			ptr := fieldValue.Addr().Interface().(*bool)
-			flag.BoolVar(ptr, flagName, defVal, usage)
-		case reflect.Slice:
-			if field.Type.Elem().Kind() == reflect.String {
-				slicePtr := fieldValue.Addr().Interface().(*[]string)
-				flag.Var(NewStringSliceValue(slicePtr), flagName, usage)
-			} else {
-				log.Printf(
-					"[WARN] unsupported slice element type for flag: %s",
-					field.Name,
-				)
+		envName := structField.Tag.Get("env")
+		flagName := structField.Tag.Get("flag")
+		fieldValue := v.Field(i)
+
+		if structField.Type.Kind() == reflect.Struct && !isScalar(structField.Type) {
+			// embedded structs share their fields between configs
+			if structField.Anonymous {
+				fields = append(fields, collect(fieldValue, envPrefix, flagPrefix, keyPrefix)...)
+				continue
 			}
-		default:
+
+			key := flagName
+			if key == "" {
+				key = strings.ToLower(structField.Name)
+			}
+			fields = append(fields, collect(
+				fieldValue,
+				join(envPrefix, envName, "_"),
+				join(flagPrefix, flagName, "-"),
+				append(append([]string{}, keyPrefix...), key),
+			)...)
+			continue
+		}
+
+		if !supported(structField.Type) {
 			log.Printf(
 				"[WARN] unsupported field type for flag: %s",
-				field.Name,
+				structField.Name,
 			)
+			continue
+		}
+
+		f := field{
+			value: fieldValue,
+			def:   structField.Tag.Get("default"),
+			usage: structField.Tag.Get("usage"),
+
+			validate: structField.Tag.Get("validate"),
+			secret:   structField.Tag.Get("secret") == "true",
 		}
+		if envName != "" {
+			f.env = join(envPrefix, envName, "_")
+		}
+		if flagName != "" {
+			f.flag = join(flagPrefix, flagName, "-")
+			f.key = append(append([]string{}, keyPrefix...), flagName)
+		}
+		fields = append(fields, f)
 	}
 
-	flag.Parse()
+	return fields
+}
 
-	return nil
+// describe names f by its env variable and flag in errors
+func (f field) describe() string {
+	switch {
+	case f.env != "" && f.flag != "":
+		return f.env + " (--" + f.flag + ")"
+	case f.flag != "":
+		return "--" + f.flag
+	}
+	return f.env
+}
+
+func join(prefix, name, sep string) string {
+	if prefix == "" {
+		return name
+	}
+	if name == "" {
+		return prefix
+	}
+	return prefix + sep + name
+}
+
+// fileArg returns the config file passed in args, before they are parsed
+// to layer the file under the other flags
+func fileArg(args []string) string {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		name, ok := strings.CutPrefix(arg, "--")
+		if !ok {
+			name, ok = strings.CutPrefix(arg, "-")
+		}
+		if !ok {
+			continue
+		}
+
+		if name == FileFlag && i+1 < len(args) {
+			return args[i+1]
+		}
+		if value, ok := strings.CutPrefix(name, FileFlag+"="); ok {
+			return value
+		}
+	}
+	return ""
 }
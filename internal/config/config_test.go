@@ -0,0 +1,283 @@
+package config
+
+import (
+	"flag"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testDB struct {
+	Host string `env:"HOST" flag:"host" default:"localhost"`
+	Port int    `env:"PORT" flag:"port" default:"5432"`
+}
+
+type testConfig struct {
+	Name    string            `env:"TEST_NAME" flag:"name" default:"tunnel"`
+	Timeout time.Duration     `env:"TEST_TIMEOUT" flag:"timeout" default:"5s"`
+	Network netip.Prefix      `env:"TEST_NETWORK" flag:"network"`
+	Listen  netip.AddrPort    `env:"TEST_LISTEN" flag:"listen"`
+	Tags    []string          `env:"TEST_TAGS" flag:"tag" default:"a,b"`
+	Labels  map[string]string `env:"TEST_LABELS" flag:"label"`
+	Weights map[string]int    `env:"TEST_WEIGHTS" flag:"weight"`
+	DB      testDB            `env:"TEST_DB" flag:"db"`
+}
+
+// load runs LoadConfig on cfg with env set and, if file is given, content
+// written to a temp file by that name
+func load(t *testing.T, cfg any, file, content string, env map[string]string, args ...string) error {
+	t.Helper()
+
+	t.Setenv(FileEnv, "")
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	if file != "" {
+		path := filepath.Join(t.TempDir(), file)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		args = append([]string{"--" + FileFlag, path}, args...)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return LoadConfig(fs, cfg, args)
+}
+
+func TestLoadConfig(t *testing.T) {
+	defaults := testConfig{
+		Name:    "tunnel",
+		Timeout: 5 * time.Second,
+		Tags:    []string{"a", "b"},
+		DB:      testDB{Host: "localhost", Port: 5432},
+	}
+	with := func(fn func(c *testConfig)) testConfig {
+		c := defaults
+		fn(&c)
+		return c
+	}
+
+	tests := []struct {
+		name          string
+		file, content string
+		env           map[string]string
+		args          []string
+		want          testConfig
+	}{
+		{
+			name: "defaults",
+			want: defaults,
+		},
+		{
+			name:    "yaml file",
+			file:    "config.yaml",
+			content: "name: file\ntimeout: 1m\nnetwork: 10.0.0.0/24\ndb:\n  host: db.local\n",
+			want: with(func(c *testConfig) {
+				c.Name = "file"
+				c.Timeout = time.Minute
+				c.Network = netip.MustParsePrefix("10.0.0.0/24")
+				c.DB.Host = "db.local"
+			}),
+		},
+		{
+			name:    "json file",
+			file:    "config.json",
+			content: `{"listen": "127.0.0.1:8080", "db": {"port": 6543}, "tag": ["x"]}`,
+			want: with(func(c *testConfig) {
+				c.Listen = netip.MustParseAddrPort("127.0.0.1:8080")
+				c.DB.Port = 6543
+				c.Tags = []string{"x"}
+			}),
+		},
+		{
+			name:    "env over file",
+			file:    "config.yaml",
+			content: "name: file\ndb:\n  host: file.local\n",
+			env:     map[string]string{"TEST_NAME": "env", "TEST_DB_HOST": "env.local"},
+			want: with(func(c *testConfig) {
+				c.Name = "env"
+				c.DB.Host = "env.local"
+			}),
+		},
+		{
+			name:    "flags over env and file",
+			file:    "config.yaml",
+			content: "name: file\ntimeout: 1m\n",
+			env:     map[string]string{"TEST_NAME": "env", "TEST_DB_PORT": "1"},
+			args:    []string{"--name", "flag", "--db-port", "2"},
+			want: with(func(c *testConfig) {
+				c.Name = "flag"
+				c.Timeout = time.Minute
+				c.DB.Port = 2
+			}),
+		},
+		{
+			name: "nested flag prefix",
+			args: []string{"--db-host", "flag.local"},
+			want: with(func(c *testConfig) { c.DB.Host = "flag.local" }),
+		},
+		{
+			name: "env lists and maps",
+			env: map[string]string{
+				"TEST_TAGS":    "x, y",
+				"TEST_LABELS":  "a=1, b=2",
+				"TEST_WEIGHTS": "a=1,b=0x10",
+			},
+			want: with(func(c *testConfig) {
+				c.Tags = []string{"x", "y"}
+				c.Labels = map[string]string{"a": "1", "b": "2"}
+				c.Weights = map[string]int{"a": 1, "b": 16}
+			}),
+		},
+		{
+			name:    "file maps",
+			file:    "config.yaml",
+			content: "label:\n  a: x\n  b: 2\nweight:\n  c: 3\n",
+			want: with(func(c *testConfig) {
+				c.Labels = map[string]string{"a": "x", "b": "2"}
+				c.Weights = map[string]int{"c": 3}
+			}),
+		},
+		{
+			name:    "repeated flags replace the lower layers",
+			file:    "config.yaml",
+			content: "tag: [x, y]\nlabel:\n  a: x\n",
+			args:    []string{"--tag", "c", "--tag", "d", "--label", "b=1", "--label", "c=2"},
+			want: with(func(c *testConfig) {
+				c.Tags = []string{"c", "d"}
+				c.Labels = map[string]string{"b": "1", "c": "2"}
+			}),
+		},
+		{
+			name: "netip and duration flags",
+			args: []string{"--network", "fd00::/64", "--listen", "[::1]:443", "--timeout", "90s"},
+			want: with(func(c *testConfig) {
+				c.Network = netip.MustParsePrefix("fd00::/64")
+				c.Listen = netip.MustParseAddrPort("[::1]:443")
+				c.Timeout = 90 * time.Second
+			}),
+		},
+		{
+			name:    "null resets to zero",
+			file:    "config.yaml",
+			content: "tag: null\n",
+			want:    with(func(c *testConfig) { c.Tags = nil }),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var cfg testConfig
+			if err := load(t, &cfg, tc.file, tc.content, tc.env, tc.args...); err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			if !reflect.DeepEqual(cfg, tc.want) {
+				t.Errorf("LoadConfig = %+v, want %+v", cfg, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		file, content string
+		env           map[string]string
+		args          []string
+		// substrings of the error
+		want []string
+	}{
+		{
+			name: "bad duration",
+			env:  map[string]string{"TEST_TIMEOUT": "5"},
+			want: []string{"TEST_TIMEOUT (--timeout)", "missing unit"},
+		},
+		{
+			name: "bad prefix",
+			args: []string{"--network", "10.0.0.0"},
+			want: []string{"10.0.0.0"},
+		},
+		{
+			name:    "bad addr port in file",
+			file:    "config.yaml",
+			content: "listen: localhost\n",
+			want:    []string{"listen:"},
+		},
+		{
+			name: "bad map pair",
+			env:  map[string]string{"TEST_LABELS": "a"},
+			want: []string{`"a" is not a key=value pair`},
+		},
+		{
+			name:    "unknown keys",
+			file:    "config.yaml",
+			content: "nmae: x\ndb:\n  hots: x\n  port: 1\n",
+			want:    []string{"unknown keys db.hots, nmae"},
+		},
+		{
+			name:    "object for a scalar",
+			file:    "config.yaml",
+			content: "name:\n  nested: x\n",
+			want:    []string{"name: object given for string"},
+		},
+		{
+			name:    "list for a scalar",
+			file:    "config.json",
+			content: `{"name": ["a"]}`,
+			want:    []string{"name: list given for string"},
+		},
+		{
+			name: "all problems at once",
+			env:  map[string]string{"TEST_TIMEOUT": "x", "TEST_DB_PORT": "x"},
+			want: []string{"TEST_TIMEOUT", "TEST_DB_PORT"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var cfg testConfig
+			err := load(t, &cfg, tc.file, tc.content, tc.env, tc.args...)
+			if err == nil {
+				t.Fatal("LoadConfig succeeded")
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfigNotStruct(t *testing.T) {
+	var s string
+	if err := LoadConfig(flag.NewFlagSet("test", flag.ContinueOnError), &s, nil); err == nil {
+		t.Error("LoadConfig accepted a pointer to a string")
+	}
+	if err := LoadConfig(flag.NewFlagSet("test", flag.ContinueOnError), testConfig{}, nil); err == nil {
+		t.Error("LoadConfig accepted a struct value")
+	}
+}
+
+func TestFileArg(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"--config", "a.yaml"}, "a.yaml"},
+		{[]string{"-config", "a.yaml"}, "a.yaml"},
+		{[]string{"--name", "x", "--config=a.yaml"}, "a.yaml"},
+		{[]string{"--", "--config", "a.yaml"}, ""},
+		{[]string{"--config"}, ""},
+	}
+	for _, tc := range tests {
+		if got := fileArg(tc.args); got != tc.want {
+			t.Errorf("fileArg(%q) = %q, want %q", tc.args, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loadFile sets fields from the YAML (or, by the .json extension, JSON)
+// file at path, keyed by their flag names and nested by struct
+func loadFile(path string, fields []field) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	doc := map[string]any{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(b, &doc)
+	} else {
+		err = yaml.Unmarshal(b, &doc)
+	}
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	leaves, structs := map[string]bool{}, map[string]bool{}
+	for _, f := range fields {
+		if f.key == nil {
+			continue
+		}
+		leaves[strings.Join(f.key, ".")] = true
+		for i := 1; i < len(f.key); i++ {
+			structs[strings.Join(f.key[:i], ".")] = true
+		}
+
+		raw, ok := lookup(doc, f.key)
+		if !ok {
+			continue
+		}
+		if err := setRaw(f.value, raw); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", strings.Join(f.key, "."), err))
+		}
+	}
+
+	// typos would silently fall back to the defaults otherwise
+	var unknown []string
+	unknownKeys(doc, "", leaves, structs, &unknown)
+	if len(unknown) > 0 {
+		slices.Sort(unknown)
+		errs = append(errs, fmt.Errorf("unknown keys %s", strings.Join(unknown, ", ")))
+	}
+	return errors.Join(errs...)
+}
+
+func lookup(doc map[string]any, key []string) (any, bool) {
+	var cur any = doc
+	for _, k := range key {
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[k]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+func unknownKeys(doc map[string]any, prefix string, leaves, structs map[string]bool, unknown *[]string) {
+	for k, v := range doc {
+		key := join(prefix, k, ".")
+		switch m, ok := v.(map[string]any); {
+		case leaves[key]:
+		case structs[key] && ok:
+			unknownKeys(m, key, leaves, structs, unknown)
+		default:
+			*unknown = append(*unknown, key)
+		}
+	}
+}
+
+func setRaw(v reflect.Value, raw any) error {
+	switch raw := raw.(type) {
+	case nil:
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	case []any:
+		if v.Kind() != reflect.Slice {
+			return fmt.Errorf("list given for %s", v.Type())
+		}
+		v.Set(reflect.MakeSlice(v.Type(), 0, len(raw)))
+		for _, item := range raw {
+			if err := appendElem(v, scalar(item)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]any:
+		if v.Kind() != reflect.Map {
+			return fmt.Errorf("object given for %s", v.Type())
+		}
+		v.Set(reflect.MakeMap(v.Type()))
+		for key, item := range raw {
+			if err := putElem(v, key+"="+scalar(item)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return setString(v, scalar(raw))
+}
+
+func scalar(raw any) string {
+	switch raw := raw.(type) {
+	case string:
+		return raw
+	case float64:
+		return strconv.FormatFloat(raw, 'f', -1, 64)
+	}
+	return fmt.Sprint(raw)
+}
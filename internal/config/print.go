@@ -0,0 +1,95 @@
+package config
+
+import (
+	"io"
+	"reflect"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "REDACTED"
+
+// dump writes the fields to w in the config file format, with the secrets
+// redacted. Env only fields, which the file can't set, follow keyed by
+// their env variable.
+func dump(w io.Writer, fields []field) error {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+
+	var envOnly []*yaml.Node
+	for _, f := range fields {
+		var value *yaml.Node
+		if f.secret && !isEmpty(f.value) {
+			value = scalarNode(redacted)
+		} else {
+			value = node(f.value)
+		}
+
+		if f.key == nil {
+			if f.env != "" {
+				envOnly = append(envOnly, scalarNode(f.env), value)
+			}
+			continue
+		}
+
+		parent := root
+		for _, k := range f.key[:len(f.key)-1] {
+			parent = child(parent, k)
+		}
+		parent.Content = append(parent.Content, scalarNode(f.key[len(f.key)-1]), value)
+	}
+	if len(envOnly) > 0 {
+		envOnly[0].HeadComment = "env only"
+		root.Content = append(root.Content, envOnly...)
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(root); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// child returns the mapping under key in parent, adding it if missing
+func child(parent *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(parent.Content); i += 2 {
+		if parent.Content[i].Value == key {
+			return parent.Content[i+1]
+		}
+	}
+	n := &yaml.Node{Kind: yaml.MappingNode}
+	parent.Content = append(parent.Content, scalarNode(key), n)
+	return n
+}
+
+func node(v reflect.Value) *yaml.Node {
+	switch v.Kind() {
+	case reflect.Slice:
+		n := &yaml.Node{Kind: yaml.SequenceNode}
+		for i := 0; i < v.Len(); i++ {
+			n.Content = append(n.Content, node(v.Index(i)))
+		}
+		return n
+	case reflect.Map:
+		n := &yaml.Node{Kind: yaml.MappingNode}
+		keys := make([]string, 0, v.Len())
+		for _, k := range v.MapKeys() {
+			keys = append(keys, k.String())
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			value := v.MapIndex(reflect.ValueOf(k).Convert(v.Type().Key()))
+			n.Content = append(n.Content, scalarNode(k), node(value))
+		}
+		return n
+	case reflect.String:
+		// quoted so "true" or "10" stay strings
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v.String()}
+	}
+	return scalarNode(format(v))
+}
+
+func scalarNode(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Value: value}
+}
@@ -0,0 +1,90 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type secretConfig struct {
+	Token    string            `env:"TEST_S_TOKEN" flag:"token" secret:"true"`
+	Empty    string            `env:"TEST_S_EMPTY" flag:"empty" secret:"true"`
+	Password string            `env:"TEST_S_PASSWORD" secret:"true"`
+	Level    string            `env:"TEST_S_LEVEL" default:"info"`
+	Number   string            `env:"TEST_S_NUMBER" flag:"number" default:"10"`
+	Labels   map[string]string `env:"TEST_S_LABELS" flag:"label" default:"b=2,a=1"`
+	DB       testDB            `env:"TEST_S_DB" flag:"db"`
+}
+
+func TestSecretFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "token")
+	if err := os.WriteFile(path, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg secretConfig
+	if err := load(t, &cfg, "", "", map[string]string{"TEST_S_TOKEN_FILE": path}); err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.Token != "from-file" {
+		t.Errorf("Token = %q, want %q", cfg.Token, "from-file")
+	}
+
+	// flags still override the file
+	cfg = secretConfig{}
+	if err := load(t, &cfg, "", "", map[string]string{"TEST_S_TOKEN_FILE": path}, "--token", "flag"); err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.Token != "flag" {
+		t.Errorf("Token = %q, want %q", cfg.Token, "flag")
+	}
+
+	cfg = secretConfig{}
+	err := load(t, &cfg, "", "", map[string]string{"TEST_S_TOKEN": "env", "TEST_S_TOKEN_FILE": path})
+	if err == nil || !strings.Contains(err.Error(), "both TEST_S_TOKEN and TEST_S_TOKEN_FILE are set") {
+		t.Errorf("LoadConfig = %v, want a both set error", err)
+	}
+
+	cfg = secretConfig{}
+	err = load(t, &cfg, "", "", map[string]string{"TEST_S_TOKEN_FILE": filepath.Join(dir, "missing")})
+	if err == nil || !strings.Contains(err.Error(), "TEST_S_TOKEN (--token)") {
+		t.Errorf("LoadConfig = %v, want a read error", err)
+	}
+}
+
+func TestDump(t *testing.T) {
+	var cfg secretConfig
+	env := map[string]string{"TEST_S_TOKEN": "hunter2", "TEST_S_PASSWORD": "hunter3"}
+	if err := load(t, &cfg, "", "", env, "--db-host", "db.local"); err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := dump(&buf, collect(reflect.ValueOf(&cfg).Elem(), "", "", nil)); err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+
+	want := `token: REDACTED
+empty: ""
+number: "10"
+label:
+  a: "1"
+  b: "2"
+db:
+  host: db.local
+  port: 5432
+# env only
+TEST_S_PASSWORD: REDACTED
+TEST_S_LEVEL: info
+`
+	if got := buf.String(); got != want {
+		t.Errorf("dump =\n%s\nwant\n%s", got, want)
+	}
+	if strings.Contains(buf.String(), "hunter") {
+		t.Error("dump leaked a secret")
+	}
+}
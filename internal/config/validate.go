@@ -0,0 +1,89 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// Validator is implemented by configs with constraints spanning fields,
+// Validate runs after the fields are loaded and validated
+type Validator interface {
+	Validate() error
+}
+
+var validators = map[string]func(value any) error{}
+
+// RegisterValidator makes fn usable as name in validate tags, it gets the
+// value of non-empty fields. Register validators before loading configs.
+func RegisterValidator(name string, fn func(value any) error) {
+	validators[name] = fn
+}
+
+// validate checks the fields against their comma separated validate tag
+// rules: required, oneof=a b c (each element for slices) and the registered
+// validators. Empty fields only fail required.
+func validate(fields []field) []error {
+	var errs []error
+
+	for _, f := range fields {
+		if f.validate == "" {
+			continue
+		}
+
+		empty := isEmpty(f.value)
+		for _, rule := range strings.Split(f.validate, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(rule), "=")
+
+			var err error
+			switch name {
+			case "required":
+				if empty {
+					err = fmt.Errorf("is required")
+				}
+			case "oneof":
+				if !empty {
+					err = oneOf(f.value, strings.Fields(arg))
+				}
+			default:
+				fn, ok := validators[name]
+				if !ok {
+					err = fmt.Errorf("unknown validator %q", name)
+				} else if !empty {
+					err = fn(f.value.Interface())
+				}
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", f.describe(), err))
+			}
+		}
+	}
+
+	return errs
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+func oneOf(v reflect.Value, allowed []string) error {
+	values := []string{format(v)}
+	if v.Kind() == reflect.Slice {
+		values = values[:0]
+		for i := 0; i < v.Len(); i++ {
+			values = append(values, format(v.Index(i)))
+		}
+	}
+
+	for _, value := range values {
+		if !slices.Contains(allowed, value) {
+			return fmt.Errorf("must be one of %s, got %q", strings.Join(allowed, ", "), value)
+		}
+	}
+	return nil
+}
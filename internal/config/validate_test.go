@@ -0,0 +1,127 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func init() {
+	RegisterValidator("test_even", func(value any) error {
+		if value.(int)%2 != 0 {
+			return errors.New("must be even")
+		}
+		return nil
+	})
+}
+
+type validateConfig struct {
+	Name  string   `env:"TEST_V_NAME" flag:"name" validate:"required"`
+	Mode  string   `env:"TEST_V_MODE" flag:"mode" default:"a" validate:"oneof=a b"`
+	Modes []string `env:"TEST_V_MODES" flag:"modes" validate:"oneof=a b"`
+	Count int      `env:"TEST_V_COUNT" flag:"count" validate:"required,test_even"`
+	Size  int      `env:"TEST_V_SIZE" flag:"size" validate:"test_even"`
+
+	// set by the test to check Validate runs
+	fail bool
+}
+
+func (c *validateConfig) Validate() error {
+	if c.fail {
+		return errors.New("cross field check failed")
+	}
+	return nil
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		fail bool
+		// substrings of the error, none for a valid config
+		want []string
+	}{
+		{
+			name: "valid",
+			args: []string{"--name", "x", "--mode", "b", "--modes", "a", "--modes", "b", "--count", "2"},
+		},
+		{
+			name: "required",
+			args: []string{"--count", "2"},
+			want: []string{"TEST_V_NAME (--name): is required"},
+		},
+		{
+			name: "required and validator",
+			args: []string{"--name", "x", "--count", "0"},
+			want: []string{"TEST_V_COUNT (--count): is required"},
+		},
+		{
+			name: "oneof",
+			args: []string{"--name", "x", "--count", "2", "--mode", "c"},
+			want: []string{`TEST_V_MODE (--mode): must be one of a, b, got "c"`},
+		},
+		{
+			name: "oneof each element",
+			args: []string{"--name", "x", "--count", "2", "--modes", "a", "--modes", "c"},
+			want: []string{`TEST_V_MODES (--modes): must be one of a, b, got "c"`},
+		},
+		{
+			name: "registered validator",
+			args: []string{"--name", "x", "--count", "3"},
+			want: []string{"TEST_V_COUNT (--count): must be even"},
+		},
+		{
+			// empty fields only fail required
+			name: "registered validator skips empty",
+			args: []string{"--name", "x", "--count", "2", "--size", "0"},
+		},
+		{
+			name: "Validate",
+			args: []string{"--name", "x", "--count", "2"},
+			fail: true,
+			want: []string{"cross field check failed"},
+		},
+		{
+			name: "aggregated",
+			args: []string{"--mode", "c", "--count", "1", "--size", "3"},
+			fail: true,
+			want: []string{
+				"TEST_V_NAME (--name): is required",
+				"TEST_V_MODE (--mode): must be one of",
+				"TEST_V_COUNT (--count): must be even",
+				"TEST_V_SIZE (--size): must be even",
+				"cross field check failed",
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := validateConfig{fail: tc.fail}
+			err := load(t, &cfg, "", "", nil, tc.args...)
+			if len(tc.want) == 0 {
+				if err != nil {
+					t.Fatalf("LoadConfig: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("LoadConfig succeeded")
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateUnknownValidator(t *testing.T) {
+	var cfg struct {
+		Name string `env:"TEST_V_NAME" validate:"no_such_validator"`
+	}
+	err := load(t, &cfg, "", "", nil)
+	if err == nil || !strings.Contains(err.Error(), `unknown validator "no_such_validator"`) {
+		t.Errorf("LoadConfig = %v, want an unknown validator error", err)
+	}
+}
@@ -0,0 +1,230 @@
+package config
+
+import (
+	"fmt"
+	"net/netip"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	prefixType   = reflect.TypeOf(netip.Prefix{})
+	addrPortType = reflect.TypeOf(netip.AddrPort{})
+	addrType     = reflect.TypeOf(netip.Addr{})
+)
+
+// isScalar reports whether t is parsed from a single value even though it
+// is a struct
+func isScalar(t reflect.Type) bool {
+	return t == prefixType || t == addrPortType || t == addrType
+}
+
+func supported(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Slice:
+		return supportedElem(t.Elem())
+	case reflect.Map:
+		return t.Key().Kind() == reflect.String && supportedElem(t.Elem())
+	}
+	return supportedElem(t)
+}
+
+func supportedElem(t reflect.Type) bool {
+	if isScalar(t) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// setString sets v from a default, env variable or file value, replacing
+// slices and maps with the comma separated list of elements or key=value
+// pairs in s
+func setString(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+		for _, item := range splitList(s) {
+			if err := appendElem(v, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		v.Set(reflect.MakeMap(v.Type()))
+		for _, item := range splitList(s) {
+			if err := putElem(v, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return parseElem(v, s)
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func appendElem(v reflect.Value, s string) error {
+	elem := reflect.New(v.Type().Elem()).Elem()
+	if err := parseElem(elem, s); err != nil {
+		return err
+	}
+	v.Set(reflect.Append(v, elem))
+	return nil
+}
+
+func putElem(v reflect.Value, s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("%q is not a key=value pair", s)
+	}
+	if v.IsNil() {
+		v.Set(reflect.MakeMap(v.Type()))
+	}
+	elem := reflect.New(v.Type().Elem()).Elem()
+	if err := parseElem(elem, value); err != nil {
+		return err
+	}
+	v.SetMapIndex(reflect.ValueOf(strings.TrimSpace(key)).Convert(v.Type().Key()), elem)
+	return nil
+}
+
+func parseElem(v reflect.Value, s string) error {
+	switch v.Type() {
+	case durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	case prefixType, addrPortType, addrType:
+		if s == "" {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		var parsed any
+		var err error
+		switch v.Type() {
+		case prefixType:
+			parsed, err = netip.ParsePrefix(s)
+		case addrPortType:
+			parsed, err = netip.ParseAddrPort(s)
+		default:
+			parsed, err = netip.ParseAddr(s)
+		}
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(parsed))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func format(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Slice:
+		items := make([]string, v.Len())
+		for i := range items {
+			items[i] = format(v.Index(i))
+		}
+		return strings.Join(items, ",")
+	case reflect.Map:
+		items := make([]string, 0, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			items = append(items, iter.Key().String()+"="+format(iter.Value()))
+		}
+		slices.Sort(items)
+		return strings.Join(items, ",")
+	}
+
+	if isScalar(v.Type()) && v.IsZero() {
+		return ""
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// flagValue sets a non string or bool config field from the command line,
+// slices and maps take repeated flags replacing the lower layers' values on
+// first use
+type flagValue struct {
+	value reflect.Value
+	set   bool
+}
+
+func (f *flagValue) String() string {
+	if f == nil || !f.value.IsValid() {
+		return ""
+	}
+	return format(f.value)
+}
+
+func (f *flagValue) Set(s string) error {
+	first := !f.set
+	f.set = true
+
+	switch f.value.Kind() {
+	case reflect.Slice:
+		if first {
+			f.value.Set(reflect.MakeSlice(f.value.Type(), 0, 0))
+		}
+		return appendElem(f.value, s)
+	case reflect.Map:
+		if first {
+			f.value.Set(reflect.MakeMap(f.value.Type()))
+		}
+		return putElem(f.value, s)
+	}
+	return parseElem(f.value, s)
+}
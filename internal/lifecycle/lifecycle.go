@@ -0,0 +1,152 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type stopHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// Manager runs the servers and background workers of a process and shuts
+// them down in order once the process is signalled or one of the servers
+// fails
+type Manager struct {
+	ShutdownTimeout time.Duration
+
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	mu    sync.Mutex
+	hooks []stopHook
+
+	workers    sync.WaitGroup
+	stop       chan struct{}
+	stopOnce   sync.Once
+	signalStop func()
+}
+
+func New(shutdownTimeout time.Duration) *Manager {
+	sigCtx, signalStop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	ctx, cancel := context.WithCancelCause(sigCtx)
+	return &Manager{
+		ShutdownTimeout: shutdownTimeout,
+
+		ctx:        ctx,
+		cancel:     cancel,
+		stop:       make(chan struct{}),
+		signalStop: signalStop,
+	}
+}
+
+// OnStop adds a shutdown step, steps run in the order they were added
+func (m *Manager) OnStop(name string, fn func(ctx context.Context) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hooks = append(m.hooks, stopHook{name: name, fn: fn})
+}
+
+// Go runs a background worker, stop is closed by StopWorkers
+func (m *Manager) Go(worker func(stop <-chan struct{})) {
+	m.workers.Add(1)
+	go func() {
+		defer m.workers.Done()
+		worker(m.stop)
+	}()
+}
+
+// StopWorkers signals the workers started with Go and waits for them
+func (m *Manager) StopWorkers(ctx context.Context) error {
+	m.stopOnce.Do(func() { close(m.stop) })
+
+	done := make(chan struct{})
+	go func() {
+		m.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for workers: %w", ctx.Err())
+	}
+}
+
+// Serve starts srv in the background and adds its graceful shutdown as a
+// stop step. Failing to serve shuts the whole process down.
+func (m *Manager) Serve(name string, srv *http.Server) {
+	draining := make(chan struct{})
+	srv.RegisterOnShutdown(func() { close(draining) })
+	srv.BaseContext = func(net.Listener) context.Context {
+		return context.WithValue(context.Background(), drainingKey{}, (<-chan struct{})(draining))
+	}
+
+	go func() {
+		listen := srv.ListenAndServe
+		if srv.TLSConfig != nil {
+			// the certificate comes from TLSConfig
+			listen = func() error { return srv.ListenAndServeTLS("", "") }
+		}
+		if err := listen(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			m.cancel(fmt.Errorf("serving %s at %s: %w", name, srv.Addr, err))
+		}
+	}()
+	m.OnStop(name, srv.Shutdown)
+}
+
+// Fail begins the shutdown because of err, Wait returns it
+func (m *Manager) Fail(err error) {
+	m.cancel(err)
+}
+
+// Wait blocks until the shutdown begins and runs the stop steps, all of
+// them together get ShutdownTimeout. The error tells why the process was
+// shut down if it wasn't signalled.
+func (m *Manager) Wait() error {
+	<-m.ctx.Done()
+	m.signalStop()
+
+	cause := context.Cause(m.ctx)
+	if errors.Is(cause, context.Canceled) {
+		log.Printf("[INFO] shutting down")
+		cause = nil
+	} else {
+		log.Printf("[WARN] shutting down: %v", cause)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.ShutdownTimeout)
+	defer cancel()
+
+	m.mu.Lock()
+	hooks := m.hooks
+	m.mu.Unlock()
+	for _, h := range hooks {
+		start := time.Now()
+		if err := h.fn(ctx); err != nil {
+			log.Printf("[WARN] stopping %s: %v", h.name, err)
+			continue
+		}
+		log.Printf("[INFO] stopped %s in %s", h.name, time.Since(start).Round(time.Millisecond))
+	}
+	return cause
+}
+
+type drainingKey struct{}
+
+// Draining returns a channel closed when the server handling the request
+// shuts down. Long lived responses (streams) should end on it, in-flight
+// requests are otherwise waited for.
+func Draining(ctx context.Context) <-chan struct{} {
+	ch, _ := ctx.Value(drainingKey{}).(<-chan struct{})
+	return ch
+}
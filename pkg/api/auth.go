@@ -4,20 +4,26 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"log"
 	"net"
 	"net/http"
 	"strings"
+	"tunnel/pkg/events"
+	"tunnel/pkg/metrics"
 )
 
 type AuthService struct {
 	DB *sql.DB
 
+	EventService events.EventService
+
 	MasterToken         string
 	MasterLocalhostOnly bool
 	TokenAuthDisabled   bool
 }
 
 const masterAuthKey = "master_auth_success"
+const tokenScopeKey = "token_scope"
 
 func (s AuthService) TokenAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -47,10 +53,23 @@ func (s AuthService) TokenAuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		err := s.ValidateAndBurnToken(token)
+		scope, err := s.ValidateAndBurnToken(token)
 
 		if err == nil {
-			next.ServeHTTP(w, r)
+			metrics.TokenBurns.Inc()
+
+			data := map[string]any{
+				"token_prefix": token[:min(len(token), 8)],
+				"pool":         scope.Pool,
+				"lease":        scope.Lease.String(),
+				"path":         r.URL.Path,
+			}
+			if _, err := s.EventService.Publish(events.TypeTokenBurned, "", data); err != nil {
+				log.Printf("[WARN] publishing %s event: %v", events.TypeTokenBurned, err)
+			}
+
+			ctx := context.WithValue(r.Context(), tokenScopeKey, scope)
+			next.ServeHTTP(w, r.WithContext(ctx))
 			return
 		} else {
 			switch {
@@ -67,6 +86,14 @@ func (s AuthService) TokenAuthMiddleware(next http.Handler) http.Handler {
 
 func (s AuthService) MasterAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// operators with a client cert verified against the client CAs of
+		// the TLS listener
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			ctx := context.WithValue(r.Context(), masterAuthKey, true)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
 		// disabled
 		if s.MasterToken == "" {
 			next.ServeHTTP(w, r)
@@ -117,3 +144,10 @@ func (s AuthService) RequireAuthMiddleware(next http.Handler) http.Handler {
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 	})
 }
+
+// tokenScope returns the scope of the one time token the request was
+// authorized with, empty for master token requests
+func tokenScope(ctx context.Context) TokenScope {
+	scope, _ := ctx.Value(tokenScopeKey).(TokenScope)
+	return scope
+}
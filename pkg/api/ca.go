@@ -0,0 +1,199 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+	"tunnel/pkg/cert"
+
+	nebulaCert "github.com/slackhq/nebula/cert"
+	"github.com/swaggest/usecase/status"
+)
+
+type CAInfo struct {
+	Fingerprint string    `json:"fingerprint"`
+	Name        string    `json:"name"`
+	Curve       string    `json:"curve"`
+	NotAfter    time.Time `json:"not_after"`
+	Active      bool      `json:"active"`
+	ActiveNodes int       `json:"active_nodes"`
+}
+
+type CAGetOutput struct {
+	CAs []CAInfo `json:"cas"`
+}
+
+func (s APIService) CAGet(ctx context.Context, input struct{}, output *CAGetOutput) error {
+	activeFp, err := s.Authority.Fingerprint()
+	if err != nil {
+		return status.Wrap(fmt.Errorf("active ca fingerprint: %w", err), status.Internal)
+	}
+
+	certs, err := cert.ParseBundle(s.Authority.Bundle())
+	if err != nil {
+		return status.Wrap(err, status.Internal)
+	}
+
+	output.CAs = []CAInfo{}
+	for _, c := range certs {
+		fp, err := c.Fingerprint()
+		if err != nil {
+			return status.Wrap(fmt.Errorf("ca fingerprint: %w", err), status.Internal)
+		}
+		count, err := s.NodeService.CountActiveByCA(fp)
+		if err != nil {
+			return status.Wrap(fmt.Errorf("count nodes: %w", err), status.Internal)
+		}
+		output.CAs = append(output.CAs, CAInfo{
+			Fingerprint: fp,
+			Name:        c.Name(),
+			Curve:       c.Curve().String(),
+			NotAfter:    c.NotAfter(),
+			Active:      fp == activeFp,
+			ActiveNodes: count,
+		})
+	}
+
+	return nil
+}
+
+type CARotatePostInput struct {
+	Name string `json:"name,omitempty" description:"name of the new CA, defaults to the current CA name"`
+}
+
+type CARotatePostOutput struct {
+	Fingerprint string `json:"fingerprint"`
+}
+
+func (s APIService) CARotatePost(ctx context.Context, input CARotatePostInput, output *CARotatePostOutput) error {
+	caPair, err := s.Authority.Rotate(input.Name)
+	if err != nil {
+		return status.Wrap(fmt.Errorf("rotate ca: %w", err), status.Internal)
+	}
+
+	fp, err := cert.Fingerprint(caPair.CertPEM)
+	if err != nil {
+		return status.Wrap(fmt.Errorf("ca fingerprint: %w", err), status.Internal)
+	}
+	log.Printf("[INFO] rotated CA, new CA fingerprint %s", fp)
+
+	if s.ServerConfigChanged != nil {
+		if err := s.ServerConfigChanged(); err != nil {
+			return status.Wrap(fmt.Errorf("apply rotated ca: %w", err), status.Internal)
+		}
+	}
+
+	if err := s.retireUnusedCAs(); err != nil {
+		log.Printf("[WARN] retiring unused CAs: %v", err)
+	}
+
+	output.Fingerprint = fp
+	return nil
+}
+
+// retireUnusedCAs drops the previous CAs no active node uses any more, and
+// the expired ones, from the bundle. Nodes enrolled before nodes were
+// tracked aren't counted, so unused CAs are kept for the CARetireGrace
+// after the active CA was rotated in to give those nodes time to renew.
+func (s APIService) retireUnusedCAs() error {
+	caCert, _ := s.Authority.CA()
+	active, _, err := nebulaCert.UnmarshalCertificateFromPEM([]byte(caCert))
+	if err != nil {
+		return fmt.Errorf("parsing active ca: %w", err)
+	}
+	activeFp, err := active.Fingerprint()
+	if err != nil {
+		return err
+	}
+
+	certs, err := cert.ParseBundle(s.Authority.Bundle())
+	if err != nil {
+		return err
+	}
+
+	retired := false
+	now := time.Now()
+	graceOver := !now.Before(active.NotBefore().Add(s.Settings.Get().CARetireGrace))
+	for _, c := range certs {
+		fp, err := c.Fingerprint()
+		if err != nil {
+			return fmt.Errorf("ca fingerprint: %w", err)
+		}
+		if fp == activeFp {
+			continue
+		}
+
+		reason := fmt.Sprintf("expired at %s", c.NotAfter())
+		if !c.Expired(now) {
+			if !graceOver {
+				continue
+			}
+			count, err := s.NodeService.CountActiveByCA(fp)
+			if err != nil {
+				return fmt.Errorf("count nodes for CA %s: %w", fp, err)
+			}
+			if count > 0 {
+				continue
+			}
+			reason = "no active nodes left"
+		}
+
+		if err := s.Authority.Retire(fp); err != nil {
+			return err
+		}
+		log.Printf("[INFO] retired CA %s, %s", fp, reason)
+		retired = true
+	}
+
+	if retired && s.ServerConfigChanged != nil {
+		return s.ServerConfigChanged()
+	}
+	return nil
+}
+
+type CADeleteInput struct {
+	Fingerprint string `path:"fingerprint"`
+}
+
+func (s APIService) CADelete(ctx context.Context, input CADeleteInput, output *struct{}) error {
+	activeFp, err := s.Authority.Fingerprint()
+	if err != nil {
+		return status.Wrap(fmt.Errorf("active ca fingerprint: %w", err), status.Internal)
+	}
+	if input.Fingerprint == activeFp {
+		return status.Wrap(fmt.Errorf("refusing to retire the active CA %s", activeFp), status.FailedPrecondition)
+	}
+
+	fps, err := cert.BundleFingerprints(s.Authority.Bundle())
+	if err != nil {
+		return status.Wrap(err, status.Internal)
+	}
+	if !slices.Contains(fps, input.Fingerprint) {
+		return status.Wrap(fmt.Errorf("CA %s is not in the bundle", input.Fingerprint), status.NotFound)
+	}
+
+	count, err := s.NodeService.CountActiveByCA(input.Fingerprint)
+	if err != nil {
+		return status.Wrap(fmt.Errorf("count nodes: %w", err), status.Internal)
+	}
+	if count > 0 {
+		return status.Wrap(
+			fmt.Errorf("%d active nodes still use CA %s, renew or revoke them first", count, input.Fingerprint),
+			status.FailedPrecondition,
+		)
+	}
+
+	if err := s.Authority.Retire(input.Fingerprint); err != nil {
+		return status.Wrap(fmt.Errorf("retire ca: %w", err), status.Internal)
+	}
+	log.Printf("[INFO] retired CA %s", input.Fingerprint)
+
+	if s.ServerConfigChanged != nil {
+		if err := s.ServerConfigChanged(); err != nil {
+			return status.Wrap(fmt.Errorf("apply retired ca: %w", err), status.Internal)
+		}
+	}
+	return nil
+}
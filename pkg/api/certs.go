@@ -0,0 +1,72 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"tunnel/pkg/cert"
+
+	"github.com/swaggest/usecase/status"
+)
+
+type CertOutput struct {
+	cert.Info
+	NodeName    string `json:"node_name,omitempty"`
+	Blocklisted bool   `json:"blocklisted"`
+	Trusted     bool   `json:"trusted"`
+	VerifyError string `json:"verify_error,omitempty"`
+}
+
+type CertGetInput struct {
+	Fingerprint string `path:"fingerprint"`
+}
+
+func (s APIService) CertGet(ctx context.Context, input CertGetInput, output *CertOutput) error {
+	issued, err := s.NodeService.GetCert(input.Fingerprint)
+	if err != nil {
+		if errors.Is(err, ErrCertNotFound) {
+			return status.Wrap(err, status.NotFound)
+		}
+		return status.Wrap(fmt.Errorf("get cert: %w", err), status.Internal)
+	}
+
+	return s.describeCert(issued.CertPEM, output)
+}
+
+type CertVerifyPostInput struct {
+	Cert string `json:"cert" required:"true"`
+}
+
+func (s APIService) CertVerifyPost(ctx context.Context, input CertVerifyPostInput, output *CertOutput) error {
+	return s.describeCert(input.Cert, output)
+}
+
+func (s APIService) describeCert(certPEM string, output *CertOutput) error {
+	info, err := cert.Inspect(certPEM)
+	if err != nil {
+		return status.Wrap(err, status.InvalidArgument)
+	}
+	output.Info = *info
+
+	issued, err := s.NodeService.GetCert(info.Fingerprint)
+	switch {
+	case err == nil:
+		output.NodeName = issued.NodeName
+		output.Blocklisted = issued.BlocklistedAt != nil
+	case errors.Is(err, ErrCertNotFound):
+	default:
+		return status.Wrap(fmt.Errorf("get cert: %w", err), status.Internal)
+	}
+	if slices.Contains(s.Settings.Get().Blocklist, info.Fingerprint) {
+		output.Blocklisted = true
+	}
+
+	if _, err := cert.VerifyWithBundle(s.Authority.Bundle(), certPEM); err != nil {
+		output.VerifyError = err.Error()
+	} else {
+		output.Trusted = !output.Blocklisted
+	}
+
+	return nil
+}
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+	"tunnel/pkg/cert"
+
+	nebulaCert "github.com/slackhq/nebula/cert"
+	"github.com/swaggest/usecase/status"
+)
+
+var ErrChallengeNotFound = errors.New("challenge not found, expired or already used")
+
+// challengeTTL is how long a node has to answer a possession challenge
+const challengeTTL = time.Minute
+
+// CreateChallenge stores the private key of a possession challenge issued to
+// the holder of the cert or identity key with the given fingerprint,
+// dropping expired ones
+func (s NodeService) CreateChallenge(nonce, fingerprint string, privateKey []byte, expiresAt time.Time) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM node_challenges WHERE expires_at < NOW()`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO node_challenges (nonce, fingerprint, private_key, expires_at)
+			VALUES ($1, $2, $3, $4)`,
+		nonce, fingerprint, privateKey, expiresAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ConsumeChallenge deletes an unexpired challenge, returning the fingerprint
+// of the cert or identity key it was issued for and its private key
+func (s NodeService) ConsumeChallenge(nonce string) (string, []byte, error) {
+	var fingerprint string
+	var privateKey []byte
+	err := s.DB.QueryRow(`DELETE FROM node_challenges
+			WHERE nonce = $1 AND expires_at > NOW()
+			RETURNING fingerprint, private_key`, nonce).
+		Scan(&fingerprint, &privateKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil, ErrChallengeNotFound
+	}
+	return fingerprint, privateKey, err
+}
+
+type ChallengePostInput struct {
+	Cert        string `json:"cert,omitempty" description:"current certificate of the node"`
+	IdentityKey string `json:"identity_key,omitempty" description:"public key PEM of the machine identity, for enrolling without a certificate"`
+}
+
+type ChallengePostOutput struct {
+	Nonce     string `json:"nonce"`
+	PublicKey []byte `json:"public_key" description:"challenge key to derive the shared secret with"`
+}
+
+func (s APIService) ChallengePost(ctx context.Context, input ChallengePostInput, output *ChallengePostOutput) error {
+	var fp string
+	var curve nebulaCert.Curve
+	switch {
+	case input.Cert != "" && input.IdentityKey != "":
+		return status.Wrap(errors.New("challenge either a cert or an identity key"), status.InvalidArgument)
+	case input.Cert != "":
+		_, nodeCert, err := s.certNode(input.Cert)
+		if err != nil {
+			return err
+		}
+		if fp, err = nodeCert.Fingerprint(); err != nil {
+			return status.Wrap(fmt.Errorf("cert fingerprint: %w", err), status.InvalidArgument)
+		}
+		curve = nodeCert.Curve()
+	case input.IdentityKey != "":
+		_, _, keyCurve, err := nebulaCert.UnmarshalPublicKeyFromPEM([]byte(input.IdentityKey))
+		if err != nil {
+			return status.Wrap(fmt.Errorf("invalid identity key: %w", err), status.InvalidArgument)
+		}
+		if fp, err = cert.KeyFingerprint(input.IdentityKey); err != nil {
+			return status.Wrap(err, status.InvalidArgument)
+		}
+		curve = keyCurve
+	default:
+		return status.Wrap(errors.New("cert or identity key is required"), status.InvalidArgument)
+	}
+
+	pub, priv, err := cert.NewChallengeKey(curve)
+	if err != nil {
+		return status.Wrap(fmt.Errorf("challenge key: %w", err), status.Internal)
+	}
+	nonce, err := generateToken()
+	if err != nil {
+		return status.Wrap(fmt.Errorf("generate nonce: %w", err), status.Internal)
+	}
+	if err = s.NodeService.CreateChallenge(nonce, fp, priv, time.Now().Add(challengeTTL)); err != nil {
+		return status.Wrap(fmt.Errorf("create challenge: %w", err), status.Internal)
+	}
+
+	output.Nonce = nonce
+	output.PublicKey = pub
+	return nil
+}
+
+// provenNode is certNode for callers which also answered a challenge issued
+// for the cert, proving they hold its private key
+func (s APIService) provenNode(certPEM, nonce string, proof []byte) (*Node, error) {
+	node, nodeCert, err := s.certNode(certPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, err := s.consumeChallenge(nonce, node.CertFingerprint)
+	if err != nil {
+		return nil, err
+	}
+	if err := cert.VerifyKeyPossession(nodeCert, privateKey, []byte(nonce), proof); err != nil {
+		return nil, status.Wrap(err, status.PermissionDenied)
+	}
+	return node, nil
+}
+
+// provenIdentity returns the hardware ID of a machine identity key whose
+// holder answered a challenge issued for it
+func (s APIService) provenIdentity(identityKey, nonce string, proof []byte) (string, error) {
+	fp, err := cert.KeyFingerprint(identityKey)
+	if err != nil {
+		return "", status.Wrap(err, status.InvalidArgument)
+	}
+	privateKey, err := s.consumeChallenge(nonce, fp)
+	if err != nil {
+		return "", err
+	}
+	if err := cert.VerifyPublicKeyPossession(identityKey, privateKey, []byte(nonce), proof); err != nil {
+		return "", status.Wrap(err, status.PermissionDenied)
+	}
+	return fp, nil
+}
+
+// consumeChallenge returns the private key of the challenge, which has to
+// be issued for the given fingerprint
+func (s APIService) consumeChallenge(nonce, fingerprint string) ([]byte, error) {
+	fp, privateKey, err := s.NodeService.ConsumeChallenge(nonce)
+	if err != nil {
+		if errors.Is(err, ErrChallengeNotFound) {
+			return nil, status.Wrap(err, status.PermissionDenied)
+		}
+		return nil, status.Wrap(fmt.Errorf("consume challenge: %w", err), status.Internal)
+	}
+	if fp != fingerprint {
+		return nil, status.Wrap(fmt.Errorf("challenge was issued for another key"), status.PermissionDenied)
+	}
+	return privateKey, nil
+}
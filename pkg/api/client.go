@@ -0,0 +1,306 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"tunnel/pkg/cert"
+)
+
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrServer       = errors.New("server error")
+)
+
+// StatusError is a non-OK response of the API, it unwraps to
+// ErrTokenExpired, ErrUnauthorized or ErrServer where those apply
+type StatusError struct {
+	StatusCode int
+	Body       string
+
+	class error
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("non-OK status code: %d, response body: %s", e.StatusCode, strings.TrimSpace(e.Body))
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.class
+}
+
+func newStatusError(statusCode int, body []byte) *StatusError {
+	e := &StatusError{StatusCode: statusCode, Body: string(body)}
+	switch {
+	case statusCode == http.StatusUnauthorized && strings.Contains(e.Body, "token expired"):
+		e.class = ErrTokenExpired
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		e.class = ErrUnauthorized
+	case statusCode >= 500:
+		e.class = ErrServer
+	}
+	return e
+}
+
+// Client calls the node facing endpoints of the API, retrying network
+// errors, 429 and 5xx responses with exponential backoff
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+
+	MaxAttempts    int
+	RequestTimeout time.Duration
+	MinBackoff     time.Duration
+	MaxBackoff     time.Duration
+}
+
+func NewClient(baseURL string, tlsConfig *tls.Config, maxAttempts int, requestTimeout time.Duration) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: &http.Client{Transport: transport},
+
+		MaxAttempts:    max(maxAttempts, 1),
+		RequestTimeout: requestTimeout,
+		MinBackoff:     time.Second,
+		MaxBackoff:     30 * time.Second,
+	}
+}
+
+// Connect enrolls the node with the one-time or master token, retrying only
+// when the server couldn't be reached. With an identity key the machine
+// proves its identity, getting its previous addresses back.
+func (c *Client) Connect(ctx context.Context, token, identityKeyPEM string, input ConnectGetInput) (*ConnectGetOutput, error) {
+	if identityKeyPEM != "" {
+		if err := c.proveIdentity(ctx, identityKeyPEM, &input); err != nil {
+			return nil, err
+		}
+	}
+
+	query := url.Values{}
+	for _, n := range input.UnsafeNetworks {
+		query.Add("unsafe_networks", n)
+	}
+	if input.Name != "" {
+		query.Set("name", input.Name)
+	}
+	if input.IdentityKey != "" {
+		query.Set("identity_key", input.IdentityKey)
+		query.Set("identity_nonce", input.IdentityNonce)
+		query.Set("identity_proof", input.IdentityProof)
+	}
+	if input.Lease != "" {
+		query.Set("lease", input.Lease)
+	}
+	path := "/connect"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	// the token is burned once the request reaches the server, so only
+	// requests which never left are retried
+	var output ConnectGetOutput
+	err := c.retry(ctx, http.MethodGet, path, func() (bool, error) {
+		_, err := c.attempt(ctx, http.MethodGet, path, token, nil, &output)
+		return IsUnreachable(err), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &output, nil
+}
+
+// proveIdentity answers a challenge for the identity key, the nonce stays
+// valid until a request carrying it reaches the server
+func (c *Client) proveIdentity(ctx context.Context, identityKeyPEM string, input *ConnectGetInput) error {
+	pubPEM, err := cert.PublicKeyPEM(identityKeyPEM)
+	if err != nil {
+		return fmt.Errorf("identity key: %w", err)
+	}
+
+	var challenge ChallengePostOutput
+	if err := c.do(ctx, http.MethodPost, "/challenge", "", ChallengePostInput{IdentityKey: pubPEM}, &challenge); err != nil {
+		return fmt.Errorf("challenge: %w", err)
+	}
+	proof, err := cert.ProveKeyPossession(identityKeyPEM, challenge.PublicKey, []byte(challenge.Nonce))
+	if err != nil {
+		return fmt.Errorf("answering challenge: %w", err)
+	}
+
+	input.IdentityKey = pubPEM
+	input.IdentityNonce = challenge.Nonce
+	input.IdentityProof = base64.RawURLEncoding.EncodeToString(proof)
+	return nil
+}
+
+// Renew re-signs the node cert, proving possession of its key
+func (c *Client) Renew(ctx context.Context, certPEM, keyPEM string) (*RenewPostOutput, error) {
+	var output RenewPostOutput
+	err := c.doProven(ctx, http.MethodPost, "/renew", certPEM, keyPEM, func(nonce string, proof []byte) any {
+		return RenewPostInput{Cert: certPEM, Nonce: nonce, Proof: proof}
+	}, &output)
+	if err != nil {
+		return nil, err
+	}
+	return &output, nil
+}
+
+func (c *Client) PutServices(ctx context.Context, certPEM, keyPEM string, services []ServicePort) error {
+	return c.doProven(ctx, http.MethodPut, "/services", certPEM, keyPEM, func(nonce string, proof []byte) any {
+		return ServicesPutInput{Cert: certPEM, Nonce: nonce, Proof: proof, Services: services}
+	}, nil)
+}
+
+func (c *Client) Leave(ctx context.Context, certPEM, keyPEM string) error {
+	return c.doProven(ctx, http.MethodPost, "/leave", certPEM, keyPEM, func(nonce string, proof []byte) any {
+		return LeavePostInput{Cert: certPEM, Nonce: nonce, Proof: proof}
+	}, nil)
+}
+
+// RevokeNode revokes a node through the operator API
+func (c *Client) RevokeNode(ctx context.Context, masterToken, name string) (*Node, error) {
+	var node Node
+	if err := c.do(ctx, http.MethodDelete, "/nodes/"+url.PathEscape(name), masterToken, nil, &node); err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path, token string, input, output any) error {
+	var reqBody []byte
+	if input != nil {
+		var err error
+		reqBody, err = json.Marshal(input)
+		if err != nil {
+			return fmt.Errorf("marshaling JSON request: %w", err)
+		}
+	}
+
+	return c.retry(ctx, method, path, func() (bool, error) {
+		return c.attempt(ctx, method, path, token, reqBody, output)
+	})
+}
+
+// doProven answers a fresh challenge for the cert on every attempt, a nonce
+// is gone once the server has seen it
+func (c *Client) doProven(ctx context.Context, method, path, certPEM, keyPEM string, input func(nonce string, proof []byte) any, output any) error {
+	challengeBody, err := json.Marshal(ChallengePostInput{Cert: certPEM})
+	if err != nil {
+		return fmt.Errorf("marshaling JSON request: %w", err)
+	}
+
+	return c.retry(ctx, method, path, func() (bool, error) {
+		var challenge ChallengePostOutput
+		if retry, err := c.attempt(ctx, http.MethodPost, "/challenge", "", challengeBody, &challenge); err != nil {
+			return retry, fmt.Errorf("challenge: %w", err)
+		}
+		proof, err := cert.ProveKeyPossession(keyPEM, challenge.PublicKey, []byte(challenge.Nonce))
+		if err != nil {
+			return false, fmt.Errorf("answering challenge: %w", err)
+		}
+
+		reqBody, err := json.Marshal(input(challenge.Nonce, proof))
+		if err != nil {
+			return false, fmt.Errorf("marshaling JSON request: %w", err)
+		}
+		return c.attempt(ctx, method, path, "", reqBody, output)
+	})
+}
+
+func (c *Client) retry(ctx context.Context, method, path string, attemptFn func() (bool, error)) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		retry, err = attemptFn()
+		if !retry || attempt >= c.MaxAttempts {
+			break
+		}
+
+		backoff := c.backoff(attempt)
+		log.Printf("[WARN] %s %s failed (attempt %d/%d), retrying in %s: %v", method, path, attempt, c.MaxAttempts, backoff, err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w, last error: %v", ctx.Err(), err)
+		case <-time.After(backoff):
+		}
+	}
+	return err
+}
+
+// attempt makes a single request, reporting whether a failure is worth
+// retrying
+func (c *Client) attempt(ctx context.Context, method, path, token string, reqBody []byte, output any) (bool, error) {
+	if c.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.RequestTimeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, bytes.NewReader(reqBody))
+	if err != nil {
+		return false, fmt.Errorf("creating http request: %w", err)
+	}
+	if reqBody != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		// a wrong server doesn't get right by retrying
+		var verifyErr *tls.CertificateVerificationError
+		retry := !errors.As(err, &verifyErr) && !errors.Is(err, ErrPinMismatch)
+		return retry, fmt.Errorf("making http request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return true, fmt.Errorf("reading response body: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, newStatusError(resp.StatusCode, body)
+	}
+
+	if output != nil {
+		if err := json.Unmarshal(body, output); err != nil {
+			return false, fmt.Errorf("unmarshaling JSON response: %w", err)
+		}
+	}
+	return false, nil
+}
+
+// IsUnreachable tells whether the request failed before a connection to the
+// server was made
+func IsUnreachable(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// backoff doubles from MinBackoff up to MaxBackoff, jittered down by up to
+// a half so clients failing together don't retry together
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.MinBackoff << min(attempt-1, 16)
+	if d <= 0 || d > c.MaxBackoff {
+		d = c.MaxBackoff
+	}
+	return d/2 + rand.N(d/2+1)
+}
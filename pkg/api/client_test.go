@@ -0,0 +1,116 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestServer answers every request with statusCode and body, counting
+// the requests
+func newTestServer(t *testing.T, statusCode int, body string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(statusCode)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func newTestClient(baseURL string) *Client {
+	c := NewClient(baseURL, nil, 3, time.Second)
+	c.MinBackoff = time.Millisecond
+	c.MaxBackoff = time.Millisecond
+	return c
+}
+
+func TestStatusErrorClass(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		body       string
+		want       error
+	}{
+		{"unauthorized", http.StatusUnauthorized, "unathorized\n", ErrUnauthorized},
+		{"expired", http.StatusUnauthorized, "token expired\n", ErrTokenExpired},
+		{"forbidden", http.StatusForbidden, "unauthorized\n", ErrUnauthorized},
+		{"internal", http.StatusInternalServerError, `{"status":"INTERNAL"}`, ErrServer},
+		{"unavailable", http.StatusServiceUnavailable, "", ErrServer},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, _ := newTestServer(t, tc.statusCode, tc.body)
+
+			_, err := newTestClient(srv.URL).Connect(context.Background(), "token", "", ConnectGetInput{})
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("err = %v, want %v", err, tc.want)
+			}
+			var statusErr *StatusError
+			if !errors.As(err, &statusErr) || statusErr.StatusCode != tc.statusCode {
+				t.Errorf("err = %v, want a StatusError with status code %d", err, tc.statusCode)
+			}
+		})
+	}
+
+	srv, _ := newTestServer(t, http.StatusBadRequest, `{"status":"INVALID_ARGUMENT"}`)
+	_, err := newTestClient(srv.URL).Connect(context.Background(), "token", "", ConnectGetInput{})
+	if err == nil || errors.Is(err, ErrUnauthorized) || errors.Is(err, ErrTokenExpired) || errors.Is(err, ErrServer) {
+		t.Errorf("400: err = %v, want an unclassified StatusError", err)
+	}
+}
+
+func TestConnectNotRetriedOnceSent(t *testing.T) {
+	for _, statusCode := range []int{http.StatusInternalServerError, http.StatusTooManyRequests, http.StatusUnauthorized} {
+		srv, requests := newTestServer(t, statusCode, "")
+
+		if _, err := newTestClient(srv.URL).Connect(context.Background(), "token", "", ConnectGetInput{}); err == nil {
+			t.Fatalf("%d: Connect succeeded", statusCode)
+		}
+		if n := requests.Load(); n != 1 {
+			t.Errorf("%d: Connect made %d requests, want 1", statusCode, n)
+		}
+	}
+}
+
+func TestConnectRetriedWhileUnreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	_, err = newTestClient("http://"+addr).Connect(context.Background(), "token", "", ConnectGetInput{})
+	if !IsUnreachable(err) {
+		t.Fatalf("err = %v, want a dial error", err)
+	}
+}
+
+func TestDoRetriesServerErrors(t *testing.T) {
+	srv, requests := newTestServer(t, http.StatusServiceUnavailable, "")
+
+	err := newTestClient(srv.URL).do(context.Background(), http.MethodGet, "/", "", nil, nil)
+	if !errors.Is(err, ErrServer) {
+		t.Fatalf("err = %v, want ErrServer", err)
+	}
+	if n := requests.Load(); n != 3 {
+		t.Errorf("made %d requests, want 3", n)
+	}
+
+	srv, requests = newTestServer(t, http.StatusUnauthorized, "")
+	if err := newTestClient(srv.URL).do(context.Background(), http.MethodGet, "/", "", nil, nil); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("err = %v, want ErrUnauthorized", err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("made %d requests on 401, want 1", n)
+	}
+}
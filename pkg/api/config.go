@@ -0,0 +1,36 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/swaggest/usecase/status"
+)
+
+// ReloadResult tells which settings a configuration reload applied and
+// which changed ones only take effect after a restart
+type ReloadResult struct {
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restart_required"`
+}
+
+// ErrInvalidConfig is returned by reloads rejecting the new configuration,
+// the running one stays in place
+var ErrInvalidConfig = errors.New("invalid config")
+
+func (s APIService) ConfigReloadPost(ctx context.Context, input struct{}, output *ReloadResult) error {
+	if s.ReloadConfig == nil {
+		return status.Wrap(errors.New("config reload is not supported"), status.Unimplemented)
+	}
+
+	result, err := s.ReloadConfig()
+	if errors.Is(err, ErrInvalidConfig) {
+		return status.Wrap(err, status.InvalidArgument)
+	} else if err != nil {
+		return status.Wrap(fmt.Errorf("reload config: %w", err), status.Internal)
+	}
+
+	*output = *result
+	return nil
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"tunnel/internal/lifecycle"
+)
+
+const (
+	eventsPollInterval = time.Second
+	eventsKeepAlive    = 15 * time.Second
+	eventsBatchSize    = 100
+)
+
+// EventsStream streams events as Server-Sent Events. Clients resume with
+// the Last-Event-ID header (or the last_event_id query parameter) and can
+// filter with the types (comma separated or repeated) and node query
+// parameters. Without a resume id only new events are sent.
+func (s APIService) EventsStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	var types []string
+	for _, t := range query["types"] {
+		for _, t := range strings.Split(t, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				types = append(types, t)
+			}
+		}
+	}
+	node := query.Get("node")
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = query.Get("last_event_id")
+	}
+	var afterID int64
+	if lastID != "" {
+		var err error
+		afterID, err = strconv.ParseInt(lastID, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid last event id", http.StatusBadRequest)
+			return
+		}
+	} else {
+		var err error
+		afterID, err = s.EventService.LastID()
+		if err != nil {
+			log.Printf("[WARN] reading last event id: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", (3 * time.Second).Milliseconds())
+	flusher.Flush()
+
+	poll := time.NewTicker(eventsPollInterval)
+	defer poll.Stop()
+	lastWrite := time.Now()
+
+	for {
+		evs, err := s.EventService.List(afterID, types, node, eventsBatchSize)
+		if err != nil {
+			log.Printf("[WARN] listing events: %v", err)
+			return
+		}
+		for _, e := range evs {
+			data, err := json.Marshal(e)
+			if err != nil {
+				log.Printf("[WARN] marshal event %d: %v", e.ID, err)
+				return
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+			afterID = e.ID
+		}
+		if len(evs) > 0 {
+			flusher.Flush()
+			lastWrite = time.Now()
+			if len(evs) == eventsBatchSize {
+				continue
+			}
+		} else if time.Since(lastWrite) >= eventsKeepAlive {
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+			lastWrite = time.Now()
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-lifecycle.Draining(r.Context()):
+			// clients resume from the last event ID on another instance
+			return
+		case <-poll.C:
+		}
+	}
+}
@@ -2,23 +2,96 @@ package api
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"tunnel/pkg/cert"
 	"tunnel/pkg/configurer"
+	"tunnel/pkg/events"
+	"tunnel/pkg/ipam"
+	"tunnel/pkg/metrics"
 
 	"github.com/google/uuid"
 	"github.com/swaggest/usecase/status"
 	"gopkg.in/yaml.v2"
 )
 
+type ConnectGetInput struct {
+	UnsafeNetworks []string `query:"unsafe_networks" description:"networks behind the node the server should route to (must be allowlisted)"`
+	Name           string   `query:"name" description:"node name, random if empty; taking over the name of an active node requires the same hardware ID"`
+	IdentityKey    string   `query:"identity_key" description:"public key PEM of the machine identity, re-enrolling with it hands out the previous addresses again and supersedes the active node of the machine"`
+	IdentityNonce  string   `query:"identity_nonce" description:"nonce of the challenge issued for the identity key"`
+	IdentityProof  string   `query:"identity_proof" description:"base64url answer to the challenge proving possession of the identity key"`
+	Lease          string   `query:"lease" description:"lease duration of the node (e.g. 720h), can only shorten the lease of the token"`
+}
+
+var nodeNameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,62}$`)
+
 type ConnectGetOutput struct {
 	ConnectionConfig string `json:"connection_config"`
 }
 
-func (s APIService) ConnectGet(ctx context.Context, input struct{}, output *ConnectGetOutput) error {
+func (s APIService) ConnectGet(ctx context.Context, input ConnectGetInput, output *ConnectGetOutput) error {
+	err := s.connect(ctx, input, output)
+	if err != nil {
+		metrics.Enrollments.WithLabelValues("failure").Inc()
+	} else {
+		metrics.Enrollments.WithLabelValues("success").Inc()
+	}
+	return err
+}
+
+func (s APIService) connect(ctx context.Context, input ConnectGetInput, output *ConnectGetOutput) error {
+	unsafeNetworks, err := s.validateUnsafeNetworks(input.UnsafeNetworks)
+	if err != nil {
+		return status.Wrap(err, status.InvalidArgument)
+	}
+
+	scope := tokenScope(ctx)
+
+	lease := scope.Lease
+	if input.Lease != "" {
+		requested, err := time.ParseDuration(input.Lease)
+		if err != nil || requested <= 0 {
+			return status.Wrap(fmt.Errorf("invalid lease %q", input.Lease), status.InvalidArgument)
+		}
+		if lease == 0 || requested < lease {
+			lease = requested
+		}
+	}
+	var leaseEndsAt *time.Time
+	if lease > 0 {
+		t := time.Now().Add(lease)
+		leaseEndsAt = &t
+	}
+
+	name := input.Name
+	if name == "" {
+		name = uuid.New().String()
+	} else if !nodeNameRegex.MatchString(name) || name == "server" {
+		return status.Wrap(fmt.Errorf("invalid node name %q", name), status.InvalidArgument)
+	}
+
+	// nodes of a pool only accept traffic from the server and their pool
+	groups := "client"
+	inboundGroups := ""
+	pool := scope.Pool
+	if pool != "" {
+		groups = "client," + pool
+		inboundGroups = "server," + pool
+	}
+
 	node := configurer.NebulaNode{
-		Name:           uuid.New().String(),
-		Groups:         "client",
+		Name:           name,
+		Groups:         groups,
+		InboundGroups:  inboundGroups,
+		UnsafeNetworks: strings.Join(unsafeNetworks, ","),
 		Punch:          false,
 		AmRelay:        false,
 		UseRelays:      false,
@@ -28,17 +101,83 @@ func (s APIService) ConnectGet(ctx context.Context, input struct{}, output *Conn
 		AcceptInbound:  true,
 	}
 
-	ip, err := s.IPAMService.NextIP()
+	// the hardware ID is the fingerprint of an identity key the machine
+	// proved to hold
+	var hardwareID string
+	if input.IdentityKey != "" {
+		proof, err := base64.RawURLEncoding.DecodeString(input.IdentityProof)
+		if err != nil {
+			return status.Wrap(fmt.Errorf("invalid identity proof: %w", err), status.InvalidArgument)
+		}
+		if hardwareID, err = s.provenIdentity(input.IdentityKey, input.IdentityNonce, proof); err != nil {
+			return err
+		}
+	}
+
+	ips, err := s.nodeIPs(name, hardwareID, pool)
+	if err != nil {
+		return err
+	}
+	ipCIDR, err := s.IPAMService.JoinIPsAndNets(ips)
 	if err != nil {
-		log.Fatalf("get next ip: %v", err)
+		return status.Wrap(fmt.Errorf("join ip and net: %w", err), status.Internal)
 	}
-	ipCIDR, err := s.IPAMService.JoinIPAndNet(ip)
 
-	connCfg, err := node.CreateConfig(s.CACert, s.CAKey, ipCIDR)
+	caCert, signer := s.Authority.CA()
+	connCfg, err := node.CreateConfig(caCert, signer, s.Authority.Bundle(), ipCIDR)
 	if err != nil {
 		return status.Wrap(fmt.Errorf("creating nebula cfg: %w", err), status.Internal)
 	}
 
+	caFp, err := cert.Fingerprint(caCert)
+	if err != nil {
+		return status.Wrap(fmt.Errorf("ca fingerprint: %w", err), status.Internal)
+	}
+	certPEM := connCfg.GetString("pki.cert", "")
+	certFp, err := cert.Fingerprint(certPEM)
+	if err != nil {
+		return status.Wrap(fmt.Errorf("cert fingerprint: %w", err), status.Internal)
+	}
+	superseded, err := s.NodeService.Register(Node{
+		Name:            node.Name,
+		IPs:             ips,
+		Pool:            pool,
+		HardwareID:      hardwareID,
+		LeaseEndsAt:     leaseEndsAt,
+		CAFingerprint:   caFp,
+		CertFingerprint: certFp,
+		UnsafeNetworks:  unsafeNetworks,
+	}, certPEM)
+	if err != nil {
+		if errors.Is(err, ErrNodeExists) {
+			return status.Wrap(err, status.AlreadyExists)
+		}
+		return status.Wrap(fmt.Errorf("register node: %w", err), status.Internal)
+	}
+
+	if (len(superseded) > 0 || len(unsafeNetworks) > 0) && s.ServerConfigChanged != nil {
+		if err = s.ServerConfigChanged(); err != nil {
+			log.Printf("[WARN] applying unsafe routes for %s: %v", node.Name, err)
+		}
+	}
+
+	for _, name := range superseded {
+		if name == node.Name {
+			continue
+		}
+		s.publish(events.TypeNodeRevoked, name, map[string]any{
+			"reason":        "superseded",
+			"superseded_by": node.Name,
+		})
+	}
+	s.publish(events.TypeNodeEnrolled, node.Name, map[string]any{
+		"ips":             ips,
+		"pool":            pool,
+		"unsafe_networks": unsafeNetworks,
+		"lease_ends_at":   leaseEndsAt,
+		"reenrolled":      slices.Contains(superseded, node.Name),
+	})
+
 	serverAddr, err := s.IPAMService.ServerAddr()
 	if err != nil {
 		return status.Wrap(fmt.Errorf("getting server addr: %w", err), status.Internal)
@@ -69,12 +208,211 @@ func (s APIService) ConnectGet(ctx context.Context, input struct{}, output *Conn
 	return nil
 }
 
+// publish emits an event, failures are logged only since the change it
+// describes already happened
+func (s APIService) publish(eventType, node string, data map[string]any) {
+	if _, err := s.EventService.Publish(eventType, node, data); err != nil {
+		log.Printf("[WARN] publishing %s event for %s: %v", eventType, node, err)
+	}
+}
+
+// nodeIPs hands out the addresses reserved for the node name or hardware ID,
+// or allocates new ones from the pool. New addresses stick to the hardware
+// ID so the machine gets them back when it enrolls again.
+func (s APIService) nodeIPs(name, hardwareID, pool string) ([]string, error) {
+	reservation, err := s.IPAMService.FindReservation(name, hardwareID)
+	if err == nil {
+		if pool != "" {
+			inPool, err := s.IPAMService.PoolContains(pool, reservation.IPs)
+			if err != nil {
+				return nil, status.Wrap(fmt.Errorf("check pool: %w", err), status.Internal)
+			}
+			if !inPool {
+				return nil, status.Wrap(
+					fmt.Errorf("reserved addresses %s are outside of pool %s", strings.Join(reservation.IPs, ","), pool),
+					status.FailedPrecondition,
+				)
+			}
+		}
+
+		// the previous node of the same machine is superseded on register
+		for _, ip := range reservation.IPs {
+			holder, err := s.NodeService.HolderOf(ip)
+			if errors.Is(err, ErrNodeNotFound) {
+				continue
+			} else if err != nil {
+				return nil, status.Wrap(fmt.Errorf("get address holder: %w", err), status.Internal)
+			}
+			if holder.Name != name && (hardwareID == "" || holder.HardwareID != hardwareID) {
+				return nil, status.Wrap(
+					fmt.Errorf("reserved address %s is in use by %s", ip, holder.Name),
+					status.FailedPrecondition,
+				)
+			}
+		}
+
+		return reservation.IPs, nil
+	} else if !errors.Is(err, ipam.ErrReservationNotFound) {
+		return nil, status.Wrap(fmt.Errorf("find reservation: %w", err), status.Internal)
+	}
+
+	ips, err := s.IPAMService.NextIPs(pool)
+	if err != nil {
+		if errors.Is(err, ipam.ErrPoolNotFound) {
+			return nil, status.Wrap(err, status.FailedPrecondition)
+		}
+		return nil, status.Wrap(fmt.Errorf("get next ip: %w", err), status.Internal)
+	}
+
+	if hardwareID != "" {
+		if err := s.IPAMService.Reserve(ipam.Reservation{
+			IPs:        ips,
+			HardwareID: hardwareID,
+			Sticky:     true,
+		}); err != nil {
+			log.Printf("[WARN] recording sticky addresses of %s: %v", name, err)
+		}
+	}
+
+	return ips, nil
+}
+
+// validateUnsafeNetworks checks that every requested network is covered by
+// the allowlist and doesn't collide with the overlay or other nodes' routes
+func (s APIService) validateUnsafeNetworks(requested []string) ([]string, error) {
+	if len(requested) == 0 {
+		return nil, nil
+	}
+
+	overlays, err := s.IPAMService.Networks()
+	if err != nil {
+		return nil, fmt.Errorf("invalid network CIDR: %w", err)
+	}
+	routes, err := s.NodeService.UnsafeRoutes()
+	if err != nil {
+		return nil, fmt.Errorf("list unsafe routes: %w", err)
+	}
+
+	var networks []string
+	var seen []netip.Prefix
+	for _, r := range requested {
+		n, err := netip.ParsePrefix(strings.TrimSpace(r))
+		if err != nil {
+			return nil, fmt.Errorf("invalid unsafe network %s: %w", r, err)
+		}
+		n = n.Masked()
+
+		allowed := false
+		for _, a := range s.Settings.Get().UnsafeNetworksAllowlist {
+			if a.Bits() <= n.Bits() && a.Contains(n.Addr()) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return nil, fmt.Errorf("unsafe network %s is not allowlisted", n)
+		}
+
+		for _, overlay := range overlays {
+			if n.Overlaps(overlay) {
+				return nil, fmt.Errorf("unsafe network %s overlaps the overlay network %s", n, overlay.Masked())
+			}
+		}
+		for route, via := range routes {
+			existing, err := netip.ParsePrefix(route)
+			if err == nil && n.Overlaps(existing) {
+				return nil, fmt.Errorf("unsafe network %s overlaps %s routed via %s", n, existing, via)
+			}
+		}
+		for _, other := range seen {
+			if n.Overlaps(other) {
+				return nil, fmt.Errorf("unsafe network %s overlaps %s", n, other)
+			}
+		}
+
+		seen = append(seen, n)
+		networks = append(networks, n.String())
+	}
+
+	return networks, nil
+}
+
+type RenewPostInput struct {
+	Cert  string `json:"cert" required:"true"`
+	Nonce string `json:"nonce" required:"true" description:"nonce of a challenge issued for the certificate"`
+	Proof []byte `json:"proof" required:"true" description:"HMAC-SHA256 of the nonce keyed with the secret shared with the challenge key"`
+}
+
+type RenewPostOutput struct {
+	Cert string `json:"cert"`
+	CA   string `json:"ca"`
+}
+
+func (s APIService) RenewPost(ctx context.Context, input RenewPostInput, output *RenewPostOutput) error {
+	node, err := s.provenNode(input.Cert, input.Nonce, input.Proof)
+	if err != nil {
+		return err
+	}
+
+	caCert, signer := s.Authority.CA()
+	certPair, err := cert.ResignCert(caCert, signer, input.Cert)
+	if err != nil {
+		return status.Wrap(fmt.Errorf("resign cert: %w", err), status.Internal)
+	}
+
+	caFp, err := cert.Fingerprint(caCert)
+	if err != nil {
+		return status.Wrap(fmt.Errorf("ca fingerprint: %w", err), status.Internal)
+	}
+	certFp, err := cert.Fingerprint(certPair.CertPEM)
+	if err != nil {
+		return status.Wrap(fmt.Errorf("cert fingerprint: %w", err), status.Internal)
+	}
+	if err = s.NodeService.UpdateCert(node.Name, caFp, certFp, certPair.CertPEM); err != nil {
+		return status.Wrap(fmt.Errorf("update node cert: %w", err), status.Internal)
+	}
+
+	if err = s.retireUnusedCAs(); err != nil {
+		log.Printf("[WARN] retiring unused CAs: %v", err)
+	}
+
+	output.Cert = certPair.CertPEM
+	output.CA = s.Authority.Bundle()
+	return nil
+}
+
+type TokenGetInput struct {
+	Pool  string `query:"pool" description:"address pool the enrolled node gets its address from (default pool if empty)"`
+	Lease string `query:"lease" description:"lease duration of the enrolled node (e.g. 720h), unlimited if empty"`
+}
+
 type TokenGetOutput struct {
 	OntTimeToken string `json:"one_time_token"`
 }
 
-func (s APIService) TokenGet(ctx context.Context, input struct{}, output *TokenGetOutput) error {
-	token, err := s.AuthService.NewToken()
+func (s APIService) TokenGet(ctx context.Context, input TokenGetInput, output *TokenGetOutput) error {
+	if input.Pool != "" {
+		if _, err := s.IPAMService.GetPool(input.Pool); err != nil {
+			if errors.Is(err, ipam.ErrPoolNotFound) {
+				return status.Wrap(err, status.NotFound)
+			}
+			return status.Wrap(fmt.Errorf("get pool: %w", err), status.Internal)
+		}
+	}
+
+	var lease time.Duration
+	if input.Lease != "" {
+		var err error
+		lease, err = time.ParseDuration(input.Lease)
+		if err != nil || lease <= 0 {
+			return status.Wrap(fmt.Errorf("invalid lease %q", input.Lease), status.InvalidArgument)
+		}
+	}
+
+	token, err := s.AuthService.NewToken(TokenScope{
+		Pool:  input.Pool,
+		Lease: lease,
+	})
 	if err != nil {
 		return status.Wrap(fmt.Errorf("new token: %w", err), status.Internal)
 	}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"tunnel/pkg/ipam"
+
+	"github.com/swaggest/usecase/status"
+)
+
+func (s APIService) IPAMGet(ctx context.Context, input struct{}, output *ipam.Usage) error {
+	nodes, err := s.NodeService.ListActive()
+	if err != nil {
+		return status.Wrap(fmt.Errorf("list nodes: %w", err), status.Internal)
+	}
+	var leases []string
+	for _, n := range nodes {
+		leases = append(leases, n.IPs...)
+	}
+
+	usage, err := s.IPAMService.Usage(leases)
+	if err != nil {
+		return status.Wrap(fmt.Errorf("ipam usage: %w", err), status.Internal)
+	}
+
+	*output = *usage
+	return nil
+}
+
+type Lease struct {
+	IP         string    `json:"ip"`
+	Node       string    `json:"node"`
+	Pool       string    `json:"pool,omitempty"`
+	HardwareID string    `json:"hardware_id,omitempty"`
+	Reserved   bool      `json:"reserved"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type IPAMAllocationsGetOutput struct {
+	Allocations []Lease `json:"allocations"`
+}
+
+func (s APIService) IPAMAllocationsGet(ctx context.Context, input struct{}, output *IPAMAllocationsGetOutput) error {
+	nodes, err := s.NodeService.ListActive()
+	if err != nil {
+		return status.Wrap(fmt.Errorf("list nodes: %w", err), status.Internal)
+	}
+	reservations, err := s.IPAMService.ListReservations()
+	if err != nil {
+		return status.Wrap(fmt.Errorf("list reservations: %w", err), status.Internal)
+	}
+	reserved := map[string]bool{}
+	for _, r := range reservations {
+		for _, ip := range r.IPs {
+			reserved[ip] = true
+		}
+	}
+
+	output.Allocations = []Lease{}
+	for _, n := range nodes {
+		for _, ip := range n.IPs {
+			output.Allocations = append(output.Allocations, Lease{
+				IP:         ip,
+				Node:       n.Name,
+				Pool:       n.Pool,
+				HardwareID: n.HardwareID,
+				Reserved:   reserved[ip],
+				CreatedAt:  n.CreatedAt,
+			})
+		}
+	}
+
+	return nil
+}
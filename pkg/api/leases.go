@@ -0,0 +1,55 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/swaggest/usecase/status"
+)
+
+type NodeLeasePostInput struct {
+	Name      string `path:"name"`
+	Extend    string `json:"extend,omitempty" description:"duration to add to the current lease end, or to now if the node has no lease (e.g. 720h)"`
+	Unlimited bool   `json:"unlimited,omitempty" description:"remove the lease end"`
+}
+
+func (s APIService) NodeLeasePost(ctx context.Context, input NodeLeasePostInput, output *Node) error {
+	node, err := s.NodeService.Get(input.Name)
+	if err != nil {
+		if errors.Is(err, ErrNodeNotFound) {
+			return status.Wrap(err, status.NotFound)
+		}
+		return status.Wrap(fmt.Errorf("get node: %w", err), status.Internal)
+	}
+
+	var endsAt *time.Time
+	switch {
+	case input.Unlimited:
+	case input.Extend != "":
+		extend, err := time.ParseDuration(input.Extend)
+		if err != nil || extend <= 0 {
+			return status.Wrap(fmt.Errorf("invalid lease extension %q", input.Extend), status.InvalidArgument)
+		}
+		t := time.Now()
+		if node.LeaseEndsAt != nil && node.LeaseEndsAt.After(t) {
+			t = *node.LeaseEndsAt
+		}
+		t = t.Add(extend)
+		endsAt = &t
+	default:
+		return status.Wrap(fmt.Errorf("either extend or unlimited is required"), status.InvalidArgument)
+	}
+
+	node, err = s.NodeService.SetLease(input.Name, endsAt)
+	if err != nil {
+		if errors.Is(err, ErrNodeNotFound) {
+			return status.Wrap(err, status.NotFound)
+		}
+		return status.Wrap(fmt.Errorf("set lease: %w", err), status.Internal)
+	}
+
+	*output = *node
+	return nil
+}
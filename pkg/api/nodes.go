@@ -0,0 +1,532 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"tunnel/pkg/cert"
+)
+
+var (
+	ErrNodeNotFound = errors.New("node not found or revoked")
+	ErrCertNotFound = errors.New("certificate not found")
+	ErrNodeExists   = errors.New("node name is taken by another machine")
+)
+
+type NodeService struct {
+	DB *sql.DB
+}
+
+type Node struct {
+	Name            string     `json:"name"`
+	IPs             []string   `json:"ips"`
+	CAFingerprint   string     `json:"ca_fingerprint"`
+	CertFingerprint string     `json:"cert_fingerprint"`
+	UnsafeNetworks  []string   `json:"unsafe_networks"`
+	Pool            string     `json:"pool,omitempty"`
+	HardwareID      string     `json:"hardware_id,omitempty"`
+	LeaseEndsAt     *time.Time `json:"lease_ends_at,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+	RevokedAt       *time.Time `json:"revoked_at,omitempty"`
+}
+
+type IssuedCert struct {
+	Fingerprint   string
+	NodeName      string
+	CAFingerprint string
+	CertPEM       string
+	IssuedAt      time.Time
+	BlocklistedAt *time.Time
+}
+
+func initNodesTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS nodes (
+			name TEXT NOT NULL PRIMARY KEY,
+			ip TEXT NOT NULL,
+			ca_fingerprint TEXT NOT NULL,
+			cert_fingerprint TEXT NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			revoked_at TIMESTAMP WITH TIME ZONE
+		);
+		CREATE TABLE IF NOT EXISTS certs (
+			fingerprint TEXT NOT NULL PRIMARY KEY,
+			node_name TEXT NOT NULL,
+			ca_fingerprint TEXT NOT NULL,
+			cert_pem TEXT NOT NULL,
+			issued_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			blocklisted_at TIMESTAMP WITH TIME ZONE
+		);
+		ALTER TABLE nodes ADD COLUMN IF NOT EXISTS unsafe_networks TEXT NOT NULL DEFAULT '';
+		ALTER TABLE nodes ADD COLUMN IF NOT EXISTS pool TEXT NOT NULL DEFAULT '';
+		ALTER TABLE nodes ADD COLUMN IF NOT EXISTS hardware_id TEXT NOT NULL DEFAULT '';
+		ALTER TABLE nodes ADD COLUMN IF NOT EXISTS lease_ends_at TIMESTAMP WITH TIME ZONE;
+		ALTER TABLE nodes ADD COLUMN IF NOT EXISTS lease_warned_at TIMESTAMP WITH TIME ZONE;
+		CREATE TABLE IF NOT EXISTS node_services (
+			node_name TEXT NOT NULL,
+			port INTEGER NOT NULL,
+			protocol TEXT NOT NULL,
+			updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			PRIMARY KEY (node_name, port, protocol)
+		);
+		CREATE TABLE IF NOT EXISTS node_challenges (
+			nonce TEXT NOT NULL PRIMARY KEY,
+			fingerprint TEXT NOT NULL,
+			private_key BYTEA NOT NULL,
+			expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+		);
+	`)
+	return err
+}
+
+// Register stores a newly enrolled node. A node re-enrolling from the same
+// machine (same hardware ID) supersedes the previous nodes of that machine:
+// they get revoked and their certs blocklisted. The names of the superseded
+// nodes are returned, including the node itself when it was enrolled before.
+func (s NodeService) Register(n Node, certPEM string) (superseded []string, err error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`UPDATE
+			certs
+			SET
+			blocklisted_at = NOW()
+			WHERE blocklisted_at IS NULL AND node_name IN (
+				SELECT name FROM nodes WHERE name = $1 OR (hardware_id = $2 AND $2 != '')
+			)
+			RETURNING node_name`,
+		n.Name, n.HardwareID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if !slices.Contains(superseded, name) {
+			superseded = append(superseded, name)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`UPDATE
+			nodes
+			SET
+			revoked_at = NOW(), updated_at = NOW()
+			WHERE hardware_id = $1 AND $1 != '' AND name != $2 AND revoked_at IS NULL`,
+		n.HardwareID, n.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	// a node name can only be taken over when the node is revoked or is
+	// the same machine
+	res, err := tx.Exec(`INSERT
+			INTO nodes
+			(name, ip, ca_fingerprint, cert_fingerprint, unsafe_networks, pool, hardware_id, lease_ends_at)
+			VALUES
+			($1, $2, $3, $4, $5, $6, $7, $8)
+			ON CONFLICT (name) DO UPDATE
+			SET
+			ip = EXCLUDED.ip,
+			ca_fingerprint = EXCLUDED.ca_fingerprint,
+			cert_fingerprint = EXCLUDED.cert_fingerprint,
+			unsafe_networks = EXCLUDED.unsafe_networks,
+			pool = EXCLUDED.pool,
+			hardware_id = EXCLUDED.hardware_id,
+			lease_ends_at = EXCLUDED.lease_ends_at,
+			lease_warned_at = NULL,
+			created_at = NOW(),
+			updated_at = NOW(),
+			revoked_at = NULL
+			WHERE nodes.revoked_at IS NOT NULL OR (nodes.hardware_id != '' AND nodes.hardware_id = EXCLUDED.hardware_id)`,
+		n.Name, strings.Join(n.IPs, ","), n.CAFingerprint, n.CertFingerprint, strings.Join(n.UnsafeNetworks, ","), n.Pool, n.HardwareID, n.LeaseEndsAt)
+	if err != nil {
+		return nil, err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rowsAffected == 0 {
+		return nil, ErrNodeExists
+	}
+
+	if err = recordCert(tx, n.Name, n.CAFingerprint, n.CertFingerprint, certPEM); err != nil {
+		return nil, err
+	}
+
+	return superseded, tx.Commit()
+}
+
+func (s NodeService) UpdateCert(name, caFingerprint, certFingerprint, certPEM string) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE
+			nodes
+			SET
+			ca_fingerprint = $1, cert_fingerprint = $2, updated_at = NOW()
+			WHERE name = $3 AND revoked_at IS NULL`,
+		caFingerprint, certFingerprint, name)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNodeNotFound
+	}
+
+	if err = recordCert(tx, name, caFingerprint, certFingerprint, certPEM); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func recordCert(tx *sql.Tx, name, caFingerprint, certFingerprint, certPEM string) error {
+	_, err := tx.Exec(`INSERT
+			INTO certs
+			(fingerprint, node_name, ca_fingerprint, cert_pem)
+			VALUES
+			($1, $2, $3, $4)`,
+		certFingerprint, name, caFingerprint, certPEM)
+	return err
+}
+
+func (s NodeService) GetCert(fingerprint string) (*IssuedCert, error) {
+	var c IssuedCert
+	row := s.DB.QueryRow(`SELECT
+			fingerprint, node_name, ca_fingerprint, cert_pem, issued_at, blocklisted_at
+			FROM certs
+			WHERE fingerprint = $1`,
+		fingerprint)
+	err := row.Scan(&c.Fingerprint, &c.NodeName, &c.CAFingerprint, &c.CertPEM, &c.IssuedAt, &c.BlocklistedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrCertNotFound
+		}
+		return nil, err
+	}
+	return &c, nil
+}
+
+// certsExpiry returns when the last cert ever issued to the node name
+// expires, blocklisted ones included
+func certsExpiry(tx *sql.Tx, name string) (time.Time, error) {
+	rows, err := tx.Query(`SELECT cert_pem FROM certs WHERE node_name = $1`, name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer rows.Close()
+
+	var expiry time.Time
+	for rows.Next() {
+		var certPEM string
+		if err := rows.Scan(&certPEM); err != nil {
+			return time.Time{}, err
+		}
+		info, err := cert.Inspect(certPEM)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("cert of %s: %w", name, err)
+		}
+		if info.NotAfter.After(expiry) {
+			expiry = info.NotAfter
+		}
+	}
+	return expiry, rows.Err()
+}
+
+const nodeColumns = `name, ip, ca_fingerprint, cert_fingerprint, unsafe_networks, pool, hardware_id,
+	lease_ends_at, created_at, updated_at, revoked_at`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanNode(row rowScanner) (*Node, error) {
+	var n Node
+	var ips, unsafeNetworks string
+	err := row.Scan(&n.Name, &ips, &n.CAFingerprint, &n.CertFingerprint, &unsafeNetworks, &n.Pool, &n.HardwareID,
+		&n.LeaseEndsAt, &n.CreatedAt, &n.UpdatedAt, &n.RevokedAt)
+	if err != nil {
+		return nil, err
+	}
+	n.IPs = splitList(ips)
+	n.UnsafeNetworks = splitList(unsafeNetworks)
+	return &n, nil
+}
+
+func (s NodeService) Get(name string) (*Node, error) {
+	row := s.DB.QueryRow(`SELECT `+nodeColumns+`
+			FROM nodes
+			WHERE name = $1`,
+		name)
+	n, err := scanNode(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNodeNotFound
+		}
+		return nil, err
+	}
+	return n, nil
+}
+
+// ListActive returns all nodes which are not revoked
+func (s NodeService) ListActive() ([]Node, error) {
+	return s.query(`WHERE revoked_at IS NULL ORDER BY created_at, name`)
+}
+
+func (s NodeService) query(where string, args ...any) ([]Node, error) {
+	rows, err := s.DB.Query(`SELECT `+nodeColumns+`
+			FROM nodes
+			`+where,
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	nodes := []Node{}
+	for rows.Next() {
+		n, err := scanNode(rows)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, *n)
+	}
+	return nodes, rows.Err()
+}
+
+// ExpiringLeases returns the active nodes whose lease ends before the given
+// time and which weren't warned about it yet
+func (s NodeService) ExpiringLeases(before time.Time) ([]Node, error) {
+	return s.query(`WHERE revoked_at IS NULL AND lease_ends_at <= $1 AND lease_warned_at IS NULL
+			ORDER BY lease_ends_at`,
+		before)
+}
+
+func (s NodeService) MarkLeaseWarned(name string) error {
+	_, err := s.DB.Exec(`UPDATE
+			nodes
+			SET
+			lease_warned_at = NOW()
+			WHERE name = $1`,
+		name)
+	return err
+}
+
+// ExpiredLeases returns the active nodes whose lease has ended
+func (s NodeService) ExpiredLeases(now time.Time) ([]Node, error) {
+	return s.query(`WHERE revoked_at IS NULL AND lease_ends_at <= $1
+			ORDER BY lease_ends_at`,
+		now)
+}
+
+// SetLease changes the lease end of an active node, nil makes the lease
+// unlimited
+func (s NodeService) SetLease(name string, endsAt *time.Time) (*Node, error) {
+	res, err := s.DB.Exec(`UPDATE
+			nodes
+			SET
+			lease_ends_at = $1, lease_warned_at = NULL, updated_at = NOW()
+			WHERE name = $2 AND revoked_at IS NULL`,
+		endsAt, name)
+	if err != nil {
+		return nil, err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rowsAffected == 0 {
+		return nil, ErrNodeNotFound
+	}
+	return s.Get(name)
+}
+
+// Revoke marks an active node revoked and blocklists all of its certs.
+// release runs in the same transaction and gets when the last of the certs
+// expires.
+func (s NodeService) Revoke(name string, release func(tx *sql.Tx, n *Node, reusableAt time.Time) error) (*Node, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRow(`UPDATE
+			nodes
+			SET
+			revoked_at = NOW(), updated_at = NOW()
+			WHERE name = $1 AND revoked_at IS NULL
+			RETURNING `+nodeColumns,
+		name)
+	n, err := scanNode(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNodeNotFound
+		}
+		return nil, err
+	}
+
+	_, err = tx.Exec(`UPDATE
+			certs
+			SET
+			blocklisted_at = NOW()
+			WHERE node_name = $1 AND blocklisted_at IS NULL`,
+		name)
+	if err != nil {
+		return nil, err
+	}
+
+	if release != nil {
+		reusableAt, err := certsExpiry(tx, name)
+		if err != nil {
+			return nil, fmt.Errorf("cert expiry of %s: %w", name, err)
+		}
+		if err := release(tx, n, reusableAt); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// UnsafeRoutes maps every unsafe network of the active nodes to the node
+// primary ip
+func (s NodeService) UnsafeRoutes() (map[string]string, error) {
+	rows, err := s.DB.Query(`SELECT
+			ip, unsafe_networks
+			FROM nodes
+			WHERE revoked_at IS NULL AND unsafe_networks != ''`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	routes := map[string]string{}
+	for rows.Next() {
+		var ips, unsafeNetworks string
+		if err := rows.Scan(&ips, &unsafeNetworks); err != nil {
+			return nil, err
+		}
+		via := splitList(ips)
+		if len(via) == 0 {
+			continue
+		}
+		for _, n := range splitList(unsafeNetworks) {
+			routes[n] = via[0]
+		}
+	}
+
+	return routes, rows.Err()
+}
+
+// HolderOf returns the active node the address is assigned to
+func (s NodeService) HolderOf(ip string) (*Node, error) {
+	var name string
+	row := s.DB.QueryRow(`SELECT
+			name
+			FROM nodes
+			WHERE revoked_at IS NULL AND $1 = ANY(string_to_array(ip, ','))`,
+		ip)
+	if err := row.Scan(&name); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNodeNotFound
+		}
+		return nil, err
+	}
+	return s.Get(name)
+}
+
+// Allocations maps node names to their addresses, revoked nodes are only
+// included if includeRevoked is set
+func (s NodeService) Allocations(includeRevoked bool) (map[string][]string, error) {
+	rows, err := s.DB.Query(`SELECT
+			name, ip
+			FROM nodes
+			WHERE revoked_at IS NULL OR $1`,
+		includeRevoked)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	allocations := map[string][]string{}
+	for rows.Next() {
+		var name, ips string
+		if err := rows.Scan(&name, &ips); err != nil {
+			return nil, err
+		}
+		allocations[name] = splitList(ips)
+	}
+	return allocations, rows.Err()
+}
+
+// BlocklistedFingerprints lists the fingerprints of all blocklisted certs
+func (s NodeService) BlocklistedFingerprints() ([]string, error) {
+	rows, err := s.DB.Query(`SELECT
+			fingerprint
+			FROM certs
+			WHERE blocklisted_at IS NOT NULL
+			ORDER BY fingerprint`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fps := []string{}
+	for rows.Next() {
+		var fp string
+		if err := rows.Scan(&fp); err != nil {
+			return nil, err
+		}
+		fps = append(fps, fp)
+	}
+	return fps, rows.Err()
+}
+
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (s NodeService) CountActiveByCA(caFingerprint string) (int, error) {
+	var count int
+	row := s.DB.QueryRow(`SELECT
+			COUNT(*)
+			FROM nodes
+			WHERE ca_fingerprint = $1 AND revoked_at IS NULL`,
+		caFingerprint)
+	err := row.Scan(&count)
+	return count, err
+}
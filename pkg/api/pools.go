@@ -0,0 +1,42 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"tunnel/pkg/ipam"
+
+	"github.com/swaggest/usecase/status"
+)
+
+type PoolsGetOutput struct {
+	Pools []ipam.Pool `json:"pools"`
+}
+
+func (s APIService) PoolsGet(ctx context.Context, input struct{}, output *PoolsGetOutput) error {
+	pools, err := s.IPAMService.ListPools()
+	if err != nil {
+		return status.Wrap(fmt.Errorf("list pools: %w", err), status.Internal)
+	}
+
+	output.Pools = pools
+	return nil
+}
+
+type PoolsPostInput struct {
+	Name        string `json:"name" required:"true" description:"pool name, also added as a group to the certificates of its nodes"`
+	NetworkCIDR string `json:"network_cidr" required:"true" description:"subnets of the overlay network, one per overlay network (e.g. 10.1.0.0/16)"`
+}
+
+func (s APIService) PoolsPost(ctx context.Context, input PoolsPostInput, output *ipam.Pool) error {
+	pool, err := s.IPAMService.CreatePool(input.Name, input.NetworkCIDR)
+	if err != nil {
+		if errors.Is(err, ipam.ErrPoolExists) {
+			return status.Wrap(err, status.AlreadyExists)
+		}
+		return status.Wrap(err, status.InvalidArgument)
+	}
+
+	*output = *pool
+	return nil
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"tunnel/pkg/ipam"
+
+	"github.com/swaggest/usecase/status"
+)
+
+type ReservationsGetOutput struct {
+	Reservations []ipam.Reservation `json:"reservations"`
+}
+
+func (s APIService) ReservationsGet(ctx context.Context, input struct{}, output *ReservationsGetOutput) error {
+	reservations, err := s.IPAMService.ListReservations()
+	if err != nil {
+		return status.Wrap(fmt.Errorf("list reservations: %w", err), status.Internal)
+	}
+
+	output.Reservations = reservations
+	return nil
+}
+
+type ReservationsPostInput struct {
+	IPs        []string `json:"ips" required:"true" description:"one address per overlay network"`
+	NodeName   string   `json:"node_name,omitempty"`
+	HardwareID string   `json:"hardware_id,omitempty" description:"fingerprint of the machine identity key, logged by the client when it creates the key"`
+}
+
+func (s APIService) ReservationsPost(ctx context.Context, input ReservationsPostInput, output *ipam.Reservation) error {
+	// addresses may only be pinned to the node already using them
+	for _, ip := range input.IPs {
+		holder, err := s.NodeService.HolderOf(ip)
+		if errors.Is(err, ErrNodeNotFound) {
+			continue
+		} else if err != nil {
+			return status.Wrap(fmt.Errorf("get address holder: %w", err), status.Internal)
+		}
+		if !(input.NodeName != "" && holder.Name == input.NodeName) &&
+			!(input.HardwareID != "" && holder.HardwareID == input.HardwareID) {
+			return status.Wrap(fmt.Errorf("address %s is in use by %s", ip, holder.Name), status.FailedPrecondition)
+		}
+	}
+
+	reservation := ipam.Reservation{
+		IPs:        input.IPs,
+		NodeName:   input.NodeName,
+		HardwareID: input.HardwareID,
+	}
+	if err := s.IPAMService.Reserve(reservation); err != nil {
+		if errors.Is(err, ipam.ErrAddressReserved) {
+			return status.Wrap(err, status.AlreadyExists)
+		}
+		return status.Wrap(err, status.InvalidArgument)
+	}
+
+	r, err := s.IPAMService.FindReservation(input.NodeName, input.HardwareID)
+	if err != nil {
+		return status.Wrap(fmt.Errorf("find reservation: %w", err), status.Internal)
+	}
+	*output = *r
+	return nil
+}
+
+type ReservationsDeleteInput struct {
+	NodeName   string `query:"node_name"`
+	HardwareID string `query:"hardware_id" description:"as listed, empty for reservations of a node name only"`
+}
+
+func (s APIService) ReservationsDelete(ctx context.Context, input ReservationsDeleteInput, output *struct{}) error {
+	if err := s.IPAMService.DeleteReservation(input.NodeName, input.HardwareID); err != nil {
+		if errors.Is(err, ipam.ErrReservationNotFound) {
+			return status.Wrap(err, status.NotFound)
+		}
+		return status.Wrap(fmt.Errorf("delete reservation: %w", err), status.Internal)
+	}
+	return nil
+}
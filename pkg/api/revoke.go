@@ -0,0 +1,89 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+	"tunnel/pkg/events"
+	"tunnel/pkg/ipam"
+
+	"github.com/swaggest/usecase/status"
+)
+
+// RevokeNode revokes an active node and hands its addresses back to IPAM,
+// including the ones sticking to its hardware ID, all in one transaction.
+// The addresses are only handed out again once the certs of the node
+// expired, blocklisting alone doesn't stop a cert from naming them.
+func RevokeNode(nodeService NodeService, ipamService ipam.IPAMService, name string) (*Node, error) {
+	return nodeService.Revoke(name, func(tx *sql.Tx, n *Node, reusableAt time.Time) error {
+		if n.HardwareID != "" {
+			if err := ipamService.DeleteStickyReservations(tx, n.HardwareID); err != nil {
+				return fmt.Errorf("delete sticky addresses of %s: %w", n.Name, err)
+			}
+		}
+		if err := ipamService.Release(tx, n.IPs, reusableAt); err != nil {
+			return fmt.Errorf("release addresses of %s: %w", n.Name, err)
+		}
+		return nil
+	})
+}
+
+func (s APIService) revoke(name, reason string) (*Node, error) {
+	n, err := RevokeNode(s.NodeService, s.IPAMService, name)
+	if err != nil {
+		if errors.Is(err, ErrNodeNotFound) {
+			return nil, status.Wrap(err, status.NotFound)
+		}
+		return nil, status.Wrap(fmt.Errorf("revoke node: %w", err), status.Internal)
+	}
+
+	s.publish(events.TypeNodeRevoked, n.Name, map[string]any{
+		"reason": reason,
+		"ips":    n.IPs,
+	})
+
+	// blocklist the certs and drop the routes of the node
+	if s.ServerConfigChanged != nil {
+		if err := s.ServerConfigChanged(); err != nil {
+			return nil, status.Wrap(fmt.Errorf("apply server config: %w", err), status.Internal)
+		}
+	}
+
+	if err := s.retireUnusedCAs(); err != nil {
+		log.Printf("[WARN] retiring unused CAs: %v", err)
+	}
+	return n, nil
+}
+
+type NodeDeleteInput struct {
+	Name string `path:"name"`
+}
+
+func (s APIService) NodeDelete(ctx context.Context, input NodeDeleteInput, output *Node) error {
+	n, err := s.revoke(input.Name, "revoked")
+	if err != nil {
+		return err
+	}
+
+	*output = *n
+	return nil
+}
+
+type LeavePostInput struct {
+	Cert  string `json:"cert" required:"true" description:"current certificate of the node"`
+	Nonce string `json:"nonce" required:"true" description:"nonce of a challenge issued for the certificate"`
+	Proof []byte `json:"proof" required:"true" description:"HMAC-SHA256 of the nonce keyed with the secret shared with the challenge key"`
+}
+
+func (s APIService) LeavePost(ctx context.Context, input LeavePostInput, output *struct{}) error {
+	node, err := s.provenNode(input.Cert, input.Nonce, input.Proof)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.revoke(node.Name, "left")
+	return err
+}
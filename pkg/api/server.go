@@ -2,7 +2,11 @@ package api
 
 import (
 	"net/http"
+	"tunnel/pkg/cert"
+	"tunnel/pkg/events"
+	"tunnel/pkg/health"
 	"tunnel/pkg/ipam"
+	"tunnel/pkg/metrics"
 
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
@@ -17,27 +21,50 @@ import (
 type APIService struct {
 	AuthService AuthService
 	IPAMService ipam.IPAMService
+	NodeService NodeService
+
+	EventService events.EventService
 
 	NebulaPublicAddr string
 
-	CACert string
-	CAKey  string
+	Authority *cert.Authority
+
+	Settings *Settings
+
+	// called after anything the server nebula config is derived from has
+	// changed (active CA, CA bundle, blocklist, unsafe routes)
+	ServerConfigChanged func() error
+	// reloads the server configuration, nil if reloading isn't supported
+	ReloadConfig func() (*ReloadResult, error)
 }
 
 func NewAPIServer(
 	authService AuthService,
 	ipamService ipam.IPAMService,
-	allowedOrigins []string,
-	nebulaPubAddr, caCert, caKey string,
+	nodeService NodeService,
+	eventService events.EventService,
+	nebulaPubAddr string,
+	authority *cert.Authority,
+	settings *Settings,
+	serverConfigChanged func() error,
+	reloadConfig func() (*ReloadResult, error),
+	healthChecker *health.Checker,
 ) *web.Service {
 	svc := APIService{
 		AuthService: authService,
 		IPAMService: ipamService,
+		NodeService: nodeService,
+
+		EventService: eventService,
 
 		NebulaPublicAddr: nebulaPubAddr,
 
-		CACert: caCert,
-		CAKey:  caKey,
+		Authority: authority,
+
+		Settings: settings,
+
+		ServerConfigChanged: serverConfigChanged,
+		ReloadConfig:        reloadConfig,
 	}
 
 	webService := web.NewService(openapi3.NewReflector())
@@ -50,7 +77,7 @@ func NewAPIServer(
 	webService.Use(
 		cors.Handler(
 			cors.Options{
-				AllowedOrigins:   allowedOrigins,
+				AllowOriginFunc:  settings.AllowOrigin,
 				AllowCredentials: true,
 				AllowedHeaders: []string{
 					"authorization",
@@ -69,6 +96,7 @@ func NewAPIServer(
 	webService.Wrap(
 		middleware.Logger,
 		middleware.Recoverer,
+		metrics.APIMiddleware,
 	)
 
 	connectInteractor := usecase.NewInteractor(svc.ConnectGet)
@@ -76,6 +104,9 @@ func NewAPIServer(
 	connectInteractor.SetDescription("Requests a certificate for establishing a tunnel")
 	connectInteractor.SetExpectedErrors(
 		status.Internal,
+		status.AlreadyExists,
+		status.InvalidArgument,
+		status.FailedPrecondition,
 		status.PermissionDenied,
 	)
 	webService.With(
@@ -91,6 +122,8 @@ func NewAPIServer(
 	)
 	tokenInteractor.SetExpectedErrors(
 		status.Internal,
+		status.InvalidArgument,
+		status.NotFound,
 		status.PermissionDenied,
 	)
 	webService.With(
@@ -98,6 +131,291 @@ func NewAPIServer(
 		authService.RequireAuthMiddleware,
 	).Method(http.MethodGet, "/token", nethttp.NewHandler(tokenInteractor))
 
+	challengeInteractor := usecase.NewInteractor(svc.ChallengePost)
+	challengeInteractor.SetTitle("Challenge")
+	challengeInteractor.SetDescription(
+		"Issues a one-minute challenge to the holder of a node certificate. " +
+			"Requests authenticated by the certificate answer it to prove possession of the node key.",
+	)
+	challengeInteractor.SetExpectedErrors(
+		status.Internal,
+		status.InvalidArgument,
+		status.PermissionDenied,
+	)
+	webService.Method(http.MethodPost, "/challenge", nethttp.NewHandler(challengeInteractor))
+
+	renewInteractor := usecase.NewInteractor(svc.RenewPost)
+	renewInteractor.SetTitle("Renew")
+	renewInteractor.SetDescription(
+		"Re-signs a still valid node certificate under the active CA " +
+			"and returns it together with the current CA bundle.",
+	)
+	renewInteractor.SetExpectedErrors(
+		status.Internal,
+		status.InvalidArgument,
+		status.PermissionDenied,
+	)
+	webService.Method(http.MethodPost, "/renew", nethttp.NewHandler(renewInteractor))
+
+	caInteractor := usecase.NewInteractor(svc.CAGet)
+	caInteractor.SetTitle("CA Status")
+	caInteractor.SetDescription("Lists the CAs in the trust bundle and the number of active nodes signed by each.")
+	caInteractor.SetExpectedErrors(
+		status.Internal,
+		status.PermissionDenied,
+	)
+	webService.With(
+		authService.MasterAuthMiddleware,
+		authService.RequireAuthMiddleware,
+	).Method(http.MethodGet, "/ca", nethttp.NewHandler(caInteractor))
+
+	caRotateInteractor := usecase.NewInteractor(svc.CARotatePost)
+	caRotateInteractor.SetTitle("CA Rotation")
+	caRotateInteractor.SetDescription(
+		"Generates a new CA and makes it the signing CA. " +
+			"The previous CA stays trusted until no active node uses it any more.",
+	)
+	caRotateInteractor.SetExpectedErrors(
+		status.Internal,
+		status.PermissionDenied,
+	)
+	webService.With(
+		authService.MasterAuthMiddleware,
+		authService.RequireAuthMiddleware,
+	).Method(http.MethodPost, "/ca/rotate", nethttp.NewHandler(caRotateInteractor))
+
+	caDeleteInteractor := usecase.NewInteractor(svc.CADelete)
+	caDeleteInteractor.SetTitle("CA Retirement")
+	caDeleteInteractor.SetDescription(
+		"Drops a previous CA from the trust bundle without waiting for CA_RETIRE_GRACE. " +
+			"Refused while active nodes use it, certs of nodes enrolled before nodes were tracked are not counted.",
+	)
+	caDeleteInteractor.SetExpectedErrors(
+		status.Internal,
+		status.NotFound,
+		status.FailedPrecondition,
+		status.PermissionDenied,
+	)
+	webService.With(
+		authService.MasterAuthMiddleware,
+		authService.RequireAuthMiddleware,
+	).Method(http.MethodDelete, "/ca/{fingerprint}", nethttp.NewHandler(caDeleteInteractor))
+
+	servicesGetInteractor := usecase.NewInteractor(svc.ServicesGet)
+	servicesGetInteractor.SetTitle("Service Catalog")
+	servicesGetInteractor.SetDescription("Lists the ports the active nodes forward to their services.")
+	servicesGetInteractor.SetExpectedErrors(
+		status.Internal,
+		status.PermissionDenied,
+	)
+	webService.With(
+		authService.MasterAuthMiddleware,
+		authService.RequireAuthMiddleware,
+	).Method(http.MethodGet, "/services", nethttp.NewHandler(servicesGetInteractor))
+
+	servicesPutInteractor := usecase.NewInteractor(svc.ServicesPut)
+	servicesPutInteractor.SetTitle("Node Services")
+	servicesPutInteractor.SetDescription("Replaces the services of the node the certificate belongs to in the catalog.")
+	servicesPutInteractor.SetExpectedErrors(
+		status.Internal,
+		status.InvalidArgument,
+		status.PermissionDenied,
+	)
+	webService.Method(http.MethodPut, "/services", nethttp.NewHandler(servicesPutInteractor))
+
+	configReloadInteractor := usecase.NewInteractor(svc.ConfigReloadPost)
+	configReloadInteractor.SetTitle("Configuration Reload")
+	configReloadInteractor.SetDescription(
+		"Reloads the server configuration and the nebula config, same as SIGHUP. " +
+			"Lists the changed settings which only take effect after a restart.",
+	)
+	configReloadInteractor.SetExpectedErrors(
+		status.Internal,
+		status.InvalidArgument,
+		status.Unimplemented,
+		status.PermissionDenied,
+	)
+	webService.With(
+		authService.MasterAuthMiddleware,
+		authService.RequireAuthMiddleware,
+	).Method(http.MethodPost, "/config/reload", nethttp.NewHandler(configReloadInteractor))
+
+	certInteractor := usecase.NewInteractor(svc.CertGet)
+	certInteractor.SetTitle("Certificate")
+	certInteractor.SetDescription("Decodes an issued certificate by its fingerprint.")
+	certInteractor.SetExpectedErrors(
+		status.Internal,
+		status.NotFound,
+		status.PermissionDenied,
+	)
+	webService.With(
+		authService.MasterAuthMiddleware,
+		authService.RequireAuthMiddleware,
+	).Method(http.MethodGet, "/certs/{fingerprint}", nethttp.NewHandler(certInteractor))
+
+	certVerifyInteractor := usecase.NewInteractor(svc.CertVerifyPost)
+	certVerifyInteractor.SetTitle("Certificate Verification")
+	certVerifyInteractor.SetDescription(
+		"Decodes a certificate PEM and checks it against the CA bundle and the blocklist.",
+	)
+	certVerifyInteractor.SetExpectedErrors(
+		status.Internal,
+		status.InvalidArgument,
+		status.PermissionDenied,
+	)
+	webService.With(
+		authService.MasterAuthMiddleware,
+		authService.RequireAuthMiddleware,
+	).Method(http.MethodPost, "/certs/verify", nethttp.NewHandler(certVerifyInteractor))
+
+	nodeDeleteInteractor := usecase.NewInteractor(svc.NodeDelete)
+	nodeDeleteInteractor.SetTitle("Node Revocation")
+	nodeDeleteInteractor.SetDescription("Revokes a node, blocklists its certificates and releases its addresses.")
+	nodeDeleteInteractor.SetExpectedErrors(
+		status.Internal,
+		status.NotFound,
+		status.PermissionDenied,
+	)
+	webService.With(
+		authService.MasterAuthMiddleware,
+		authService.RequireAuthMiddleware,
+	).Method(http.MethodDelete, "/nodes/{name}", nethttp.NewHandler(nodeDeleteInteractor))
+
+	leaveInteractor := usecase.NewInteractor(svc.LeavePost)
+	leaveInteractor.SetTitle("Leave")
+	leaveInteractor.SetDescription("Deregisters the node the certificate belongs to and releases its addresses.")
+	leaveInteractor.SetExpectedErrors(
+		status.Internal,
+		status.NotFound,
+		status.PermissionDenied,
+	)
+	webService.Method(http.MethodPost, "/leave", nethttp.NewHandler(leaveInteractor))
+
+	nodeLeaseInteractor := usecase.NewInteractor(svc.NodeLeasePost)
+	nodeLeaseInteractor.SetTitle("Node Lease")
+	nodeLeaseInteractor.SetDescription(
+		"Extends or removes the lease of an active node. " +
+			"Nodes are revoked and their addresses released once their lease ends.",
+	)
+	nodeLeaseInteractor.SetExpectedErrors(
+		status.Internal,
+		status.InvalidArgument,
+		status.NotFound,
+		status.PermissionDenied,
+	)
+	webService.With(
+		authService.MasterAuthMiddleware,
+		authService.RequireAuthMiddleware,
+	).Method(http.MethodPost, "/nodes/{name}/lease", nethttp.NewHandler(nodeLeaseInteractor))
+
+	ipamInteractor := usecase.NewInteractor(svc.IPAMGet)
+	ipamInteractor.SetTitle("IPAM Usage")
+	ipamInteractor.SetDescription(
+		"Shows the overlay network, the server addresses, the pools and " +
+			"the total, used and free address counts and free ranges of every network.",
+	)
+	ipamInteractor.SetExpectedErrors(
+		status.Internal,
+		status.PermissionDenied,
+	)
+	webService.With(
+		authService.MasterAuthMiddleware,
+		authService.RequireAuthMiddleware,
+	).Method(http.MethodGet, "/ipam", nethttp.NewHandler(ipamInteractor))
+
+	ipamAllocationsInteractor := usecase.NewInteractor(svc.IPAMAllocationsGet)
+	ipamAllocationsInteractor.SetTitle("IPAM Allocations")
+	ipamAllocationsInteractor.SetDescription("Lists every address leased to an active node.")
+	ipamAllocationsInteractor.SetExpectedErrors(
+		status.Internal,
+		status.PermissionDenied,
+	)
+	webService.With(
+		authService.MasterAuthMiddleware,
+		authService.RequireAuthMiddleware,
+	).Method(http.MethodGet, "/ipam/allocations", nethttp.NewHandler(ipamAllocationsInteractor))
+
+	poolsInteractor := usecase.NewInteractor(svc.PoolsGet)
+	poolsInteractor.SetTitle("Address Pools")
+	poolsInteractor.SetDescription("Lists the address pools carved out of the overlay network.")
+	poolsInteractor.SetExpectedErrors(
+		status.Internal,
+		status.PermissionDenied,
+	)
+	webService.With(
+		authService.MasterAuthMiddleware,
+		authService.RequireAuthMiddleware,
+	).Method(http.MethodGet, "/pools", nethttp.NewHandler(poolsInteractor))
+
+	poolsCreateInteractor := usecase.NewInteractor(svc.PoolsPost)
+	poolsCreateInteractor.SetTitle("Address Pool Creation")
+	poolsCreateInteractor.SetDescription(
+		"Carves a tenant address pool out of the overlay network. " +
+			"Nodes enrolled with a one time token issued for the pool get their address from it " +
+			"and only accept traffic from the server and the other nodes of the pool.",
+	)
+	poolsCreateInteractor.SetExpectedErrors(
+		status.AlreadyExists,
+		status.InvalidArgument,
+		status.PermissionDenied,
+	)
+	webService.With(
+		authService.MasterAuthMiddleware,
+		authService.RequireAuthMiddleware,
+	).Method(http.MethodPost, "/pools", nethttp.NewHandler(poolsCreateInteractor))
+
+	reservationsInteractor := usecase.NewInteractor(svc.ReservationsGet)
+	reservationsInteractor.SetTitle("Address Reservations")
+	reservationsInteractor.SetDescription("Lists the addresses pinned to node names and hardware IDs.")
+	reservationsInteractor.SetExpectedErrors(
+		status.Internal,
+		status.PermissionDenied,
+	)
+	webService.With(
+		authService.MasterAuthMiddleware,
+		authService.RequireAuthMiddleware,
+	).Method(http.MethodGet, "/reservations", nethttp.NewHandler(reservationsInteractor))
+
+	reservationsCreateInteractor := usecase.NewInteractor(svc.ReservationsPost)
+	reservationsCreateInteractor.SetTitle("Address Reservation")
+	reservationsCreateInteractor.SetDescription(
+		"Pins addresses to a node name or hardware ID. " +
+			"A node enrolling with that identity gets the pinned addresses.",
+	)
+	reservationsCreateInteractor.SetExpectedErrors(
+		status.Internal,
+		status.AlreadyExists,
+		status.FailedPrecondition,
+		status.InvalidArgument,
+		status.PermissionDenied,
+	)
+	webService.With(
+		authService.MasterAuthMiddleware,
+		authService.RequireAuthMiddleware,
+	).Method(http.MethodPost, "/reservations", nethttp.NewHandler(reservationsCreateInteractor))
+
+	reservationsDeleteInteractor := usecase.NewInteractor(svc.ReservationsDelete)
+	reservationsDeleteInteractor.SetTitle("Address Reservation Removal")
+	reservationsDeleteInteractor.SetDescription("Drops the addresses pinned to a node name and hardware ID.")
+	reservationsDeleteInteractor.SetExpectedErrors(
+		status.Internal,
+		status.NotFound,
+		status.PermissionDenied,
+	)
+	webService.With(
+		authService.MasterAuthMiddleware,
+		authService.RequireAuthMiddleware,
+	).Method(http.MethodDelete, "/reservations", nethttp.NewHandler(reservationsDeleteInteractor))
+
+	// not an interactor, swaggest can't describe streaming responses
+	webService.With(
+		authService.MasterAuthMiddleware,
+		authService.RequireAuthMiddleware,
+	).Method(http.MethodGet, "/events", http.HandlerFunc(svc.EventsStream))
+
+	webService.Method(http.MethodGet, "/healthz", http.HandlerFunc(healthChecker.Liveness))
+	webService.Method(http.MethodGet, "/readyz", http.HandlerFunc(healthChecker.Readiness))
+
 	webService.Docs("/docs", swgui.New)
 
 	return webService
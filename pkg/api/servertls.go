@@ -0,0 +1,198 @@
+package api
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertReloader serves the API certificate from a cert and key file pair,
+// picking up replaced files without a restart
+type CertReloader struct {
+	// Renew, if set, runs before every reload of Watch and may rewrite the
+	// files, e.g. to renew a self-signed certificate
+	Renew func() error
+
+	certPath string
+	keyPath  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+func NewCertReloader(certPath, keyPath string) (*CertReloader, error) {
+	r := &CertReloader{certPath: certPath, keyPath: keyPath}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+func (r *CertReloader) Leaf() *x509.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert.Leaf
+}
+
+// Reload loads the files if they changed since the last load, an invalid
+// pair keeps the previous certificate in use
+func (r *CertReloader) Reload() (bool, error) {
+	certInfo, err := os.Stat(r.certPath)
+	if err != nil {
+		return false, err
+	}
+	keyInfo, err := os.Stat(r.keyPath)
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.RLock()
+	unchanged := r.cert != nil && certInfo.ModTime().Equal(r.certMod) && keyInfo.ModTime().Equal(r.keyMod)
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return false, fmt.Errorf("load API certificate: %w", err)
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.certMod = certInfo.ModTime()
+	r.keyMod = keyInfo.ModTime()
+	r.mu.Unlock()
+	return true, nil
+}
+
+// Watch reloads the certificate every interval until stop is closed
+func (r *CertReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if r.Renew != nil {
+			if err := r.Renew(); err != nil {
+				log.Printf("[WARN] renewing API certificate: %v", err)
+			}
+		}
+		reloaded, err := r.Reload()
+		if err != nil {
+			log.Printf("[WARN] reloading API certificate, keeping the previous one: %v", err)
+			continue
+		}
+		if reloaded {
+			log.Printf("[INFO] reloaded API certificate %s", CertFingerprint(r.Leaf()))
+		}
+	}
+}
+
+// CertFingerprint is the SHA-256 hash of the DER encoded certificate, as
+// shown by browsers and openssl x509 -fingerprint -sha256
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// EnsureSelfSigned writes a self-signed certificate for hosts to certPath
+// unless a valid one for more than minValidity is there. The key in
+// keyPath is kept if present, so are the SPKI pins of clients.
+func EnsureSelfSigned(certPath, keyPath string, hosts []string, validity, minValidity time.Duration) error {
+	if cert, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil && time.Until(cert.Leaf.NotAfter) > minValidity {
+		return nil
+	}
+
+	var key crypto.Signer
+	keyPEM, err := os.ReadFile(keyPath)
+	switch {
+	case err == nil:
+		block, _ := pem.Decode(keyPEM)
+		if block == nil {
+			return fmt.Errorf("no PEM data in %s", keyPath)
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("parse %s: %w", keyPath, err)
+		}
+		var ok bool
+		if key, ok = parsed.(crypto.Signer); !ok {
+			return fmt.Errorf("unsupported key type in %s", keyPath)
+		}
+	case errors.Is(err, os.ErrNotExist):
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return err
+		}
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+			return fmt.Errorf("save API key to %s: %w", keyPath, err)
+		}
+	default:
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "tunnel API"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return fmt.Errorf("create self-signed API certificate: %w", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return fmt.Errorf("save API certificate to %s: %w", certPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+	"tunnel/pkg/cert"
+	"tunnel/pkg/events"
+
+	nebulaCert "github.com/slackhq/nebula/cert"
+	"github.com/swaggest/usecase/status"
+)
+
+// ServicePort is a port a node forwards to a service on its side of the
+// tunnel
+type ServicePort struct {
+	Port     int    `json:"port" minimum:"1" maximum:"65535"`
+	Protocol string `json:"protocol" enum:"tcp,udp"`
+}
+
+// Service is an entry of the service catalog, a port reachable at the
+// overlay addresses of a node
+type Service struct {
+	Node      string    `json:"node"`
+	IPs       []string  `json:"ips"`
+	Port      int       `json:"port"`
+	Protocol  string    `json:"protocol"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SetServices replaces the services of a node, telling whether they changed
+func (s NodeService) SetServices(name string, ports []ServicePort) (bool, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`DELETE FROM node_services WHERE node_name = $1 RETURNING port, protocol`, name)
+	if err != nil {
+		return false, err
+	}
+	previous := []ServicePort{}
+	for rows.Next() {
+		var p ServicePort
+		if err := rows.Scan(&p.Port, &p.Protocol); err != nil {
+			rows.Close()
+			return false, err
+		}
+		previous = append(previous, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	changed := len(previous) != len(ports)
+	for _, p := range ports {
+		if _, err := tx.Exec(`INSERT INTO node_services (node_name, port, protocol)
+				VALUES ($1, $2, $3)
+				ON CONFLICT DO NOTHING`,
+			name, p.Port, p.Protocol); err != nil {
+			return false, err
+		}
+		if !slices.Contains(previous, p) {
+			changed = true
+		}
+	}
+	return changed, tx.Commit()
+}
+
+// ListServices returns the services of the active nodes
+func (s NodeService) ListServices() ([]Service, error) {
+	rows, err := s.DB.Query(`SELECT
+				s.node_name, n.ip, s.port, s.protocol, s.updated_at
+			FROM node_services s
+			JOIN nodes n ON n.name = s.node_name
+			WHERE n.revoked_at IS NULL
+			ORDER BY s.node_name, s.port, s.protocol`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	services := []Service{}
+	for rows.Next() {
+		var svc Service
+		var ips string
+		if err := rows.Scan(&svc.Node, &ips, &svc.Port, &svc.Protocol, &svc.UpdatedAt); err != nil {
+			return nil, err
+		}
+		svc.IPs = splitList(ips)
+		services = append(services, svc)
+	}
+	return services, rows.Err()
+}
+
+type ServicesGetOutput struct {
+	Services []Service `json:"services"`
+}
+
+func (s APIService) ServicesGet(ctx context.Context, input struct{}, output *ServicesGetOutput) error {
+	services, err := s.NodeService.ListServices()
+	if err != nil {
+		return status.Wrap(fmt.Errorf("list services: %w", err), status.Internal)
+	}
+
+	output.Services = services
+	return nil
+}
+
+type ServicesPutInput struct {
+	Cert     string        `json:"cert" required:"true" description:"current certificate of the node"`
+	Nonce    string        `json:"nonce" required:"true" description:"nonce of a challenge issued for the certificate"`
+	Proof    []byte        `json:"proof" required:"true" description:"HMAC-SHA256 of the nonce keyed with the secret shared with the challenge key"`
+	Services []ServicePort `json:"services" required:"true"`
+}
+
+func (s APIService) ServicesPut(ctx context.Context, input ServicesPutInput, output *struct{}) error {
+	node, err := s.provenNode(input.Cert, input.Nonce, input.Proof)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range input.Services {
+		if p.Port < 1 || p.Port > 65535 || (p.Protocol != "tcp" && p.Protocol != "udp") {
+			return status.Wrap(fmt.Errorf("invalid service %d/%s", p.Port, p.Protocol), status.InvalidArgument)
+		}
+	}
+
+	changed, err := s.NodeService.SetServices(node.Name, input.Services)
+	if err != nil {
+		return status.Wrap(fmt.Errorf("set services: %w", err), status.Internal)
+	}
+	if changed {
+		s.publish(events.TypeNodeServicesChanged, node.Name, map[string]any{
+			"services": input.Services,
+		})
+	}
+	return nil
+}
+
+// certNode returns the active node certPEM is the latest certificate of
+func (s APIService) certNode(certPEM string) (*Node, nebulaCert.Certificate, error) {
+	nodeCert, err := cert.VerifyWithBundle(s.Authority.Bundle(), certPEM)
+	if err != nil {
+		return nil, nil, status.Wrap(err, status.PermissionDenied)
+	}
+
+	node, err := s.NodeService.Get(nodeCert.Name())
+	if err != nil {
+		if errors.Is(err, ErrNodeNotFound) {
+			return nil, nil, status.Wrap(err, status.PermissionDenied)
+		}
+		return nil, nil, status.Wrap(fmt.Errorf("get node: %w", err), status.Internal)
+	}
+	if node.RevokedAt != nil {
+		return nil, nil, status.Wrap(ErrNodeNotFound, status.PermissionDenied)
+	}
+
+	fp, err := nodeCert.Fingerprint()
+	if err != nil {
+		return nil, nil, status.Wrap(fmt.Errorf("cert fingerprint: %w", err), status.InvalidArgument)
+	}
+	if fp != node.CertFingerprint {
+		return nil, nil, status.Wrap(fmt.Errorf("certificate was superseded"), status.PermissionDenied)
+	}
+	if slices.Contains(s.Settings.Get().Blocklist, fp) {
+		return nil, nil, status.Wrap(fmt.Errorf("certificate is blocklisted"), status.PermissionDenied)
+	}
+	return node, nodeCert, nil
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SettingsValues is the configuration which can change while the server is
+// running
+type SettingsValues struct {
+	AllowedOrigins          []string
+	UnsafeNetworksAllowlist []netip.Prefix
+	// cert fingerprints blocked on top of the ones of revoked nodes
+	Blocklist []string
+	// how long previous CAs without tracked active nodes are kept after a
+	// rotation
+	CARetireGrace time.Duration
+}
+
+type Settings struct {
+	mu     sync.RWMutex
+	values SettingsValues
+}
+
+func NewSettings(values SettingsValues) *Settings {
+	return &Settings{values: values}
+}
+
+func (s *Settings) Get() SettingsValues {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.values
+}
+
+// Set replaces the settings, returning the previous ones
+func (s *Settings) Set(values SettingsValues) SettingsValues {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous := s.values
+	s.values = values
+	return previous
+}
+
+// AllowOrigin matches origin like cors.Options.AllowedOrigins would: an
+// empty list allows any origin and entries may contain one "*" wildcard
+func (s *Settings) AllowOrigin(r *http.Request, origin string) bool {
+	allowedOrigins := s.Get().AllowedOrigins
+	if len(allowedOrigins) == 0 {
+		return true
+	}
+
+	origin = strings.ToLower(origin)
+	for _, allowed := range allowedOrigins {
+		allowed = strings.ToLower(allowed)
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		if prefix, suffix, ok := strings.Cut(allowed, "*"); ok &&
+			len(origin) >= len(prefix)+len(suffix) &&
+			strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+			return true
+		}
+	}
+	return false
+}
@@ -22,11 +22,25 @@ func InitTables(db *sql.DB) error {
 			created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
 			expires_at TIMESTAMP WITH TIME ZONE NOT NULL
 		);
+		ALTER TABLE one_time_tokens ADD COLUMN IF NOT EXISTS pool TEXT NOT NULL DEFAULT '';
+		ALTER TABLE one_time_tokens ADD COLUMN IF NOT EXISTS lease_seconds BIGINT NOT NULL DEFAULT 0;
 	`)
-	return err
+	if err != nil {
+		return err
+	}
+
+	return initNodesTable(db)
+}
+
+// TokenScope is what a one time token grants the node enrolling with it
+type TokenScope struct {
+	// address pool, the default one if empty
+	Pool string
+	// lease of the node, unlimited if zero
+	Lease time.Duration
 }
 
-func (s AuthService) NewToken() (string, error) {
+func (s AuthService) NewToken(scope TokenScope) (string, error) {
 	newToken, err := generateToken()
 	if err != nil {
 		return "", err
@@ -35,9 +49,11 @@ func (s AuthService) NewToken() (string, error) {
 	expirationTime := time.Now().Add(DefaultExpirationTime)
 
 	_, err = s.DB.Exec(
-		`INSERT INTO one_time_tokens (token, expires_at) VALUES ($1, $2)`,
+		`INSERT INTO one_time_tokens (token, expires_at, pool, lease_seconds) VALUES ($1, $2, $3, $4)`,
 		newToken,
 		expirationTime,
+		scope.Pool,
+		int64(scope.Lease/time.Second),
 	)
 	if err != nil {
 		return "", err
@@ -46,29 +62,33 @@ func (s AuthService) NewToken() (string, error) {
 	return newToken, nil
 }
 
-func (s AuthService) ValidateAndBurnToken(token string) error {
+// ValidateAndBurnToken returns the scope the token was issued with
+func (s AuthService) ValidateAndBurnToken(token string) (TokenScope, error) {
 	tx, err := s.DB.Begin()
 	if err != nil {
-		return err
+		return TokenScope{}, err
 	}
 	defer tx.Rollback()
 
 	var expiresAt time.Time
+	var scope TokenScope
+	var leaseSeconds int64
 
-	row := tx.QueryRow(`SELECT expires_at
+	row := tx.QueryRow(`SELECT expires_at, pool, lease_seconds
 			FROM one_time_tokens
 			WHERE token = $1
 			FOR UPDATE`,
 		token,
 	)
 
-	err = row.Scan(&expiresAt)
+	err = row.Scan(&expiresAt, &scope.Pool, &leaseSeconds)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return ErrTokenNotFound
+			return TokenScope{}, ErrTokenNotFound
 		}
-		return err
+		return TokenScope{}, err
 	}
+	scope.Lease = time.Duration(leaseSeconds) * time.Second
 
 	if time.Now().After(expiresAt) {
 		_, _ = tx.Exec(`DELETE
@@ -76,7 +96,7 @@ func (s AuthService) ValidateAndBurnToken(token string) error {
 				WHERE token = $1
 			`, token)
 		tx.Commit()
-		return ErrTokenExpired
+		return TokenScope{}, ErrTokenExpired
 	}
 
 	res, err := tx.Exec(`DELETE
@@ -84,19 +104,19 @@ func (s AuthService) ValidateAndBurnToken(token string) error {
 			WHERE token = $1`,
 		token)
 	if err != nil {
-		return err
+		return TokenScope{}, err
 	}
 
 	rowsAffected, err := res.RowsAffected()
 	if err != nil {
-		return err
+		return TokenScope{}, err
 	}
 
 	if rowsAffected == 0 {
-		return ErrTokenNotFound
+		return TokenScope{}, ErrTokenNotFound
 	}
 
-	return tx.Commit()
+	return scope, tx.Commit()
 }
 
 func generateToken() (string, error) {
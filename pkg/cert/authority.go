@@ -0,0 +1,261 @@
+package cert
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	nebulaCert "github.com/slackhq/nebula/cert"
+)
+
+// Authority holds the active signing CA together with the trust bundle
+// distributed to nodes. The bundle keeps previous CA certificates around
+// until no active node relies on them anymore.
+type Authority struct {
+	CertPath   string
+	BundlePath string
+
+	mu      sync.RWMutex
+	certPEM string
+	signer  Signer
+	bundle  string
+}
+
+func LoadAuthority(certPath, bundlePath string, signer Signer) (*Authority, error) {
+	a := &Authority{
+		CertPath:   certPath,
+		BundlePath: bundlePath,
+
+		signer: signer,
+	}
+
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("read CA cert from %s: %w", certPath, err)
+	}
+	a.certPEM = string(certPEM)
+
+	caCert, _, err := nebulaCert.UnmarshalCertificateFromPEM(certPEM)
+	if err != nil {
+		return nil, fmt.Errorf("parsing ca-crt: %w", err)
+	}
+	if ks, ok := signer.(*KeySigner); ok {
+		if err := ks.VerifyCA(caCert); err != nil {
+			return nil, fmt.Errorf("root certificate does not match private key: %w", err)
+		}
+	}
+
+	bundlePEM, err := os.ReadFile(bundlePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read CA bundle from %s: %w", bundlePath, err)
+	}
+	a.bundle = string(bundlePEM)
+
+	// bundle must always trust the active CA
+	activeFp, err := Fingerprint(a.certPEM)
+	if err != nil {
+		return nil, err
+	}
+	fps, err := BundleFingerprints(a.bundle)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(fps, activeFp) {
+		a.bundle = joinPEM(a.bundle, a.certPEM)
+		if err := os.WriteFile(bundlePath, []byte(a.bundle), 0644); err != nil {
+			return nil, fmt.Errorf("save CA bundle to %s: %w", bundlePath, err)
+		}
+	}
+
+	return a, nil
+}
+
+func (a *Authority) CA() (string, Signer) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.certPEM, a.signer
+}
+
+func (a *Authority) Bundle() string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.bundle
+}
+
+func (a *Authority) Fingerprint() (string, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return Fingerprint(a.certPEM)
+}
+
+// Rotate generates a new CA with the same curve (and name, if caName is
+// empty) as the active one, makes it the signing CA and appends it to the
+// bundle. The previous key is kept next to the new one with a .prev suffix.
+// Only file backed signers can be rotated.
+func (a *Authority) Rotate(caName string) (*CertificatePair, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ks, ok := a.signer.(*KeySigner)
+	if !ok || ks.path == "" {
+		return nil, fmt.Errorf("CA rotation requires a file backed CA key")
+	}
+
+	caCert, _, err := nebulaCert.UnmarshalCertificateFromPEM([]byte(a.certPEM))
+	if err != nil {
+		return nil, fmt.Errorf("parsing ca-crt: %w", err)
+	}
+	if caName == "" {
+		caName = caCert.Name()
+	}
+
+	caPair, err := GenerateCA(caName, caCert.Curve())
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := joinPEM(a.bundle, caPair.CertPEM)
+	if err := os.WriteFile(a.BundlePath, []byte(bundle), 0644); err != nil {
+		return nil, fmt.Errorf("save CA bundle to %s: %w", a.BundlePath, err)
+	}
+	signer, err := ks.replace(caPair.KeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(a.CertPath, []byte(caPair.CertPEM), 0644); err != nil {
+		return nil, fmt.Errorf("save CA cert to %s: %w", a.CertPath, err)
+	}
+
+	a.certPEM = caPair.CertPEM
+	a.signer = signer
+	a.bundle = bundle
+
+	return caPair, nil
+}
+
+// Retire drops the CA with the given fingerprint from the bundle.
+// The active CA can not be retired.
+func (a *Authority) Retire(fingerprint string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	activeFp, err := Fingerprint(a.certPEM)
+	if err != nil {
+		return err
+	}
+	if fingerprint == activeFp {
+		return fmt.Errorf("refusing to retire the active CA %s", fingerprint)
+	}
+
+	certs, err := ParseBundle(a.bundle)
+	if err != nil {
+		return err
+	}
+
+	var kept []string
+	found := false
+	for _, c := range certs {
+		fp, err := c.Fingerprint()
+		if err != nil {
+			return fmt.Errorf("CA fingerprint: %w", err)
+		}
+		if fp == fingerprint {
+			found = true
+			continue
+		}
+		certPEM, err := c.MarshalPEM()
+		if err != nil {
+			return fmt.Errorf("marshalling CA certificate to PEM: %w", err)
+		}
+		kept = append(kept, string(certPEM))
+	}
+	if !found {
+		return fmt.Errorf("CA %s is not in the bundle", fingerprint)
+	}
+
+	bundle := joinPEM(kept...)
+	if err := os.WriteFile(a.BundlePath, []byte(bundle), 0644); err != nil {
+		return fmt.Errorf("save CA bundle to %s: %w", a.BundlePath, err)
+	}
+	a.bundle = bundle
+
+	return nil
+}
+
+func Fingerprint(certPEM string) (string, error) {
+	c, _, err := nebulaCert.UnmarshalCertificateFromPEM([]byte(certPEM))
+	if err != nil {
+		return "", fmt.Errorf("parsing certificate: %w", err)
+	}
+	fp, err := c.Fingerprint()
+	if err != nil {
+		return "", fmt.Errorf("certificate fingerprint: %w", err)
+	}
+	return fp, nil
+}
+
+func ParseBundle(bundlePEM string) ([]nebulaCert.Certificate, error) {
+	var certs []nebulaCert.Certificate
+	rest := []byte(bundlePEM)
+	for len(strings.TrimSpace(string(rest))) > 0 {
+		c, r, err := nebulaCert.UnmarshalCertificateFromPEM(rest)
+		if err != nil {
+			return nil, fmt.Errorf("parsing CA bundle: %w", err)
+		}
+		certs = append(certs, c)
+		rest = r
+	}
+	return certs, nil
+}
+
+func BundleFingerprints(bundlePEM string) ([]string, error) {
+	certs, err := ParseBundle(bundlePEM)
+	if err != nil {
+		return nil, err
+	}
+	fps := make([]string, 0, len(certs))
+	for _, c := range certs {
+		fp, err := c.Fingerprint()
+		if err != nil {
+			return nil, fmt.Errorf("CA fingerprint: %w", err)
+		}
+		fps = append(fps, fp)
+	}
+	return fps, nil
+}
+
+// VerifyWithBundle checks that the certificate is signed by one of the CAs
+// in the bundle and is currently valid.
+func VerifyWithBundle(bundlePEM, certPEM string) (nebulaCert.Certificate, error) {
+	pool, err := nebulaCert.NewCAPoolFromPEM([]byte(bundlePEM))
+	if err != nil {
+		return nil, fmt.Errorf("parsing CA bundle: %w", err)
+	}
+
+	c, _, err := nebulaCert.UnmarshalCertificateFromPEM([]byte(certPEM))
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate: %w", err)
+	}
+
+	if _, err := pool.VerifyCertificate(time.Now(), c); err != nil {
+		return nil, fmt.Errorf("verifying certificate: %w", err)
+	}
+
+	return c, nil
+}
+
+func joinPEM(pems ...string) string {
+	var b strings.Builder
+	for _, p := range pems {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		b.WriteString(p)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
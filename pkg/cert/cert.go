@@ -19,8 +19,26 @@ type CertificatePair struct {
 	KeyPEM  string
 }
 
-func GenerateCA(caName string) (*CertificatePair, error) {
-	curve := nebulaCert.Curve_CURVE25519
+func ParseCurve(s string) (nebulaCert.Curve, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "25519", "x25519", "curve25519":
+		return nebulaCert.Curve_CURVE25519, nil
+	case "p256", "p-256":
+		return nebulaCert.Curve_P256, nil
+	default:
+		return 0, fmt.Errorf("invalid curve: %s", s)
+	}
+}
+
+func CACurve(caCertPEM string) (nebulaCert.Curve, error) {
+	caCert, _, err := nebulaCert.UnmarshalCertificateFromPEM([]byte(caCertPEM))
+	if err != nil {
+		return 0, fmt.Errorf("parsing ca-crt: %w", err)
+	}
+	return caCert.Curve(), nil
+}
+
+func GenerateCA(caName string, curve nebulaCert.Curve) (*CertificatePair, error) {
 	duration := time.Duration(time.Hour * 8760 * 10)
 
 	pub, rawPriv, err := newSignerKeypair(curve)
@@ -59,9 +77,7 @@ func GenerateCA(caName string) (*CertificatePair, error) {
 	}, nil
 }
 
-func GenerateKeyPair() (*CertificatePair, error) {
-	curve := nebulaCert.Curve_CURVE25519
-
+func GenerateKeyPair(curve nebulaCert.Curve) (*CertificatePair, error) {
 	pub, rawPriv, err := newEphemeralKeypair(curve)
 	if err != nil {
 		return nil, err
@@ -77,10 +93,11 @@ func GenerateKeyPair() (*CertificatePair, error) {
 
 func SignCert(
 	caCertPEM string,
-	caKeyPEM string,
+	signer Signer,
 	nodeName string,
 	nodeIP string,
 	groupsList string,
+	unsafeNetworksList string,
 	nodePubKeyPEM string,
 ) (*CertificatePair, error) {
 	caCert, _, err := nebulaCert.UnmarshalCertificateFromPEM([]byte(caCertPEM))
@@ -88,13 +105,9 @@ func SignCert(
 		return nil, fmt.Errorf("parsing ca-crt: %w", err)
 	}
 
-	caKey, _, curve, err := nebulaCert.UnmarshalSigningPrivateKeyFromPEM([]byte(caKeyPEM))
-	if err != nil {
-		return nil, fmt.Errorf("parsing ca-key: %w", err)
-	}
-
-	if err := caCert.VerifyPrivateKey(curve, caKey); err != nil {
-		return nil, fmt.Errorf("root certificate does not match private key: %w", err)
+	curve := signer.Curve()
+	if curve != caCert.Curve() {
+		return nil, fmt.Errorf("curve of signer does not match ca curve: got %v, want %v", curve, caCert.Curve())
 	}
 
 	if caCert.Expired(time.Now()) {
@@ -115,6 +128,11 @@ func SignCert(
 		return nil, err
 	}
 
+	unsafeNetworks, err := parseCIDRs(unsafeNetworksList)
+	if err != nil {
+		return nil, err
+	}
+
 	groups := []string{}
 	if groupsList != "" {
 		for _, g := range strings.Split(groupsList, ",") {
@@ -131,7 +149,7 @@ func SignCert(
 		Name:           nodeName,
 		Networks:       networks,
 		Groups:         groups,
-		UnsafeNetworks: nil,
+		UnsafeNetworks: unsafeNetworks,
 		NotBefore:      notBefore,
 		NotAfter:       notAfter,
 		PublicKey:      pub,
@@ -139,10 +157,13 @@ func SignCert(
 		Curve:          curve,
 	}
 
-	signedCert, err := tbs.Sign(caCert, curve, caKey)
+	signedCert, err := tbs.SignWith(caCert, curve, signer.Sign)
 	if err != nil {
 		return nil, fmt.Errorf("signing certificate: %w", err)
 	}
+	if !signedCert.CheckSignature(caCert.PublicKey()) {
+		return nil, fmt.Errorf("root certificate does not match signer")
+	}
 
 	certPEM, err := signedCert.MarshalPEM()
 	if err != nil {
@@ -155,6 +176,32 @@ func SignCert(
 	}, nil
 }
 
+func ResignCert(caCertPEM string, signer Signer, certPEM string) (*CertificatePair, error) {
+	c, _, err := nebulaCert.UnmarshalCertificateFromPEM([]byte(certPEM))
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate: %w", err)
+	}
+
+	networks := make([]string, 0, len(c.Networks()))
+	for _, n := range c.Networks() {
+		networks = append(networks, n.String())
+	}
+	unsafeNetworks := make([]string, 0, len(c.UnsafeNetworks()))
+	for _, n := range c.UnsafeNetworks() {
+		unsafeNetworks = append(unsafeNetworks, n.String())
+	}
+
+	return SignCert(
+		caCertPEM,
+		signer,
+		c.Name(),
+		strings.Join(networks, ","),
+		strings.Join(c.Groups(), ","),
+		strings.Join(unsafeNetworks, ","),
+		string(nebulaCert.MarshalPublicKeyToPEM(c.Curve(), c.PublicKey())),
+	)
+}
+
 func newSignerKeypair(curve nebulaCert.Curve) ([]byte, []byte, error) {
 	switch curve {
 	case nebulaCert.Curve_CURVE25519:
@@ -0,0 +1,139 @@
+package cert
+
+import (
+	"testing"
+
+	nebulaCert "github.com/slackhq/nebula/cert"
+)
+
+var curves = []struct {
+	name  string
+	curve nebulaCert.Curve
+}{
+	{"curve25519", nebulaCert.Curve_CURVE25519},
+	{"p256", nebulaCert.Curve_P256},
+}
+
+// newTestCA returns a CA pair and its signer
+func newTestCA(t *testing.T, name string, curve nebulaCert.Curve) (*CertificatePair, Signer) {
+	t.Helper()
+
+	ca, err := GenerateCA(name, curve)
+	if err != nil {
+		t.Fatalf("GenerateCA: %v", err)
+	}
+	signer, err := NewKeySigner([]byte(ca.KeyPEM), nil)
+	if err != nil {
+		t.Fatalf("NewKeySigner: %v", err)
+	}
+	if signer.Curve() != curve {
+		t.Fatalf("signer curve = %v, want %v", signer.Curve(), curve)
+	}
+	return ca, signer
+}
+
+// newTestNode returns the key pair of a node and its cert signed by the CA
+func newTestNode(t *testing.T, ca *CertificatePair, signer Signer, curve nebulaCert.Curve) (*CertificatePair, string) {
+	t.Helper()
+
+	keyPair, err := GenerateKeyPair(curve)
+	if err != nil {
+		t.Fatalf("GenerateKeyPair: %v", err)
+	}
+	signed, err := SignCert(ca.CertPEM, signer, "node-1", "10.0.0.2/24", "client,pool-a", "192.168.1.0/24", keyPair.CertPEM)
+	if err != nil {
+		t.Fatalf("SignCert: %v", err)
+	}
+	return keyPair, signed.CertPEM
+}
+
+func TestSignAndVerify(t *testing.T) {
+	for _, tc := range curves {
+		t.Run(tc.name, func(t *testing.T) {
+			ca, signer := newTestCA(t, "test-ca", tc.curve)
+			_, certPEM := newTestNode(t, ca, signer, tc.curve)
+
+			c, err := VerifyWithBundle(ca.CertPEM, certPEM)
+			if err != nil {
+				t.Fatalf("VerifyWithBundle: %v", err)
+			}
+			if c.Name() != "node-1" {
+				t.Errorf("name = %q, want node-1", c.Name())
+			}
+			if c.Curve() != tc.curve {
+				t.Errorf("curve = %v, want %v", c.Curve(), tc.curve)
+			}
+			if len(c.Networks()) != 1 || c.Networks()[0].String() != "10.0.0.2/24" {
+				t.Errorf("networks = %v, want [10.0.0.2/24]", c.Networks())
+			}
+			if len(c.UnsafeNetworks()) != 1 || c.UnsafeNetworks()[0].String() != "192.168.1.0/24" {
+				t.Errorf("unsafe networks = %v, want [192.168.1.0/24]", c.UnsafeNetworks())
+			}
+			if got := c.Groups(); len(got) != 2 || got[0] != "client" || got[1] != "pool-a" {
+				t.Errorf("groups = %v, want [client pool-a]", got)
+			}
+			if c.IsCA() {
+				t.Error("node cert is a CA")
+			}
+		})
+	}
+}
+
+func TestVerifyWithBundleRejectsOtherCA(t *testing.T) {
+	for _, tc := range curves {
+		t.Run(tc.name, func(t *testing.T) {
+			ca, signer := newTestCA(t, "test-ca", tc.curve)
+			other, _ := newTestCA(t, "other-ca", tc.curve)
+			_, certPEM := newTestNode(t, ca, signer, tc.curve)
+
+			if _, err := VerifyWithBundle(other.CertPEM, certPEM); err == nil {
+				t.Fatal("VerifyWithBundle accepted a cert of a CA outside the bundle")
+			}
+			if _, err := VerifyWithBundle(joinPEM(other.CertPEM, ca.CertPEM), certPEM); err != nil {
+				t.Fatalf("VerifyWithBundle with both CAs: %v", err)
+			}
+		})
+	}
+}
+
+func TestSignCertRejectsCurveMismatch(t *testing.T) {
+	ca, signer := newTestCA(t, "test-ca", nebulaCert.Curve_CURVE25519)
+	keyPair, err := GenerateKeyPair(nebulaCert.Curve_P256)
+	if err != nil {
+		t.Fatalf("GenerateKeyPair: %v", err)
+	}
+
+	if _, err := SignCert(ca.CertPEM, signer, "node-1", "10.0.0.2/24", "", "", keyPair.CertPEM); err == nil {
+		t.Fatal("SignCert accepted a P256 key under a Curve25519 CA")
+	}
+}
+
+func TestResignCertUnderRotatedCA(t *testing.T) {
+	for _, tc := range curves {
+		t.Run(tc.name, func(t *testing.T) {
+			ca, signer := newTestCA(t, "test-ca", tc.curve)
+			_, certPEM := newTestNode(t, ca, signer, tc.curve)
+			rotated, rotatedSigner := newTestCA(t, "test-ca", tc.curve)
+
+			resigned, err := ResignCert(rotated.CertPEM, rotatedSigner, certPEM)
+			if err != nil {
+				t.Fatalf("ResignCert: %v", err)
+			}
+			c, err := VerifyWithBundle(rotated.CertPEM, resigned.CertPEM)
+			if err != nil {
+				t.Fatalf("VerifyWithBundle: %v", err)
+			}
+
+			old, err := VerifyWithBundle(ca.CertPEM, certPEM)
+			if err != nil {
+				t.Fatalf("VerifyWithBundle of the old cert: %v", err)
+			}
+			if string(c.PublicKey()) != string(old.PublicKey()) {
+				t.Error("resigned cert has a different public key")
+			}
+			if c.Name() != old.Name() {
+				t.Errorf("name = %q, want %q", c.Name(), old.Name())
+			}
+		})
+	}
+}
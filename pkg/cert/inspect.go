@@ -0,0 +1,66 @@
+package cert
+
+import (
+	"fmt"
+	"time"
+
+	nebulaCert "github.com/slackhq/nebula/cert"
+)
+
+type Info struct {
+	Fingerprint    string    `json:"fingerprint"`
+	Version        int       `json:"version"`
+	Name           string    `json:"name"`
+	Networks       []string  `json:"networks"`
+	UnsafeNetworks []string  `json:"unsafe_networks"`
+	Groups         []string  `json:"groups"`
+	IsCA           bool      `json:"is_ca"`
+	NotBefore      time.Time `json:"not_before"`
+	NotAfter       time.Time `json:"not_after"`
+	Expired        bool      `json:"expired"`
+	Issuer         string    `json:"issuer"`
+	Curve          string    `json:"curve"`
+	PublicKey      []byte    `json:"public_key"`
+}
+
+func Inspect(certPEM string) (*Info, error) {
+	c, _, err := nebulaCert.UnmarshalCertificateFromPEM([]byte(certPEM))
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate: %w", err)
+	}
+	return InfoOf(c)
+}
+
+func InfoOf(c nebulaCert.Certificate) (*Info, error) {
+	fp, err := c.Fingerprint()
+	if err != nil {
+		return nil, fmt.Errorf("certificate fingerprint: %w", err)
+	}
+
+	info := &Info{
+		Fingerprint:    fp,
+		Version:        int(c.Version()),
+		Name:           c.Name(),
+		Networks:       []string{},
+		UnsafeNetworks: []string{},
+		Groups:         c.Groups(),
+		IsCA:           c.IsCA(),
+		NotBefore:      c.NotBefore(),
+		NotAfter:       c.NotAfter(),
+		Expired:        c.Expired(time.Now()),
+		Issuer:         c.Issuer(),
+		Curve:          c.Curve().String(),
+		PublicKey:      c.PublicKey(),
+	}
+	for _, n := range c.Networks() {
+		info.Networks = append(info.Networks, n.String())
+	}
+	for _, n := range c.UnsafeNetworks() {
+		info.UnsafeNetworks = append(info.UnsafeNetworks, n.String())
+	}
+	if info.Groups == nil {
+		info.Groups = []string{}
+	}
+
+	return info, nil
+}
@@ -0,0 +1,34 @@
+package cert
+
+import (
+	"fmt"
+
+	nebulaCert "github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/pkclient"
+)
+
+// PKCS11Signer signs with a P256 key kept on a PKCS#11 token.
+// Requires a build with cgo and the pkcs11 build tag.
+type PKCS11Signer struct {
+	client *pkclient.PKClient
+}
+
+func NewPKCS11Signer(uri string) (*PKCS11Signer, error) {
+	client, err := pkclient.FromUrl(uri)
+	if err != nil {
+		return nil, fmt.Errorf("creating PKCS#11 client: %w", err)
+	}
+	return &PKCS11Signer{client: client}, nil
+}
+
+func (s *PKCS11Signer) Curve() nebulaCert.Curve {
+	return nebulaCert.Curve_P256
+}
+
+func (s *PKCS11Signer) Sign(data []byte) ([]byte, error) {
+	return s.client.SignASN1(data)
+}
+
+func (s *PKCS11Signer) Close() error {
+	return s.client.Close()
+}
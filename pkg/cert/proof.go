@@ -0,0 +1,132 @@
+package cert
+
+import (
+	"crypto/ecdh"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	nebulaCert "github.com/slackhq/nebula/cert"
+)
+
+var ErrInvalidProof = errors.New("invalid proof of key possession")
+
+// Node keys are DH keys and can't sign, so a node proves it holds the key of
+// its certificate by MACing a server-issued nonce with the secret it shares
+// with a challenge key the server generated for that nonce.
+
+// NewChallengeKey generates the ephemeral keypair of a possession challenge
+func NewChallengeKey(curve nebulaCert.Curve) (pub, priv []byte, err error) {
+	return newEphemeralKeypair(curve)
+}
+
+// ProveKeyPossession answers a challenge with the node's private key
+func ProveKeyPossession(keyPEM string, challengePub, nonce []byte) ([]byte, error) {
+	key, _, curve, err := nebulaCert.UnmarshalPrivateKeyFromPEM([]byte(keyPEM))
+	if err != nil {
+		return nil, fmt.Errorf("parsing private key PEM: %w", err)
+	}
+	shared, err := sharedSecret(curve, key, challengePub)
+	if err != nil {
+		return nil, err
+	}
+	return possessionMAC(shared, nonce), nil
+}
+
+// VerifyKeyPossession checks the answer to a challenge against the public
+// key of the node's certificate
+func VerifyKeyPossession(nodeCert nebulaCert.Certificate, challengeKey, nonce, proof []byte) error {
+	return verifyPossession(nodeCert.Curve(), nodeCert.PublicKey(), challengeKey, nonce, proof)
+}
+
+// VerifyPublicKeyPossession checks the answer to a challenge against a
+// public key PEM
+func VerifyPublicKeyPossession(pubPEM string, challengeKey, nonce, proof []byte) error {
+	pub, _, curve, err := nebulaCert.UnmarshalPublicKeyFromPEM([]byte(pubPEM))
+	if err != nil {
+		return fmt.Errorf("parsing public key PEM: %w", err)
+	}
+	return verifyPossession(curve, pub, challengeKey, nonce, proof)
+}
+
+// PublicKeyPEM returns the public key PEM of a private key PEM
+func PublicKeyPEM(keyPEM string) (string, error) {
+	key, _, curve, err := nebulaCert.UnmarshalPrivateKeyFromPEM([]byte(keyPEM))
+	if err != nil {
+		return "", fmt.Errorf("parsing private key PEM: %w", err)
+	}
+	c, err := ecdhCurve(curve)
+	if err != nil {
+		return "", err
+	}
+	privKey, err := c.NewPrivateKey(key)
+	if err != nil {
+		return "", fmt.Errorf("parsing private key: %w", err)
+	}
+	return string(nebulaCert.MarshalPublicKeyToPEM(curve, privKey.PublicKey().Bytes())), nil
+}
+
+// KeyFingerprint is the hex SHA-256 of the key in a public key PEM
+func KeyFingerprint(pubPEM string) (string, error) {
+	pub, _, _, err := nebulaCert.UnmarshalPublicKeyFromPEM([]byte(pubPEM))
+	if err != nil {
+		return "", fmt.Errorf("parsing public key PEM: %w", err)
+	}
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func verifyPossession(curve nebulaCert.Curve, pub, challengeKey, nonce, proof []byte) error {
+	shared, err := sharedSecret(curve, challengeKey, pub)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(possessionMAC(shared, nonce), proof) {
+		return ErrInvalidProof
+	}
+	return nil
+}
+
+func possessionMAC(shared, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, shared)
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+func ecdhCurve(curve nebulaCert.Curve) (ecdh.Curve, error) {
+	switch curve {
+	case nebulaCert.Curve_CURVE25519:
+		return ecdh.X25519(), nil
+	case nebulaCert.Curve_P256:
+		return ecdh.P256(), nil
+	default:
+		return nil, fmt.Errorf("invalid curve: %v", curve)
+	}
+}
+
+func sharedSecret(curve nebulaCert.Curve, priv, pub []byte) ([]byte, error) {
+	c, err := ecdhCurve(curve)
+	if err != nil {
+		return nil, err
+	}
+	if curve == nebulaCert.Curve_P256 && len(pub) == 33 {
+		x, y := elliptic.UnmarshalCompressed(elliptic.P256(), pub)
+		if x == nil {
+			return nil, fmt.Errorf("invalid compressed P256 public key")
+		}
+		pub = elliptic.Marshal(elliptic.P256(), x, y)
+	}
+
+	privKey, err := c.NewPrivateKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("parsing private key: %w", err)
+	}
+	pubKey, err := c.NewPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("parsing public key: %w", err)
+	}
+	return privKey.ECDH(pubKey)
+}
@@ -0,0 +1,92 @@
+package cert
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestKeyPossession(t *testing.T) {
+	for _, tc := range curves {
+		t.Run(tc.name, func(t *testing.T) {
+			ca, signer := newTestCA(t, "test-ca", tc.curve)
+			keyPair, certPEM := newTestNode(t, ca, signer, tc.curve)
+			otherKey, err := GenerateKeyPair(tc.curve)
+			if err != nil {
+				t.Fatalf("GenerateKeyPair: %v", err)
+			}
+			nodeCert, err := VerifyWithBundle(ca.CertPEM, certPEM)
+			if err != nil {
+				t.Fatalf("VerifyWithBundle: %v", err)
+			}
+
+			challengePub, challengeKey, err := NewChallengeKey(tc.curve)
+			if err != nil {
+				t.Fatalf("NewChallengeKey: %v", err)
+			}
+			nonce := []byte("nonce")
+
+			proof, err := ProveKeyPossession(keyPair.KeyPEM, challengePub, nonce)
+			if err != nil {
+				t.Fatalf("ProveKeyPossession: %v", err)
+			}
+			if err := VerifyKeyPossession(nodeCert, challengeKey, nonce, proof); err != nil {
+				t.Fatalf("VerifyKeyPossession: %v", err)
+			}
+
+			if err := VerifyKeyPossession(nodeCert, challengeKey, []byte("other nonce"), proof); !errors.Is(err, ErrInvalidProof) {
+				t.Errorf("proof for another nonce: err = %v, want ErrInvalidProof", err)
+			}
+
+			forged, err := ProveKeyPossession(otherKey.KeyPEM, challengePub, nonce)
+			if err != nil {
+				t.Fatalf("ProveKeyPossession with another key: %v", err)
+			}
+			if err := VerifyKeyPossession(nodeCert, challengeKey, nonce, forged); !errors.Is(err, ErrInvalidProof) {
+				t.Errorf("proof with another key: err = %v, want ErrInvalidProof", err)
+			}
+		})
+	}
+}
+
+func TestPublicKeyPossession(t *testing.T) {
+	for _, tc := range curves {
+		t.Run(tc.name, func(t *testing.T) {
+			identity, err := GenerateKeyPair(tc.curve)
+			if err != nil {
+				t.Fatalf("GenerateKeyPair: %v", err)
+			}
+			pubPEM, err := PublicKeyPEM(identity.KeyPEM)
+			if err != nil {
+				t.Fatalf("PublicKeyPEM: %v", err)
+			}
+			if pubPEM != identity.CertPEM {
+				t.Fatalf("PublicKeyPEM = %q, want %q", pubPEM, identity.CertPEM)
+			}
+			fp, err := KeyFingerprint(pubPEM)
+			if err != nil || len(fp) != 64 {
+				t.Fatalf("KeyFingerprint = %q, %v", fp, err)
+			}
+
+			challengePub, challengeKey, err := NewChallengeKey(tc.curve)
+			if err != nil {
+				t.Fatalf("NewChallengeKey: %v", err)
+			}
+			nonce := []byte("nonce")
+			proof, err := ProveKeyPossession(identity.KeyPEM, challengePub, nonce)
+			if err != nil {
+				t.Fatalf("ProveKeyPossession: %v", err)
+			}
+			if err := VerifyPublicKeyPossession(pubPEM, challengeKey, nonce, proof); err != nil {
+				t.Fatalf("VerifyPublicKeyPossession: %v", err)
+			}
+
+			other, err := GenerateKeyPair(tc.curve)
+			if err != nil {
+				t.Fatalf("GenerateKeyPair: %v", err)
+			}
+			if err := VerifyPublicKeyPossession(other.CertPEM, challengeKey, nonce, proof); !errors.Is(err, ErrInvalidProof) {
+				t.Errorf("proof against another key: err = %v, want ErrInvalidProof", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package cert
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+
+	nebulaCert "github.com/slackhq/nebula/cert"
+	"golang.org/x/term"
+)
+
+// Signer signs certificates on behalf of a CA without exposing the CA
+// private key to the caller.
+type Signer interface {
+	Curve() nebulaCert.Curve
+	Sign(data []byte) ([]byte, error)
+}
+
+// KeySigner signs with a CA private key held in memory. Signers loaded from
+// a file remember the path and passphrase so a rotated key can be stored
+// the same way.
+type KeySigner struct {
+	curve nebulaCert.Curve
+	key   []byte
+
+	path       string
+	passphrase []byte
+}
+
+// LoadKeySigner reads the CA private key from path. A plaintext key is
+// encrypted in place when a passphrase is given.
+func LoadKeySigner(path string, passphrase []byte) (*KeySigner, error) {
+	keyPEM, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read CA key from %s: %w", path, err)
+	}
+
+	s, err := NewKeySigner(keyPEM, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	s.path = path
+	s.passphrase = passphrase
+
+	if len(passphrase) > 0 && !IsEncryptedKeyPEM(keyPEM) {
+		log.Printf("[INFO] encrypting plaintext CA key at %s", path)
+		if err := s.save(path); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// NewKeySigner parses a plain or passphrase encrypted CA private key PEM.
+func NewKeySigner(keyPEM []byte, passphrase []byte) (*KeySigner, error) {
+	if IsEncryptedKeyPEM(keyPEM) {
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("ca-key is encrypted, passphrase required")
+		}
+		curve, key, _, err := nebulaCert.DecryptAndUnmarshalSigningPrivateKey(passphrase, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("decrypting ca-key: %w", err)
+		}
+		return &KeySigner{curve: curve, key: key}, nil
+	}
+
+	key, _, curve, err := nebulaCert.UnmarshalSigningPrivateKeyFromPEM(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("parsing ca-key: %w", err)
+	}
+	return &KeySigner{curve: curve, key: key}, nil
+}
+
+func (s *KeySigner) Curve() nebulaCert.Curve {
+	return s.curve
+}
+
+func (s *KeySigner) Sign(data []byte) ([]byte, error) {
+	switch s.curve {
+	case nebulaCert.Curve_CURVE25519:
+		return ed25519.Sign(ed25519.PrivateKey(s.key), data), nil
+	case nebulaCert.Curve_P256:
+		pk := &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+			},
+			D: new(big.Int).SetBytes(s.key),
+		}
+		pk.X, pk.Y = pk.Curve.ScalarBaseMult(s.key)
+		hashed := sha256.Sum256(data)
+		return ecdsa.SignASN1(rand.Reader, pk, hashed[:])
+	default:
+		return nil, fmt.Errorf("invalid curve: %v", s.curve)
+	}
+}
+
+func (s *KeySigner) VerifyCA(caCert nebulaCert.Certificate) error {
+	return caCert.VerifyPrivateKey(s.curve, s.key)
+}
+
+// MarshalPEM returns the key as PEM, encrypted if a passphrase is given.
+func (s *KeySigner) MarshalPEM(passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nebulaCert.MarshalSigningPrivateKeyToPEM(s.curve, s.key), nil
+	}
+
+	keyPEM, err := nebulaCert.EncryptAndMarshalSigningPrivateKey(s.curve, s.key, passphrase, newArgon2Parameters())
+	if err != nil {
+		return nil, fmt.Errorf("encrypting ca-key: %w", err)
+	}
+	return keyPEM, nil
+}
+
+// replace stores keyPEM at the signer path, keeping the current key with
+// a .prev suffix, and returns a signer for the new key.
+func (s *KeySigner) replace(keyPEM string) (*KeySigner, error) {
+	if s.path == "" {
+		return nil, fmt.Errorf("signer is not backed by a key file")
+	}
+
+	next, err := NewKeySigner([]byte(keyPEM), nil)
+	if err != nil {
+		return nil, err
+	}
+	next.path = s.path
+	next.passphrase = s.passphrase
+
+	if err := s.save(s.path + ".prev"); err != nil {
+		return nil, err
+	}
+	if err := next.save(next.path); err != nil {
+		return nil, err
+	}
+
+	return next, nil
+}
+
+func (s *KeySigner) save(path string) error {
+	keyPEM, err := s.MarshalPEM(s.passphrase)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, keyPEM, 0600); err != nil {
+		return fmt.Errorf("save CA key to %s: %w", path, err)
+	}
+	return nil
+}
+
+func IsEncryptedKeyPEM(keyPEM []byte) bool {
+	k, _ := pem.Decode(keyPEM)
+	if k == nil {
+		return false
+	}
+	return k.Type == nebulaCert.EncryptedEd25519PrivateKeyBanner ||
+		k.Type == nebulaCert.EncryptedECDSAP256PrivateKeyBanner
+}
+
+func EncryptKeyPEM(keyPEM []byte, passphrase []byte) ([]byte, error) {
+	signer, err := NewKeySigner(keyPEM, nil)
+	if err != nil {
+		return nil, err
+	}
+	return signer.MarshalPEM(passphrase)
+}
+
+// ResolvePassphrase returns the passphrase given directly or read from
+// passphraseFile, falling back to an interactive prompt if the key is
+// encrypted and stdin is a terminal.
+func ResolvePassphrase(passphrase, passphraseFile string, encrypted bool) ([]byte, error) {
+	if passphrase != "" {
+		return []byte(passphrase), nil
+	}
+
+	if passphraseFile != "" {
+		b, err := os.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("read passphrase from %s: %w", passphraseFile, err)
+		}
+		return bytes.TrimRight(b, "\r\n"), nil
+	}
+
+	if encrypted && term.IsTerminal(int(os.Stdin.Fd())) {
+		return promptPassphrase("CA key passphrase: ")
+	}
+
+	return nil, nil
+}
+
+var ErrPassphraseRequired = errors.New("a passphrase is required to encrypt the CA key")
+
+// NewPassphrase returns the passphrase to encrypt a new CA key with, given
+// directly or read from passphraseFile, else prompting twice if stdin is a
+// terminal
+func NewPassphrase(passphrase, passphraseFile string) ([]byte, error) {
+	pass, err := ResolvePassphrase(passphrase, passphraseFile, false)
+	if err != nil || len(pass) > 0 {
+		return pass, err
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, ErrPassphraseRequired
+	}
+
+	pass, err = promptPassphrase("New CA key passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if len(pass) == 0 {
+		return nil, ErrPassphraseRequired
+	}
+	confirmed, err := promptPassphrase("Repeat the passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(pass, confirmed) {
+		return nil, errors.New("passphrases don't match")
+	}
+	return pass, nil
+}
+
+func promptPassphrase(prompt string) ([]byte, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	b, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("read passphrase: %w", err)
+	}
+	return b, nil
+}
+
+// argon2 parameters for the CA key encryption, lighter than nebula-cert
+// defaults since the key gets unlocked on every server start
+func newArgon2Parameters() *nebulaCert.Argon2Parameters {
+	return nebulaCert.NewArgon2Parameters(64*1024, 4, 3)
+}
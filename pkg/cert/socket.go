@@ -0,0 +1,133 @@
+package cert
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	nebulaCert "github.com/slackhq/nebula/cert"
+)
+
+const (
+	signerOpCurve = "curve"
+	signerOpSign  = "sign"
+
+	socketSignerTimeout = 10 * time.Second
+)
+
+type signerRequest struct {
+	Op   string `json:"op"`
+	Data []byte `json:"data,omitempty"`
+}
+
+type signerResponse struct {
+	Curve     nebulaCert.Curve `json:"curve"`
+	Signature []byte           `json:"signature,omitempty"`
+	Error     string           `json:"error,omitempty"`
+}
+
+// SocketSigner delegates signing to a signer process listening on a unix
+// socket, see ServeSigner.
+type SocketSigner struct {
+	path  string
+	curve nebulaCert.Curve
+}
+
+func NewSocketSigner(path string) (*SocketSigner, error) {
+	s := &SocketSigner{path: path}
+
+	resp, err := s.call(signerRequest{Op: signerOpCurve})
+	if err != nil {
+		return nil, err
+	}
+	s.curve = resp.Curve
+
+	return s, nil
+}
+
+func (s *SocketSigner) Curve() nebulaCert.Curve {
+	return s.curve
+}
+
+func (s *SocketSigner) Sign(data []byte) ([]byte, error) {
+	resp, err := s.call(signerRequest{Op: signerOpSign, Data: data})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Signature, nil
+}
+
+func (s *SocketSigner) call(req signerRequest) (*signerResponse, error) {
+	conn, err := net.DialTimeout("unix", s.path, socketSignerTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("dial signer at %s: %w", s.path, err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(socketSignerTimeout)); err != nil {
+		return nil, fmt.Errorf("set signer deadline: %w", err)
+	}
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("write signer request: %w", err)
+	}
+
+	var resp signerResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("read signer response: %w", err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("signer: %s", resp.Error)
+	}
+
+	return &resp, nil
+}
+
+// ServeSigner answers SocketSigner requests on l using signer until l is closed.
+func ServeSigner(l net.Listener, signer Signer) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+			if err := handleSignerConn(conn, signer); err != nil {
+				log.Printf("[WARN] signer connection: %v", err)
+			}
+		}()
+	}
+}
+
+func handleSignerConn(conn net.Conn, signer Signer) error {
+	if err := conn.SetDeadline(time.Now().Add(socketSignerTimeout)); err != nil {
+		return err
+	}
+
+	var req signerRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return fmt.Errorf("read request: %w", err)
+	}
+
+	resp := signerResponse{Curve: signer.Curve()}
+	switch req.Op {
+	case signerOpCurve:
+	case signerOpSign:
+		sig, err := signer.Sign(req.Data)
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		resp.Signature = sig
+	default:
+		resp.Error = fmt.Sprintf("unknown op: %s", req.Op)
+	}
+
+	return json.NewEncoder(conn).Encode(resp)
+}
@@ -0,0 +1,83 @@
+package cert
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// serveTestSigner serves signer on a unix socket in a temp dir until the
+// test ends and returns the socket path
+func serveTestSigner(t *testing.T, signer Signer) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "signer.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listen at %s: %v", path, err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- ServeSigner(l, signer)
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		if err := <-done; err != nil {
+			t.Errorf("ServeSigner: %v", err)
+		}
+	})
+	return path
+}
+
+func TestSocketSigner(t *testing.T) {
+	for _, tc := range curves {
+		t.Run(tc.name, func(t *testing.T) {
+			ca, keySigner := newTestCA(t, "test-ca", tc.curve)
+			path := serveTestSigner(t, keySigner)
+
+			socketSigner, err := NewSocketSigner(path)
+			if err != nil {
+				t.Fatalf("NewSocketSigner: %v", err)
+			}
+			if socketSigner.Curve() != tc.curve {
+				t.Fatalf("curve = %v, want %v", socketSigner.Curve(), tc.curve)
+			}
+
+			_, certPEM := newTestNode(t, ca, socketSigner, tc.curve)
+			c, err := VerifyWithBundle(ca.CertPEM, certPEM)
+			if err != nil {
+				t.Fatalf("VerifyWithBundle: %v", err)
+			}
+			if c.Name() != "node-1" {
+				t.Errorf("name = %q, want node-1", c.Name())
+			}
+		})
+	}
+}
+
+func TestSocketSignerOfOtherCA(t *testing.T) {
+	ca, _ := newTestCA(t, "test-ca", curves[0].curve)
+	_, otherSigner := newTestCA(t, "other-ca", curves[0].curve)
+	path := serveTestSigner(t, otherSigner)
+
+	socketSigner, err := NewSocketSigner(path)
+	if err != nil {
+		t.Fatalf("NewSocketSigner: %v", err)
+	}
+	keyPair, err := GenerateKeyPair(curves[0].curve)
+	if err != nil {
+		t.Fatalf("GenerateKeyPair: %v", err)
+	}
+	_, err = SignCert(ca.CertPEM, socketSigner, "node-1", "10.0.0.2/24", "", "", keyPair.CertPEM)
+	if err == nil || !strings.Contains(err.Error(), "does not match signer") {
+		t.Fatalf("SignCert with the key of another CA: err = %v, want signer mismatch", err)
+	}
+}
+
+func TestSocketSignerUnreachable(t *testing.T) {
+	if _, err := NewSocketSigner(filepath.Join(t.TempDir(), "missing.sock")); err == nil {
+		t.Fatal("NewSocketSigner succeeded without a signer listening")
+	}
+}
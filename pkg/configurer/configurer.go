@@ -5,6 +5,7 @@ import (
 	"log"
 	"net"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"tunnel/pkg/cert"
@@ -16,6 +17,11 @@ type NebulaNode struct {
 	Name   string
 	Groups string
 
+	// comma separated networks this node routes for (nebula unsafe networks)
+	UnsafeNetworks string
+	// comma separated groups allowed to reach this node, any host if empty
+	InboundGroups string
+
 	Punch bool
 
 	AmRelay   bool
@@ -42,48 +48,67 @@ func ApplyStaticHosts(c *config.C, hosts map[string][]string) error {
 	return nil
 }
 
+type PortMapping struct {
+	ListenPort  int
+	DialAddress string
+	Protocols   []string
+}
+
+func ParsePortMapping(portMapping string) (PortMapping, error) {
+	matches := mappingRegex.FindStringSubmatch(portMapping)
+	if len(matches) != 4 {
+		return PortMapping{}, fmt.Errorf("invalid port mapping format: '%s'. expected format: PORT:DIAL_ADDRESS:tcp/udp/both", portMapping)
+	}
+
+	portStr := matches[1]
+	host := strings.TrimSpace(matches[2])
+	protoStr := matches[3]
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return PortMapping{}, fmt.Errorf("invalid port number in mapping '%s': %w", portMapping, err)
+	}
+	// TODO: proper host check
+	if host == "" {
+		return PortMapping{}, fmt.Errorf("DIAL_ADDRESS cannot be empty in mapping '%s'", portMapping)
+	}
+
+	var protocols []string
+	switch protoStr {
+	case "tcp":
+		protocols = []string{"tcp"}
+	case "udp":
+		protocols = []string{"udp"}
+	case "both":
+		protocols = []string{"tcp", "udp"}
+	default:
+		return PortMapping{}, fmt.Errorf("invalid protocol '%s' in mapping '%s'. must be tcp, udp, or both", protoStr, portMapping)
+	}
+
+	return PortMapping{
+		ListenPort:  port,
+		DialAddress: host,
+		Protocols:   protocols,
+	}, nil
+}
+
 func ApplyPortMappings(c *config.C, portMappings []string) error {
 	portMappingSlice := []any{}
 
 	for _, portMapping := range portMappings {
-		matches := mappingRegex.FindStringSubmatch(portMapping)
-		if len(matches) != 4 {
-			return fmt.Errorf("invalid port mapping format: '%s'. expected format: PORT:DIAL_ADDRESS:tcp/udp/both", portMapping)
-		}
-
-		portStr := matches[1]
-		host := strings.TrimSpace(matches[2])
-		protoStr := matches[3]
-
-		port, err := strconv.Atoi(portStr)
+		m, err := ParsePortMapping(portMapping)
 		if err != nil {
-			return fmt.Errorf("invalid port number in mapping '%s': %w", portMapping, err)
-		}
-		// TODO: proper host check
-		if host == "" {
-			return fmt.Errorf("DIAL_ADDRESS cannot be empty in mapping '%s'", portMapping)
-		}
-
-		var protocols []string
-		switch protoStr {
-		case "tcp":
-			protocols = []string{"tcp"}
-		case "udp":
-			protocols = []string{"udp"}
-		case "both":
-			protocols = []string{"tcp", "udp"}
-		default:
-			return fmt.Errorf("invalid protocol '%s' in mapping '%s'. must be tcp, udp, or both", protoStr, portMapping)
+			return err
 		}
 
-		protocolsAny := make([]any, len(protocols))
-		for i, p := range protocols {
+		protocolsAny := make([]any, len(m.Protocols))
+		for i, p := range m.Protocols {
 			protocolsAny[i] = p
 		}
 
 		portMappingSlice = append(portMappingSlice, map[string]any{
-			"listen_port":  port,
-			"dial_address": host,
+			"listen_port":  m.ListenPort,
+			"dial_address": m.DialAddress,
 			"protocols":    protocolsAny,
 		})
 	}
@@ -95,6 +120,42 @@ func ApplyPortMappings(c *config.C, portMappings []string) error {
 	return nil
 }
 
+func ApplyTUN(c *config.C, devName string) error {
+	tun, ok := (*c).Settings["tun"].(map[string]any)
+	if !ok {
+		tun = map[string]any{}
+		(*c).Settings["tun"] = tun
+	}
+	tun["disabled"] = false
+	tun["dev"] = devName
+	return nil
+}
+
+func ApplyUnsafeRoutes(c *config.C, routes map[string]string) error {
+	tun, ok := (*c).Settings["tun"].(map[string]any)
+	if !ok {
+		tun = map[string]any{}
+		(*c).Settings["tun"] = tun
+	}
+
+	networks := make([]string, 0, len(routes))
+	for n := range routes {
+		networks = append(networks, n)
+	}
+	sort.Strings(networks)
+
+	unsafeRoutes := make([]any, 0, len(networks))
+	for _, n := range networks {
+		unsafeRoutes = append(unsafeRoutes, map[string]any{
+			"route": n,
+			"via":   routes[n],
+		})
+	}
+	tun["unsafe_routes"] = unsafeRoutes
+
+	return nil
+}
+
 func ApplyListen(c *config.C, listenAddr string) error {
 	host, port, err := net.SplitHostPort(listenAddr)
 	if err != nil {
@@ -111,22 +172,67 @@ func ApplyListen(c *config.C, listenAddr string) error {
 	return nil
 }
 
+func ApplyCA(c *config.C, caCert string, signer cert.Signer, caBundle string) error {
+	certPEM := c.GetString("pki.cert", "")
+	keyPEM := c.GetString("pki.key", "")
+	if certPEM == "" || keyPEM == "" {
+		return fmt.Errorf("config has no inline pki.cert/pki.key")
+	}
+
+	caFp, err := cert.Fingerprint(caCert)
+	if err != nil {
+		return fmt.Errorf("ca fingerprint: %w", err)
+	}
+	nodeCert, err := cert.VerifyWithBundle(caBundle, certPEM)
+	if err != nil || nodeCert.Issuer() != caFp {
+		certPair, err := cert.ResignCert(caCert, signer, certPEM)
+		if err != nil {
+			return fmt.Errorf("resign cert: %w", err)
+		}
+		certPEM = certPair.CertPEM
+	}
+
+	(*c).Settings["pki"] = map[string]any{
+		"cert": certPEM,
+		"key":  keyPEM,
+		"ca":   caBundle,
+	}
+	return nil
+}
+
+// ApplyBlocklist makes nebula reject the certs with the given fingerprints,
+// must be applied after ApplyCA
+func ApplyBlocklist(c *config.C, fingerprints []string) error {
+	pki, ok := (*c).Settings["pki"].(map[string]any)
+	if !ok {
+		return fmt.Errorf("config has no pki section")
+	}
+	pki["blocklist"] = fingerprints
+	return nil
+}
+
 func (node NebulaNode) CreateConfig(
-	caCert, caKey, ip string,
+	caCert string, signer cert.Signer, caBundle, ip string,
 ) (*config.C, error) {
 	c := config.NewC(nil)
 
-	serverKeyPair, err := cert.GenerateKeyPair()
+	curve, err := cert.CACurve(caCert)
+	if err != nil {
+		return nil, fmt.Errorf("ca curve: %w", err)
+	}
+
+	serverKeyPair, err := cert.GenerateKeyPair(curve)
 	if err != nil {
 		log.Fatalf("server key pair: %v", err)
 	}
 
 	serverCertPair, err := cert.SignCert(
 		caCert,
-		caKey,
+		signer,
 		node.Name,
 		ip,
 		node.Groups,
+		node.UnsafeNetworks,
 		serverKeyPair.CertPEM,
 	)
 	if err != nil {
@@ -135,7 +241,7 @@ func (node NebulaNode) CreateConfig(
 	(*c).Settings["pki"] = map[string]any{
 		"cert": serverCertPair.CertPEM,
 		"key":  serverKeyPair.KeyPEM,
-		"ca":   caCert,
+		"ca":   caBundle,
 	}
 
 	(*c).Settings["punchy"] = map[string]any{
@@ -172,6 +278,31 @@ func (node NebulaNode) CreateConfig(
 	if !ok {
 		return nil, fmt.Errorf("failed to get firewall ref: %w", err)
 	}
+	if node.InboundGroups != "" {
+		inbound := []any{}
+		for _, g := range strings.Split(node.InboundGroups, ",") {
+			inbound = append(inbound, map[string]any{
+				"port":  "any",
+				"proto": "any",
+				"group": strings.TrimSpace(g),
+			})
+		}
+		firewallRef["inbound"] = inbound
+	}
+	if node.UnsafeNetworks != "" {
+		// rules without local_cidr only match the node's own vpn address,
+		// let the server reach the routed networks too
+		inbound := firewallRef["inbound"].([]any)
+		for _, n := range strings.Split(node.UnsafeNetworks, ",") {
+			inbound = append(inbound, map[string]any{
+				"port":       "any",
+				"proto":      "any",
+				"group":      "server",
+				"local_cidr": strings.TrimSpace(n),
+			})
+		}
+		firewallRef["inbound"] = inbound
+	}
 	if !node.AcceptInbound {
 		delete(firewallRef, "inbound")
 	}
@@ -0,0 +1,167 @@
+package events
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	TypeNodeEnrolled        = "node.enrolled"
+	TypeNodeOnline          = "node.online"
+	TypeNodeOffline         = "node.offline"
+	TypeNodeRevoked         = "node.revoked"
+	TypeNodeLeaseExpiring   = "node.lease_expiring"
+	TypeNodeLeaseExpired    = "node.lease_expired"
+	TypeNodeServicesChanged = "node.services_changed"
+	TypeTokenBurned         = "token.burned"
+)
+
+// publishLockKey is the advisory lock serializing Publish
+const publishLockKey = 0x74756e6e656c // "tunnel"
+
+type Event struct {
+	ID        int64          `json:"id"`
+	Type      string         `json:"type"`
+	Node      string         `json:"node,omitempty"`
+	Data      map[string]any `json:"data,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+type EventService struct {
+	DB *sql.DB
+
+	// every published event is queued for delivery to these webhooks
+	Webhooks []Webhook
+}
+
+func InitTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS events (
+			id BIGSERIAL PRIMARY KEY,
+			type TEXT NOT NULL,
+			node TEXT NOT NULL DEFAULT '',
+			data JSONB NOT NULL DEFAULT '{}',
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+		CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id BIGSERIAL PRIMARY KEY,
+			event_id BIGINT NOT NULL REFERENCES events (id) ON DELETE CASCADE,
+			url TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			last_error TEXT NOT NULL DEFAULT '',
+			delivered_at TIMESTAMP WITH TIME ZONE,
+			failed_at TIMESTAMP WITH TIME ZONE
+		);
+		CREATE INDEX IF NOT EXISTS webhook_deliveries_pending
+			ON webhook_deliveries (next_attempt_at)
+			WHERE delivered_at IS NULL AND failed_at IS NULL;
+	`)
+	return err
+}
+
+// Publish records an event and queues it for the webhooks subscribed to it
+func (s EventService) Publish(eventType, node string, data map[string]any) (*Event, error) {
+	if data == nil {
+		data = map[string]any{}
+	}
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("marshal event data: %w", err)
+	}
+
+	e := Event{
+		Type: eventType,
+		Node: node,
+		Data: data,
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// ids are the resume cursor of event streams, publishing one at a time
+	// makes them commit in id order so a stream never passes an id which
+	// is still to be committed
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, publishLockKey); err != nil {
+		return nil, fmt.Errorf("lock events: %w", err)
+	}
+
+	row := tx.QueryRow(`INSERT
+			INTO events
+			(type, node, data)
+			VALUES
+			($1, $2, $3)
+			RETURNING id, created_at`,
+		eventType, node, string(dataJSON))
+	if err := row.Scan(&e.ID, &e.CreatedAt); err != nil {
+		return nil, fmt.Errorf("insert event: %w", err)
+	}
+
+	for _, w := range s.Webhooks {
+		if !w.Subscribed(eventType) {
+			continue
+		}
+		_, err := tx.Exec(`INSERT
+				INTO webhook_deliveries
+				(event_id, url)
+				VALUES
+				($1, $2)`,
+			e.ID, w.URL)
+		if err != nil {
+			return nil, fmt.Errorf("queue webhook delivery: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	log.Printf("[INFO] event %d %s %s", e.ID, e.Type, e.Node)
+	return &e, nil
+}
+
+// List returns up to limit events after the given id in ascending order,
+// optionally restricted to some event types and a node
+func (s EventService) List(afterID int64, types []string, node string, limit int) ([]Event, error) {
+	rows, err := s.DB.Query(`SELECT
+			id, type, node, data, created_at
+			FROM events
+			WHERE id > $1 AND (cardinality($2::TEXT[]) = 0 OR type = ANY($2)) AND ($3 = '' OR node = $3)
+			ORDER BY id
+			LIMIT $4`,
+		afterID, pq.Array(types), node, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		var e Event
+		var data string
+		if err := rows.Scan(&e.ID, &e.Type, &e.Node, &data, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(data), &e.Data); err != nil {
+			return nil, fmt.Errorf("unmarshal event data: %w", err)
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// LastID returns the id of the latest event, zero if there is none
+func (s EventService) LastID() (int64, error) {
+	var id int64
+	row := s.DB.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM events`)
+	err := row.Scan(&id)
+	return id, err
+}
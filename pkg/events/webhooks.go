@@ -0,0 +1,257 @@
+package events
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SignatureHeader = "X-Tunnel-Signature"
+	TimestampHeader = "X-Tunnel-Timestamp"
+	EventHeader     = "X-Tunnel-Event"
+	DeliveryHeader  = "X-Tunnel-Delivery"
+)
+
+// Webhook receives events as JSON POST requests
+type Webhook struct {
+	URL string
+	// subscribed event types, all if empty
+	Events []string
+}
+
+// ParseWebhook parses URL or URL#type,type formatted webhooks
+func ParseWebhook(s string) (Webhook, error) {
+	rawURL, types, _ := strings.Cut(strings.TrimSpace(s), "#")
+	if !strings.HasPrefix(rawURL, "http://") && !strings.HasPrefix(rawURL, "https://") {
+		return Webhook{}, fmt.Errorf("invalid webhook url %q", rawURL)
+	}
+
+	w := Webhook{URL: rawURL}
+	for _, t := range strings.Split(types, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			w.Events = append(w.Events, t)
+		}
+	}
+	return w, nil
+}
+
+func (w Webhook) Subscribed(eventType string) bool {
+	return len(w.Events) == 0 || slices.Contains(w.Events, eventType)
+}
+
+// Sign returns the signature of a payload sent at timestamp, receivers
+// compute it over the timestamp header, a dot and the raw body
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookDispatcher delivers the queued webhook deliveries. Failed
+// deliveries are retried with exponential backoff until MaxAttempts.
+type WebhookDispatcher struct {
+	DB     *sql.DB
+	Secret []byte
+	Client *http.Client
+
+	MaxAttempts int
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+}
+
+type delivery struct {
+	id       int64
+	url      string
+	attempts int
+	event    Event
+
+	// next_attempt_at as set by the claim, a delivery whose claim ran out
+	// and was taken over no longer has it
+	claimedUntil time.Time
+}
+
+// claimLease is how long a claimed delivery is left to the dispatcher which
+// claimed it, after that it's due again. It's extended to twice the client
+// timeout so it outlasts the webhook request.
+const claimLease = 5 * time.Minute
+
+// Run delivers due deliveries every interval until stop is closed
+func (d WebhookDispatcher) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			delivered, err := d.deliverNext()
+			if err != nil {
+				log.Printf("[WARN] delivering webhooks: %v", err)
+				break
+			}
+			if !delivered {
+				break
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliverNext attempts the oldest due delivery, reporting whether there
+// was one. No transaction is held while the webhook is called.
+func (d WebhookDispatcher) deliverNext() (bool, error) {
+	dl, err := d.claim()
+	if err != nil || dl == nil {
+		return false, err
+	}
+
+	sendErr := d.send(*dl)
+	if err := d.record(*dl, sendErr); err != nil {
+		return false, fmt.Errorf("update delivery: %w", err)
+	}
+	return true, nil
+}
+
+// claim leases the oldest due delivery by pushing its next attempt past
+// claimLease, nil if there is none
+func (d WebhookDispatcher) claim() (*delivery, error) {
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var dl delivery
+	var data string
+	row := tx.QueryRow(`SELECT
+			w.id, w.url, w.attempts, e.id, e.type, e.node, e.data, e.created_at
+			FROM webhook_deliveries w
+			JOIN events e ON e.id = w.event_id
+			WHERE w.delivered_at IS NULL AND w.failed_at IS NULL AND w.next_attempt_at <= NOW()
+			ORDER BY w.next_attempt_at, w.id
+			LIMIT 1
+			FOR UPDATE OF w SKIP LOCKED`)
+	err = row.Scan(&dl.id, &dl.url, &dl.attempts, &dl.event.ID, &dl.event.Type, &dl.event.Node, &data, &dl.event.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read delivery: %w", err)
+	}
+	if err := json.Unmarshal([]byte(data), &dl.event.Data); err != nil {
+		return nil, fmt.Errorf("unmarshal event data: %w", err)
+	}
+
+	err = tx.QueryRow(`UPDATE
+			webhook_deliveries
+			SET
+			next_attempt_at = $1
+			WHERE id = $2
+			RETURNING next_attempt_at`,
+		time.Now().Add(max(claimLease, 2*d.Client.Timeout)), dl.id).Scan(&dl.claimedUntil)
+	if err != nil {
+		return nil, fmt.Errorf("claim delivery: %w", err)
+	}
+
+	return &dl, tx.Commit()
+}
+
+// record stores the outcome of an attempt unless the claim was lost
+func (d WebhookDispatcher) record(dl delivery, sendErr error) error {
+	dl.attempts++
+
+	var res sql.Result
+	var err error
+	switch {
+	case sendErr == nil:
+		res, err = d.DB.Exec(`UPDATE
+				webhook_deliveries
+				SET
+				attempts = $1, delivered_at = NOW(), last_error = ''
+				WHERE id = $2 AND next_attempt_at = $3`,
+			dl.attempts, dl.id, dl.claimedUntil)
+	case dl.attempts >= d.MaxAttempts:
+		log.Printf("[WARN] giving up delivering event %d to %s after %d attempts: %v", dl.event.ID, dl.url, dl.attempts, sendErr)
+		res, err = d.DB.Exec(`UPDATE
+				webhook_deliveries
+				SET
+				attempts = $1, failed_at = NOW(), last_error = $2
+				WHERE id = $3 AND next_attempt_at = $4`,
+			dl.attempts, sendErr.Error(), dl.id, dl.claimedUntil)
+	default:
+		res, err = d.DB.Exec(`UPDATE
+				webhook_deliveries
+				SET
+				attempts = $1, next_attempt_at = $2, last_error = $3
+				WHERE id = $4 AND next_attempt_at = $5`,
+			dl.attempts, time.Now().Add(d.backoff(dl.attempts)), sendErr.Error(), dl.id, dl.claimedUntil)
+	}
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		log.Printf("[WARN] claim of delivery %d to %s ran out before the attempt finished", dl.id, dl.url)
+	}
+	return nil
+}
+
+func (d WebhookDispatcher) send(dl delivery) error {
+	body, err := json.Marshal(dl.event)
+	if err != nil {
+		return fmt.Errorf("marshal event: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, dl.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating http request: %w", err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, dl.event.Type)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(dl.id, 10))
+	req.Header.Set(TimestampHeader, timestamp)
+	if len(d.Secret) > 0 {
+		req.Header.Set(SignatureHeader, Sign(d.Secret, timestamp, body))
+	}
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("non-2xx status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (d WebhookDispatcher) backoff(attempts int) time.Duration {
+	backoff := d.MinBackoff
+	for i := 1; i < attempts && backoff < d.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, d.MaxBackoff)
+}
@@ -0,0 +1,376 @@
+package events
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type receivedRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// newReceiver returns a webhook receiver answering with statusCode and the
+// channel it passes the received requests on
+func newReceiver(t *testing.T, statusCode int) (*httptest.Server, <-chan receivedRequest) {
+	t.Helper()
+
+	received := make(chan receivedRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("method = %s, want POST", r.Method)
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("read body: %v", err)
+		}
+		received <- receivedRequest{header: r.Header.Clone(), body: body}
+		w.WriteHeader(statusCode)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, received
+}
+
+func testDelivery(url string) delivery {
+	return delivery{
+		id:  42,
+		url: url,
+		event: Event{
+			ID:        7,
+			Type:      TypeNodeEnrolled,
+			Node:      "node-1",
+			Data:      map[string]any{"pool": "edge"},
+			CreatedAt: time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+		},
+	}
+}
+
+func TestSendSigned(t *testing.T) {
+	srv, received := newReceiver(t, http.StatusNoContent)
+	secret := []byte("s3cret")
+	d := WebhookDispatcher{Secret: secret, Client: srv.Client()}
+
+	if err := d.send(testDelivery(srv.URL)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	req := <-received
+
+	if got := req.header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	if got := req.header.Get(EventHeader); got != TypeNodeEnrolled {
+		t.Errorf("%s = %q, want %s", EventHeader, got, TypeNodeEnrolled)
+	}
+	if got := req.header.Get(DeliveryHeader); got != "42" {
+		t.Errorf("%s = %q, want 42", DeliveryHeader, got)
+	}
+
+	timestamp := req.header.Get(TimestampHeader)
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		t.Fatalf("%s = %q: %v", TimestampHeader, timestamp, err)
+	}
+	if age := time.Since(time.Unix(sent, 0)); age < -time.Minute || age > time.Minute {
+		t.Errorf("%s is %s off", TimestampHeader, age)
+	}
+	if got, want := req.header.Get(SignatureHeader), Sign(secret, timestamp, req.body); got != want {
+		t.Errorf("%s = %q, want %q", SignatureHeader, got, want)
+	}
+
+	var event Event
+	if err := json.Unmarshal(req.body, &event); err != nil {
+		t.Fatalf("unmarshal body: %v", err)
+	}
+	if event.ID != 7 || event.Type != TypeNodeEnrolled || event.Node != "node-1" || event.Data["pool"] != "edge" {
+		t.Errorf("received event %+v", event)
+	}
+}
+
+func TestSendUnsigned(t *testing.T) {
+	srv, received := newReceiver(t, http.StatusOK)
+	d := WebhookDispatcher{Client: srv.Client()}
+
+	if err := d.send(testDelivery(srv.URL)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if got := (<-received).header.Get(SignatureHeader); got != "" {
+		t.Errorf("%s = %q without a secret", SignatureHeader, got)
+	}
+}
+
+func TestSendNon2xx(t *testing.T) {
+	for _, statusCode := range []int{http.StatusMovedPermanently, http.StatusBadRequest, http.StatusInternalServerError} {
+		t.Run(strconv.Itoa(statusCode), func(t *testing.T) {
+			srv, received := newReceiver(t, statusCode)
+			d := WebhookDispatcher{Client: &http.Client{
+				// a redirect isn't followed, the receiver has to answer itself
+				CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+			}}
+
+			if err := d.send(testDelivery(srv.URL)); err == nil {
+				t.Errorf("send succeeded on status code %d", statusCode)
+			}
+			<-received
+		})
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	d := WebhookDispatcher{Client: &http.Client{Timeout: 50 * time.Millisecond}}
+	if err := d.send(testDelivery(srv.URL)); err == nil {
+		t.Fatal("send succeeded although the receiver didn't answer")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	d := WebhookDispatcher{MinBackoff: 5 * time.Second, MaxBackoff: time.Minute}
+	want := []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute}
+	for i, w := range want {
+		if got := d.backoff(i + 1); got != w {
+			t.Errorf("backoff(%d) = %s, want %s", i+1, got, w)
+		}
+	}
+}
+
+func TestParseWebhook(t *testing.T) {
+	w, err := ParseWebhook(" https://hooks.example.com/tunnel#node.enrolled, node.revoked ")
+	if err != nil {
+		t.Fatalf("ParseWebhook: %v", err)
+	}
+	if w.URL != "https://hooks.example.com/tunnel" {
+		t.Errorf("URL = %q", w.URL)
+	}
+	if !w.Subscribed(TypeNodeEnrolled) || !w.Subscribed(TypeNodeRevoked) || w.Subscribed(TypeTokenBurned) {
+		t.Errorf("subscribed to %v", w.Events)
+	}
+
+	all, err := ParseWebhook("http://localhost:8080/hook")
+	if err != nil {
+		t.Fatalf("ParseWebhook: %v", err)
+	}
+	if !all.Subscribed(TypeTokenBurned) {
+		t.Error("webhook without event types isn't subscribed to everything")
+	}
+
+	if _, err := ParseWebhook("ftp://example.com"); err == nil {
+		t.Error("ParseWebhook accepted a non-http url")
+	}
+}
+
+// testDB returns a connection to the postgres database in TEST_DB_CONN with
+// the tables created in a schema of their own, skipping the test without it
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	conn := os.Getenv("TEST_DB_CONN")
+	if conn == "" {
+		t.Skip("TEST_DB_CONN not set")
+	}
+	db, err := sql.Open("postgres", conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	// search_path is per connection
+	db.SetMaxOpenConns(1)
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	schema := "test_" + hex.EncodeToString(b)
+	if _, err := db.Exec(`CREATE SCHEMA ` + schema + `; SET search_path TO ` + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec(`DROP SCHEMA ` + schema + ` CASCADE`) })
+
+	if err := InitTables(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// queueDelivery publishes an event for a webhook at url and returns a
+// dispatcher for it
+func queueDelivery(t *testing.T, db *sql.DB, url string) WebhookDispatcher {
+	t.Helper()
+
+	s := EventService{DB: db, Webhooks: []Webhook{{URL: url}}}
+	if _, err := s.Publish(TypeNodeEnrolled, "node-1", map[string]any{"pool": "edge"}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	return WebhookDispatcher{
+		DB:          db,
+		Secret:      []byte("s3cret"),
+		Client:      &http.Client{Timeout: time.Second},
+		MaxAttempts: 3,
+		MinBackoff:  time.Hour,
+		MaxBackoff:  4 * time.Hour,
+	}
+}
+
+type deliveryRow struct {
+	attempts      int
+	nextAttemptAt time.Time
+	lastError     string
+	delivered     bool
+	failed        bool
+}
+
+func readDelivery(t *testing.T, db *sql.DB) deliveryRow {
+	t.Helper()
+
+	var r deliveryRow
+	err := db.QueryRow(`SELECT
+			attempts, next_attempt_at, last_error, delivered_at IS NOT NULL, failed_at IS NOT NULL
+			FROM webhook_deliveries`).
+		Scan(&r.attempts, &r.nextAttemptAt, &r.lastError, &r.delivered, &r.failed)
+	if err != nil {
+		t.Fatalf("read delivery: %v", err)
+	}
+	return r
+}
+
+// makeDue lets the next claim take the delivery right away
+func makeDue(t *testing.T, db *sql.DB) {
+	t.Helper()
+
+	if _, err := db.Exec(`UPDATE webhook_deliveries SET next_attempt_at = NOW()`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClaim(t *testing.T) {
+	db := testDB(t)
+	d := queueDelivery(t, db, "http://127.0.0.1:1/hook")
+
+	dl, err := d.claim()
+	if err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+	if dl == nil {
+		t.Fatal("claim found no delivery")
+	}
+	if dl.url != "http://127.0.0.1:1/hook" || dl.event.Type != TypeNodeEnrolled || dl.event.Node != "node-1" || dl.event.Data["pool"] != "edge" {
+		t.Errorf("claimed %+v", dl)
+	}
+	if until := time.Until(dl.claimedUntil); until < claimLease-time.Minute {
+		t.Errorf("claimed for %s, want %s", until, claimLease)
+	}
+
+	// leased to the first claim
+	if dl, err := d.claim(); err != nil || dl != nil {
+		t.Errorf("second claim = %+v, %v, want none", dl, err)
+	}
+}
+
+func TestDeliverNext(t *testing.T) {
+	db := testDB(t)
+	srv, received := newReceiver(t, http.StatusNoContent)
+	d := queueDelivery(t, db, srv.URL)
+
+	delivered, err := d.deliverNext()
+	if err != nil || !delivered {
+		t.Fatalf("deliverNext = %v, %v", delivered, err)
+	}
+	req := <-received
+	if req.header.Get(SignatureHeader) == "" {
+		t.Error("delivery is not signed")
+	}
+
+	r := readDelivery(t, db)
+	if !r.delivered || r.failed || r.attempts != 1 || r.lastError != "" {
+		t.Errorf("delivery = %+v, want delivered after 1 attempt", r)
+	}
+	if delivered, err := d.deliverNext(); err != nil || delivered {
+		t.Errorf("deliverNext after delivery = %v, %v, want nothing to deliver", delivered, err)
+	}
+}
+
+func TestDeliverNextRetries(t *testing.T) {
+	db := testDB(t)
+	srv, received := newReceiver(t, http.StatusInternalServerError)
+	d := queueDelivery(t, db, srv.URL)
+
+	for attempt, backoff := range []time.Duration{time.Hour, 2 * time.Hour} {
+		start := time.Now()
+		if delivered, err := d.deliverNext(); err != nil || !delivered {
+			t.Fatalf("attempt %d: deliverNext = %v, %v", attempt+1, delivered, err)
+		}
+		<-received
+
+		r := readDelivery(t, db)
+		if r.delivered || r.failed || r.attempts != attempt+1 || r.lastError == "" {
+			t.Errorf("attempt %d: delivery = %+v", attempt+1, r)
+		}
+		if wait := r.nextAttemptAt.Sub(start); wait < backoff || wait > backoff+time.Minute {
+			t.Errorf("attempt %d: retried after %s, want %s", attempt+1, wait, backoff)
+		}
+
+		// not due before the backoff
+		if delivered, err := d.deliverNext(); err != nil || delivered {
+			t.Errorf("attempt %d: deliverNext in backoff = %v, %v", attempt+1, delivered, err)
+		}
+		makeDue(t, db)
+	}
+
+	// the last attempt gives up
+	if delivered, err := d.deliverNext(); err != nil || !delivered {
+		t.Fatalf("deliverNext = %v, %v", delivered, err)
+	}
+	<-received
+	r := readDelivery(t, db)
+	if !r.failed || r.delivered || r.attempts != d.MaxAttempts {
+		t.Errorf("delivery = %+v, want failed after %d attempts", r, d.MaxAttempts)
+	}
+
+	makeDue(t, db)
+	if delivered, err := d.deliverNext(); err != nil || delivered {
+		t.Errorf("deliverNext after giving up = %v, %v, want nothing to deliver", delivered, err)
+	}
+}
+
+func TestRecordLostClaim(t *testing.T) {
+	db := testDB(t)
+	d := queueDelivery(t, db, "http://127.0.0.1:1/hook")
+
+	dl, err := d.claim()
+	if err != nil || dl == nil {
+		t.Fatalf("claim = %v, %v", dl, err)
+	}
+
+	// the lease ran out and another dispatcher claimed the delivery
+	makeDue(t, db)
+	other, err := d.claim()
+	if err != nil || other == nil {
+		t.Fatalf("claim after the lease = %v, %v", other, err)
+	}
+
+	if err := d.record(*dl, nil); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if r := readDelivery(t, db); r.delivered || r.attempts != 0 {
+		t.Errorf("delivery = %+v, the lost claim was recorded", r)
+	}
+
+	if err := d.record(*other, nil); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if r := readDelivery(t, db); !r.delivered || r.attempts != 1 {
+		t.Errorf("delivery = %+v, want delivered by the current claim", r)
+	}
+}
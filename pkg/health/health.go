@@ -0,0 +1,174 @@
+package health
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+	"tunnel/pkg/cert"
+
+	"github.com/slackhq/nebula"
+)
+
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+type CheckFunc func(ctx context.Context) error
+
+type Check struct {
+	Name string
+	Run  CheckFunc
+}
+
+// Checker runs the readiness checks, every check gets Timeout to finish
+type Checker struct {
+	Timeout time.Duration
+
+	mu     sync.RWMutex
+	checks []Check
+}
+
+type Result struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type Report struct {
+	Status string   `json:"status"`
+	Checks []Result `json:"checks,omitempty"`
+}
+
+func (c *Checker) Add(name string, run CheckFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, Check{Name: name, Run: run})
+}
+
+// Run runs all checks concurrently, the report fails if any check fails
+func (c *Checker) Run(ctx context.Context) Report {
+	c.mu.RLock()
+	checks := append([]Check{}, c.checks...)
+	c.mu.RUnlock()
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	report := Report{Status: StatusOK, Checks: make([]Result, len(checks))}
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check.Run(ctx)
+			res := Result{
+				Name:      check.Name,
+				Status:    StatusOK,
+				LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				res.Status = StatusFail
+				res.Error = err.Error()
+			}
+			report.Checks[i] = res
+		}()
+	}
+	wg.Wait()
+
+	for _, res := range report.Checks {
+		if res.Status != StatusOK {
+			report.Status = StatusFail
+		}
+	}
+	return report
+}
+
+// Liveness only tells the process is able to serve requests
+func (c *Checker) Liveness(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, Report{Status: StatusOK})
+}
+
+func (c *Checker) Readiness(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, c.Run(r.Context()))
+}
+
+func writeReport(w http.ResponseWriter, report Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != StatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+func DB(db *sql.DB) CheckFunc {
+	return func(ctx context.Context) error {
+		return db.PingContext(ctx)
+	}
+}
+
+// CertValidity fails when the certificate returned by certPEM can't be
+// parsed or expires within minValidity
+func CertValidity(certPEM func() string, minValidity time.Duration) CheckFunc {
+	return func(ctx context.Context) error {
+		info, err := cert.Inspect(certPEM())
+		if err != nil {
+			return err
+		}
+		if left := time.Until(info.NotAfter); left < minValidity {
+			if left <= 0 {
+				return fmt.Errorf("certificate %s expired at %s", info.Name, info.NotAfter.Format(time.RFC3339))
+			}
+			return fmt.Errorf("certificate %s expires at %s", info.Name, info.NotAfter.Format(time.RFC3339))
+		}
+		return nil
+	}
+}
+
+// Nebula fails until ctrl returns a started instance and after it stopped
+func Nebula(ctrl func() *nebula.Control) CheckFunc {
+	return func(ctx context.Context) error {
+		c := ctrl()
+		if c == nil {
+			return errors.New("nebula is not running")
+		}
+		if c.Context().Err() != nil {
+			return errors.New("nebula stopped")
+		}
+		return nil
+	}
+}
+
+// TUN fails unless the tun device of the nebula instance is up
+func TUN(ctrl func() *nebula.Control) CheckFunc {
+	return func(ctx context.Context) error {
+		c := ctrl()
+		if c == nil {
+			return errors.New("nebula is not running")
+		}
+		name := c.Device().Name()
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return fmt.Errorf("tun device %s: %w", name, err)
+		}
+		if iface.Flags&net.FlagUp == 0 {
+			return fmt.Errorf("tun device %s is down", name)
+		}
+		return nil
+	}
+}
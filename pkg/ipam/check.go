@@ -0,0 +1,249 @@
+package ipam
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/netip"
+	"slices"
+	"sort"
+)
+
+// cursor is the allocation state of one network of the default pool (empty
+// pool name) or a named pool
+type cursor struct {
+	pool    string
+	id      int
+	network netip.Prefix
+	next    string
+}
+
+func storedNetworks(tx *sql.Tx) (map[int]string, error) {
+	rows, err := tx.Query(`SELECT id, network_cidr FROM ip_state`)
+	if err != nil {
+		return nil, fmt.Errorf("read state: %w", err)
+	}
+	defer rows.Close()
+
+	stored := map[int]string{}
+	for rows.Next() {
+		var id int
+		var cidr string
+		if err := rows.Scan(&id, &cidr); err != nil {
+			return nil, err
+		}
+		stored[id] = cidr
+	}
+	return stored, rows.Err()
+}
+
+func samePrefix(cidr string, network netip.Prefix) bool {
+	p, err := netip.ParsePrefix(cidr)
+	return err == nil && p == network
+}
+
+func cursors(tx *sql.Tx) ([]cursor, error) {
+	rows, err := tx.Query(`SELECT '', id, network_cidr, next_available_ip FROM ip_state
+			UNION ALL
+			SELECT pool, id, network_cidr, next_available_ip FROM ip_pool_state
+			ORDER BY 1, 2`)
+	if err != nil {
+		return nil, fmt.Errorf("read state: %w", err)
+	}
+	defer rows.Close()
+
+	var cs []cursor
+	for rows.Next() {
+		var c cursor
+		var cidr string
+		if err := rows.Scan(&c.pool, &c.id, &cidr, &c.next); err != nil {
+			return nil, err
+		}
+		c.network, err = netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stored CIDR (%s): %w", cidr, err)
+		}
+		cs = append(cs, c)
+	}
+	return cs, rows.Err()
+}
+
+// owner returns the cursor the address is allocated by
+func owner(cs []cursor, ip netip.Addr) *cursor {
+	// pools take precedence over the default pool they are carved from
+	for i := range cs {
+		if cs[i].pool != "" && cs[i].network.Masked().Contains(ip) {
+			return &cs[i]
+		}
+	}
+	for i := range cs {
+		if cs[i].pool == "" && cs[i].network.Masked().Contains(ip) {
+			return &cs[i]
+		}
+	}
+	return nil
+}
+
+// reconcile moves every cursor past the highest allocated address it owns
+func reconcile(tx *sql.Tx, allocated []string) error {
+	cs, err := cursors(tx)
+	if err != nil {
+		return err
+	}
+
+	for _, ipStr := range allocated {
+		ip, err := netip.ParseAddr(ipStr)
+		if err != nil {
+			log.Printf("[WARN] ignoring invalid allocated address %s", ipStr)
+			continue
+		}
+		c := owner(cs, ip)
+		if c == nil {
+			continue
+		}
+		// an invalid next address means the network is exhausted already
+		next, err := netip.ParseAddr(c.next)
+		if err != nil || ip.Less(next) {
+			continue
+		}
+		c.next = ip.Next().String()
+		log.Printf("[INFO] moving IPAM cursor of %s past allocated address %s", c.network, ip)
+
+		if c.pool == "" {
+			_, err = tx.Exec(`UPDATE ip_state SET next_available_ip = $1 WHERE id = $2`, c.next, c.id)
+		} else {
+			_, err = tx.Exec(`UPDATE ip_pool_state SET next_available_ip = $1 WHERE pool = $2 AND id = $3`, c.next, c.pool, c.id)
+		}
+		if err != nil {
+			return fmt.Errorf("update next IP: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Check compares the stored allocation state, pools and reservations with
+// the addresses in use (per holder) and describes every conflict found
+func (s IPAMService) Check(allocations map[string][]string) ([]string, error) {
+	networks, err := s.Networks()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var conflicts []string
+
+	stored, err := storedNetworks(tx)
+	if err != nil {
+		return nil, err
+	}
+	for i, n := range networks {
+		storedCIDR, ok := stored[firstRowID+i]
+		if !ok {
+			conflicts = append(conflicts, fmt.Sprintf("network %s is not initialized", n))
+		} else if !samePrefix(storedCIDR, n) {
+			conflicts = append(conflicts, fmt.Sprintf("network %s differs from the stored %s", n, storedCIDR))
+		}
+	}
+
+	cs, err := cursors(tx)
+	if err != nil {
+		return nil, err
+	}
+	pools, err := poolNetworks(tx)
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range pools {
+		for _, other := range pools[i+1:] {
+			if p.Overlaps(other) {
+				conflicts = append(conflicts, fmt.Sprintf("pool network %s overlaps pool network %s", p, other))
+			}
+		}
+		if !slices.ContainsFunc(networks, func(n netip.Prefix) bool {
+			return n.Masked().Bits() < p.Bits() && n.Masked().Contains(p.Addr())
+		}) {
+			conflicts = append(conflicts, fmt.Sprintf("pool network %s is outside of %s", p, s.NetworkCIDR))
+		}
+	}
+
+	holders := make([]string, 0, len(allocations))
+	for h := range allocations {
+		holders = append(holders, h)
+	}
+	sort.Strings(holders)
+
+	released, err := releasedAddrs(tx, false, false)
+	if err != nil {
+		return nil, err
+	}
+
+	heldBy := map[netip.Addr]string{}
+	for _, h := range holders {
+		for _, ipStr := range allocations[h] {
+			ip, err := netip.ParseAddr(ipStr)
+			if err != nil {
+				conflicts = append(conflicts, fmt.Sprintf("%s has invalid address %s", h, ipStr))
+				continue
+			}
+
+			if other, ok := heldBy[ip]; ok {
+				conflicts = append(conflicts, fmt.Sprintf("%s is assigned to both %s and %s", ip, other, h))
+			}
+			heldBy[ip] = h
+
+			if slices.Contains(released, ip) {
+				conflicts = append(conflicts, fmt.Sprintf("%s of %s is released and would be handed out again", ip, h))
+			}
+
+			c := owner(cs, ip)
+			if c == nil {
+				conflicts = append(conflicts, fmt.Sprintf("%s of %s is outside of %s", ip, h, s.NetworkCIDR))
+				continue
+			}
+			if !Usable(ip, c.network) {
+				conflicts = append(conflicts, fmt.Sprintf("%s of %s is a reserved address of %s", ip, h, c.network.Masked()))
+			}
+			next, err := netip.ParseAddr(c.next)
+			if err == nil && !ip.Less(next) {
+				reserved, err := hasReservation(tx, ip)
+				if err != nil {
+					return nil, err
+				}
+				// reserved addresses are skipped by the cursor
+				if !reserved {
+					conflicts = append(conflicts, fmt.Sprintf(
+						"%s of %s is not below the allocation cursor %s of %s and would be handed out again",
+						ip, h, c.next, c.network.Masked(),
+					))
+				}
+			}
+		}
+	}
+
+	reservations, err := s.ListReservations()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range reservations {
+		if r.NodeName == "" || r.HardwareID != "" {
+			continue
+		}
+		for _, ipStr := range r.IPs {
+			ip, err := netip.ParseAddr(ipStr)
+			if err != nil {
+				continue
+			}
+			if h, ok := heldBy[ip]; ok && h != r.NodeName {
+				conflicts = append(conflicts, fmt.Sprintf("%s is reserved for %s but assigned to %s", ip, r.NodeName, h))
+			}
+		}
+	}
+
+	return conflicts, nil
+}
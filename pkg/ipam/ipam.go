@@ -2,25 +2,40 @@ package ipam
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
-	"net"
+	"net/netip"
+	"strings"
 
 	_ "github.com/lib/pq"
 )
 
+// IPAMService hands out overlay addresses sequentially. NetworkCIDR holds
+// one network, or one IPv4 and one IPv6 network separated by a comma for
+// dual-stack nodes. The first network is the primary one.
 type IPAMService struct {
 	DB          *sql.DB
 	NetworkCIDR string
+
+	// utilization percentage to warn about, disabled if zero
+	AlertThreshold float64
 }
 
+var ErrNetworkChanged = errors.New("network CIDR differs from the stored one, migration required")
+
 type IPState struct {
 	ID              int
 	NetworkCIDR     string
 	NextAvailableIP string
 }
 
-const singleRowID = 1
+// every network keeps its own ip_state row, starting with the primary one
+const firstRowID = 1
+
+// RFC 2526 reserves the highest 128 addresses of an IPv6 subnet for
+// subnet anycast
+const reservedIPv6Anycast = 128
 
 func InitTables(db *sql.DB) error {
 	_, err := db.Exec(`
@@ -29,26 +44,106 @@ func InitTables(db *sql.DB) error {
 			network_cidr TEXT NOT NULL,
 			next_available_ip TEXT NOT NULL
 		);
+		CREATE TABLE IF NOT EXISTS ip_pools (
+			name TEXT NOT NULL PRIMARY KEY,
+			network_cidr TEXT NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+		CREATE TABLE IF NOT EXISTS ip_released (
+			ip TEXT NOT NULL PRIMARY KEY,
+			released_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+		ALTER TABLE ip_released ADD COLUMN IF NOT EXISTS reusable_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW();
+		CREATE TABLE IF NOT EXISTS ip_pool_state (
+			pool TEXT NOT NULL REFERENCES ip_pools (name) ON DELETE CASCADE,
+			id INTEGER NOT NULL,
+			network_cidr TEXT NOT NULL,
+			next_available_ip TEXT NOT NULL,
+			PRIMARY KEY (pool, id)
+		);
 	`)
-	return err
+	if err != nil {
+		return err
+	}
+
+	return initReservationsTable(db)
+}
+
+// Networks parses NetworkCIDR. The returned prefixes keep the configured
+// address, which is the one right before the server address.
+func (s IPAMService) Networks() ([]netip.Prefix, error) {
+	return ParseNetworks(s.NetworkCIDR)
+}
+
+func ParseNetworks(cidrList string) ([]netip.Prefix, error) {
+	var networks []netip.Prefix
+	var has4, has6 bool
+	for _, c := range strings.Split(cidrList, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR format: %w", err)
+		}
+
+		if prefix.Addr().Is4() {
+			if has4 {
+				return nil, fmt.Errorf("more than one IPv4 network in %s", cidrList)
+			}
+			has4 = true
+		} else {
+			if has6 {
+				return nil, fmt.Errorf("more than one IPv6 network in %s", cidrList)
+			}
+			has6 = true
+		}
+
+		networks = append(networks, prefix)
+	}
+	if len(networks) == 0 {
+		return nil, fmt.Errorf("no network configured")
+	}
+	return networks, nil
 }
 
+// ServerAddr returns the server address in the primary network
 func (s IPAMService) ServerAddr() (string, error) {
-	ip, _, err := net.ParseCIDR(s.NetworkCIDR)
+	ips, err := s.ServerIPs()
 	if err != nil {
-		return "", fmt.Errorf("invalid CIDR format: %w", err)
+		return "", err
 	}
 
-	return incrementIP(ip).String(), nil
+	return ips[0], nil
 }
 
-func (s IPAMService) InitializeNetwork() error {
-	ip, _, err := net.ParseCIDR(s.NetworkCIDR)
+// ServerIPs returns the server address in every network, they are never
+// handed out to nodes
+func (s IPAMService) ServerIPs() ([]string, error) {
+	networks, err := s.Networks()
 	if err != nil {
-		return fmt.Errorf("invalid CIDR format: %w", err)
+		return nil, err
+	}
+
+	ips := make([]string, 0, len(networks))
+	for _, n := range networks {
+		ips = append(ips, n.Addr().Next().String())
 	}
+	return ips, nil
+}
 
-	firstUsableIP := incrementIP(ip)
+// InitializeNetwork prepares the allocation state for NetworkCIDR and moves
+// the allocation cursors past every address in allocated, so addresses
+// already in use are never handed out again. Existing state is kept; a
+// NetworkCIDR that differs from the stored one is refused with
+// ErrNetworkChanged unless migrate is set, which restarts allocation in
+// the changed networks.
+func (s IPAMService) InitializeNetwork(allocated []string, migrate bool) (err error) {
+	networks, err := s.Networks()
+	if err != nil {
+		return err
+	}
 
 	tx, err := s.DB.Begin()
 	if err != nil {
@@ -66,28 +161,71 @@ func (s IPAMService) InitializeNetwork() error {
 		}
 	}()
 
-	_, err = tx.Exec("DELETE FROM ip_state WHERE id = $1", singleRowID)
-	if err != nil {
-		return fmt.Errorf("delete old state: %w", err)
+	if _, err = tx.Exec(`LOCK TABLE ip_state, ip_pool_state IN EXCLUSIVE MODE`); err != nil {
+		return fmt.Errorf("lock state: %w", err)
 	}
 
-	_, err = tx.Exec(`INSERT
-			INTO ip_state
-			(id, network_cidr, next_available_ip)
-			VALUES
-			($1, $2, $3)`,
-		singleRowID, s.NetworkCIDR, firstUsableIP.String())
+	stored, err := storedNetworks(tx)
 	if err != nil {
-		return fmt.Errorf("insert new state: %w", err)
+		return err
+	}
+
+	for i, network := range networks {
+		id := firstRowID + i
+		storedCIDR, ok := stored[id]
+		if ok && samePrefix(storedCIDR, network) {
+			continue
+		}
+		if ok && !migrate {
+			return fmt.Errorf("%w: stored %s, configured %s", ErrNetworkChanged, storedCIDR, network)
+		}
+		if ok {
+			log.Printf("[INFO] migrating IPAM network %s to %s", storedCIDR, network)
+		}
+
+		// the server address comes first and is never handed out
+		_, err = tx.Exec(`INSERT
+				INTO ip_state
+				(id, network_cidr, next_available_ip)
+				VALUES
+				($1, $2, $3)
+				ON CONFLICT (id) DO UPDATE
+				SET
+				network_cidr = EXCLUDED.network_cidr,
+				next_available_ip = EXCLUDED.next_available_ip`,
+			id, network.String(), network.Addr().Next().Next().String())
+		if err != nil {
+			return fmt.Errorf("insert new state: %w", err)
+		}
+	}
+	for id, storedCIDR := range stored {
+		if id < firstRowID+len(networks) {
+			continue
+		}
+		if !migrate {
+			return fmt.Errorf("%w: stored %s is not configured anymore", ErrNetworkChanged, storedCIDR)
+		}
+		log.Printf("[INFO] dropping IPAM network %s", storedCIDR)
+		if _, err = tx.Exec(`DELETE FROM ip_state WHERE id = $1`, id); err != nil {
+			return fmt.Errorf("delete state: %w", err)
+		}
 	}
 
-	return nil
+	return reconcile(tx, allocated)
 }
 
-func (s IPAMService) NextIP() (string, error) {
+// NextIPs allocates one address from every network, in the order of
+// NetworkCIDR. Addresses come from the named pool, or from the parts of
+// NetworkCIDR not carved out by any pool if pool is empty.
+func (s IPAMService) NextIPs(pool string) ([]string, error) {
+	networks, err := s.Networks()
+	if err != nil {
+		return nil, err
+	}
+
 	tx, err := s.DB.Begin()
 	if err != nil {
-		return "", fmt.Errorf("begin transaction: %w", err)
+		return nil, fmt.Errorf("begin transaction: %w", err)
 	}
 	defer func() {
 		if err != nil {
@@ -97,85 +235,224 @@ func (s IPAMService) NextIP() (string, error) {
 		}
 	}()
 
+	var skip []netip.Prefix
+	if pool == "" {
+		// a pool created meanwhile could cover the address handed out,
+		// CreatePool waits for this lock and sees the advanced cursor
+		if _, err = tx.Exec(`LOCK TABLE ip_pools IN SHARE MODE`); err != nil {
+			return nil, fmt.Errorf("lock pools: %w", err)
+		}
+		skip, err = poolNetworks(tx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ips := make([]string, 0, len(networks))
+	for i := range networks {
+		var ip string
+		ip, err = nextIP(tx, pool, firstRowID+i, skip)
+		if err != nil {
+			return nil, err
+		}
+		ips = append(ips, ip)
+	}
+
+	return ips, nil
+}
+
+func nextIP(tx *sql.Tx, pool string, id int, skip []netip.Prefix) (string, error) {
 	var currentIPStr string
 	var currentCIDR string
 
-	row := tx.QueryRow(`SELECT
-			next_available_ip, network_cidr
-			FROM
-			ip_state
-			WHERE id = $1
-			FOR UPDATE`,
-		singleRowID)
-	err = row.Scan(&currentIPStr, &currentCIDR)
+	var row *sql.Row
+	if pool == "" {
+		row = tx.QueryRow(`SELECT
+				next_available_ip, network_cidr
+				FROM
+				ip_state
+				WHERE id = $1
+				FOR UPDATE`,
+			id)
+	} else {
+		row = tx.QueryRow(`SELECT
+				next_available_ip, network_cidr
+				FROM
+				ip_pool_state
+				WHERE pool = $1 AND id = $2
+				FOR UPDATE`,
+			pool, id)
+	}
+	err := row.Scan(&currentIPStr, &currentCIDR)
 	if err == sql.ErrNoRows {
+		if pool != "" {
+			return "", ErrPoolNotFound
+		}
 		return "", fmt.Errorf("network not initialized")
 	} else if err != nil {
 		return "", fmt.Errorf("read current IP: %w", err)
 	}
 
-	currentIP := net.ParseIP(currentIPStr)
-	_, ipNet, err := net.ParseCIDR(currentCIDR)
+	prefix, err := netip.ParsePrefix(currentCIDR)
 	if err != nil {
 		return "", fmt.Errorf("invalid stored CIDR (%s): %w", currentCIDR, err)
 	}
 
-	if currentIP == nil || !ipNet.Contains(currentIP) || isBroadcast(currentIP, ipNet) {
+	released, err := takeReleased(tx, prefix, skip)
+	if err != nil || released != "" {
+		return released, err
+	}
+
+	currentIP, err := netip.ParseAddr(currentIPStr)
+	if err == nil {
+		currentIP, err = nextFree(currentIP, prefix, skip, func(ip netip.Addr) (bool, error) {
+			return hasReservation(tx, ip)
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	if err != nil || !currentIP.IsValid() {
 		return "", fmt.Errorf(
-			"network exhaustion: next IP (%s) is outside of CIDR range (%s) or is the broadcast address",
+			"network exhaustion: next IP (%s) is outside of CIDR range (%s) or is reserved",
 			currentIPStr, currentCIDR,
 		)
 	}
 
-	allocatedIP := currentIP
-	nextIPToStore := incrementIP(currentIP)
+	// an invalid address marks the end of the address space
+	nextIPToStore := currentIP.Next()
 
-	_, err = tx.Exec(`UPDATE
-			ip_state
-			SET
-			next_available_ip = $1
-			WHERE id = $2`,
-		nextIPToStore.String(), singleRowID)
+	if pool == "" {
+		_, err = tx.Exec(`UPDATE
+				ip_state
+				SET
+				next_available_ip = $1
+				WHERE id = $2`,
+			nextIPToStore.String(), id)
+	} else {
+		_, err = tx.Exec(`UPDATE
+				ip_pool_state
+				SET
+				next_available_ip = $1
+				WHERE pool = $2 AND id = $3`,
+			nextIPToStore.String(), pool, id)
+	}
 	if err != nil {
 		return "", fmt.Errorf("update next IP: %w", err)
 	}
 
-	return allocatedIP.String(), nil
+	return currentIP.String(), nil
 }
 
-func (s IPAMService) JoinIPAndNet(ip string) (string, error) {
-	_, ipNet, err := net.ParseCIDR(s.NetworkCIDR)
+// nextFree returns the first address from ip on which can be handed out, or
+// an invalid address once prefix is exhausted
+func nextFree(ip netip.Addr, prefix netip.Prefix, skip []netip.Prefix, taken func(netip.Addr) (bool, error)) (netip.Addr, error) {
+	ip, err := skipReserved(skipNetworks(ip, skip), prefix, skip, taken)
 	if err != nil {
-		return "", fmt.Errorf("invalid CIDR (%s): %w", s.NetworkCIDR, err)
+		return netip.Addr{}, err
 	}
-	size, _ := ipNet.Mask.Size()
-
-	return fmt.Sprintf("%s/%d", ip, size), nil
+	if !Usable(ip, prefix) {
+		return netip.Addr{}, nil
+	}
+	return ip, nil
 }
 
-func incrementIP(ip net.IP) net.IP {
-	newIP := make(net.IP, len(ip))
-	copy(newIP, ip)
-
-	for i := len(newIP) - 1; i >= 0; i-- {
-		newIP[i]++
-		if newIP[i] != 0 {
+// skipReserved moves ip past addresses reserved for other nodes
+func skipReserved(ip netip.Addr, prefix netip.Prefix, skip []netip.Prefix, taken func(netip.Addr) (bool, error)) (netip.Addr, error) {
+	for Usable(ip, prefix) {
+		reserved, err := taken(ip)
+		if err != nil {
+			return ip, err
+		}
+		if !reserved {
 			break
 		}
+		ip = skipNetworks(ip.Next(), skip)
+	}
+	return ip, nil
+}
+
+// skipNetworks moves ip past every network in skip it falls into
+func skipNetworks(ip netip.Addr, skip []netip.Prefix) netip.Addr {
+	for moved := true; moved && ip.IsValid(); {
+		moved = false
+		for _, n := range skip {
+			if n.Contains(ip) {
+				ip = lastAddr(n).Next()
+				moved = true
+			}
+		}
+	}
+	return ip
+}
+
+// JoinIPsAndNets joins addresses returned by NextIPs with the size of
+// their networks into a comma separated list suitable for certificates
+func (s IPAMService) JoinIPsAndNets(ips []string) (string, error) {
+	networks, err := s.Networks()
+	if err != nil {
+		return "", err
+	}
+	if len(ips) != len(networks) {
+		return "", fmt.Errorf("got %d addresses for %d networks", len(ips), len(networks))
+	}
+
+	cidrs := make([]string, 0, len(ips))
+	for i, ip := range ips {
+		cidrs = append(cidrs, fmt.Sprintf("%s/%d", ip, networks[i].Bits()))
+	}
+
+	return strings.Join(cidrs, ","), nil
+}
+
+// Usable reports whether ip can be handed out from the network: it has to
+// be inside of it and be neither the network address, the IPv4 broadcast
+// address nor one of the reserved IPv6 subnet anycast addresses. Networks
+// of one or two addresses (/31, /127, RFC 3021 and 6164) use all of them.
+func Usable(ip netip.Addr, network netip.Prefix) bool {
+	network = network.Masked()
+	if !ip.IsValid() || !network.Contains(ip) || ip.Less(firstAddr(network)) {
+		return false
 	}
-	return newIP
+	return !isReserved(ip, network)
 }
 
-func isBroadcast(ip net.IP, ipNet *net.IPNet) bool {
-	ip4 := ip.To4()
-	if ip4 == nil {
+func isReserved(ip netip.Addr, network netip.Prefix) bool {
+	hostBits := ip.BitLen() - network.Bits()
+
+	if ip.Is4() {
+		// point-to-point networks have no broadcast address
+		if hostBits < 2 {
+			return false
+		}
+		return ip == lastAddr(network)
+	}
+
+	// RFC 2526 only applies to subnets large enough to hold the range
+	if hostBits < 8 {
 		return false
 	}
+	firstReserved := lastAddr(network)
+	for range reservedIPv6Anycast - 1 {
+		firstReserved = firstReserved.Prev()
+	}
+	return ip.Compare(firstReserved) >= 0
+}
 
-	broadcast := make(net.IP, 4)
-	for i := 0; i < len(ip4); i++ {
-		broadcast[i] = ipNet.IP[i] | ^ipNet.Mask[i]
+// firstAddr returns the first address of network Usable allows
+func firstAddr(network netip.Prefix) netip.Addr {
+	network = network.Masked()
+	if network.Addr().BitLen()-network.Bits() < 2 {
+		return network.Addr()
 	}
+	return network.Addr().Next()
+}
 
-	return ip4.Equal(broadcast)
+func lastAddr(network netip.Prefix) netip.Addr {
+	b := network.Masked().Addr().AsSlice()
+	for i := network.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
 }
@@ -0,0 +1,230 @@
+package ipam
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestUsable(t *testing.T) {
+	tests := []struct {
+		ip      string
+		network string
+		want    bool
+	}{
+		{"10.0.0.1", "10.0.0.0/24", true},
+		{"10.0.0.254", "10.0.0.0/24", true},
+		{"10.0.0.0", "10.0.0.0/24", false},
+		{"10.0.0.255", "10.0.0.0/24", false},
+		{"10.0.1.1", "10.0.0.0/24", false},
+		{"10.0.0.255", "10.0.0.1/24", false},
+		{"10.0.0.2", "10.0.0.0/30", true},
+		{"10.0.0.3", "10.0.0.0/30", false},
+		// point-to-point networks have neither a network nor a broadcast
+		// address
+		{"10.0.0.1", "10.0.0.0/31", true},
+		{"10.0.0.0", "10.0.0.0/31", true},
+		{"10.0.0.1", "10.0.0.1/32", true},
+		{"10.0.0.2", "10.0.0.0/31", false},
+		{"255.255.255.254", "255.255.255.0/24", true},
+		{"255.255.255.255", "255.255.255.0/24", false},
+
+		{"fd00::1", "fd00::/64", true},
+		{"fd00::", "fd00::/64", false},
+		{"fd00::ffff:ffff:ffff:ff7f", "fd00::/64", true},
+		// RFC 2526 subnet anycast addresses
+		{"fd00::ffff:ffff:ffff:ff80", "fd00::/64", false},
+		{"fd00::ffff:ffff:ffff:fffe", "fd00::/64", false},
+		{"fd00::ffff:ffff:ffff:ffff", "fd00::/64", false},
+		{"fd00::7f", "fd00::/120", true},
+		{"fd00::80", "fd00::/120", false},
+		// too small to hold the anycast range
+		{"fd00::7f", "fd00::/121", true},
+		{"fd00::3", "fd00::/126", true},
+		{"fd00::", "fd00::/126", false},
+		{"fd00::", "fd00::/127", true},
+		{"fd00::1", "fd00::/127", true},
+		{"fd00::1", "fd00::1/128", true},
+		{"fd01::1", "fd00::/64", false},
+
+		{"10.0.0.1", "fd00::/64", false},
+		{"fd00::1", "10.0.0.0/24", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.ip+" in "+tc.network, func(t *testing.T) {
+			got := Usable(netip.MustParseAddr(tc.ip), netip.MustParsePrefix(tc.network))
+			if got != tc.want {
+				t.Errorf("Usable = %v, want %v", got, tc.want)
+			}
+		})
+	}
+	if Usable(netip.Addr{}, netip.MustParsePrefix("10.0.0.0/24")) {
+		t.Error("Usable accepted an invalid address")
+	}
+}
+
+func TestIsReserved(t *testing.T) {
+	tests := []struct {
+		ip      string
+		network string
+		want    bool
+	}{
+		{"10.0.0.255", "10.0.0.0/24", true},
+		{"10.0.0.254", "10.0.0.0/24", false},
+		{"10.0.0.1", "10.0.0.0/31", false},
+		{"10.0.0.1", "10.0.0.1/32", false},
+		{"fd00::ff", "fd00::/120", true},
+		{"fd00::80", "fd00::/120", true},
+		{"fd00::7f", "fd00::/120", false},
+		{"fd00::7f", "fd00::/121", false},
+		{"fd00::ffff:ffff:ffff:ff80", "fd00::/64", true},
+		{"fd00::ffff:ffff:ffff:ff7f", "fd00::/64", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.ip+" in "+tc.network, func(t *testing.T) {
+			got := isReserved(netip.MustParseAddr(tc.ip), netip.MustParsePrefix(tc.network))
+			if got != tc.want {
+				t.Errorf("isReserved = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// allocateAll hands out addresses like nextIP does until the network is
+// exhausted, at most limit of them
+func allocateAll(t *testing.T, network string, skip []string, reserved []string, limit int) []string {
+	t.Helper()
+
+	prefix := netip.MustParsePrefix(network)
+	var skipPrefixes []netip.Prefix
+	for _, s := range skip {
+		skipPrefixes = append(skipPrefixes, netip.MustParsePrefix(s))
+	}
+	taken := func(ip netip.Addr) (bool, error) {
+		return slices.Contains(reserved, ip.String()), nil
+	}
+
+	var ips []string
+	// cursors start at the first usable address
+	next := firstAddr(prefix)
+	for range limit {
+		ip, err := nextFree(next, prefix, skipPrefixes, taken)
+		if err != nil {
+			t.Fatalf("nextFree: %v", err)
+		}
+		if !ip.IsValid() {
+			return ips
+		}
+		ips = append(ips, ip.String())
+		next = ip.Next()
+	}
+	t.Fatalf("%s not exhausted after %d addresses: %v", network, limit, ips)
+	return nil
+}
+
+func TestNextFree(t *testing.T) {
+	tests := []struct {
+		name     string
+		network  string
+		skip     []string
+		reserved []string
+		want     []string
+	}{
+		{
+			name:    "ipv4",
+			network: "10.0.0.0/29",
+			want:    []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"},
+		},
+		{
+			name:    "ipv4 point-to-point",
+			network: "10.0.0.0/31",
+			want:    []string{"10.0.0.0", "10.0.0.1"},
+		},
+		{
+			name:    "ipv4 end of the address space",
+			network: "255.255.255.252/30",
+			want:    []string{"255.255.255.253", "255.255.255.254"},
+		},
+		{
+			name:    "ipv4 no wrap-around",
+			network: "255.255.255.254/31",
+			want:    []string{"255.255.255.254", "255.255.255.255"},
+		},
+		{
+			name:    "ipv4 skipped pool",
+			network: "10.0.0.0/28",
+			skip:    []string{"10.0.0.4/30", "10.0.0.12/30"},
+			want:    []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.8", "10.0.0.9", "10.0.0.10", "10.0.0.11"},
+		},
+		{
+			name:    "ipv4 skipped pool at the end of the address space",
+			network: "255.255.255.248/29",
+			skip:    []string{"255.255.255.252/30"},
+			want:    []string{"255.255.255.249", "255.255.255.250", "255.255.255.251"},
+		},
+		{
+			name:     "ipv4 reserved",
+			network:  "10.0.0.0/29",
+			reserved: []string{"10.0.0.2", "10.0.0.3", "10.0.0.6"},
+			want:     []string{"10.0.0.1", "10.0.0.4", "10.0.0.5"},
+		},
+		{
+			name:    "ipv6 point-to-point",
+			network: "fd00::/127",
+			want:    []string{"fd00::", "fd00::1"},
+		},
+		{
+			name:    "ipv6 small subnet",
+			network: "fd00::/126",
+			want:    []string{"fd00::1", "fd00::2", "fd00::3"},
+		},
+		{
+			name:    "ipv6 end of the address space",
+			network: "ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffc/126",
+			want: []string{
+				"ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffd",
+				"ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffe",
+				"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff",
+			},
+		},
+		{
+			name:     "ipv6 skipped and reserved",
+			network:  "fd00::/125",
+			skip:     []string{"fd00::2/127"},
+			reserved: []string{"fd00::5"},
+			want:     []string{"fd00::1", "fd00::4", "fd00::6", "fd00::7"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := allocateAll(t, tc.network, tc.skip, tc.reserved, 1024)
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("allocated %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNextFreeIPv6Anycast(t *testing.T) {
+	got := allocateAll(t, "fd00::/120", nil, nil, 1024)
+	if len(got) != 127 {
+		t.Fatalf("allocated %d addresses, want 127", len(got))
+	}
+	if got[0] != "fd00::1" || got[len(got)-1] != "fd00::7f" {
+		t.Errorf("allocated %s to %s, want fd00::1 to fd00::7f", got[0], got[len(got)-1])
+	}
+}
+
+func TestNextFreeFromExhaustedCursor(t *testing.T) {
+	prefix := netip.MustParsePrefix("255.255.255.254/31")
+	last := netip.MustParseAddr("255.255.255.255")
+
+	// the cursor past the end of the address space is an invalid address
+	ip, err := nextFree(last.Next(), prefix, nil, func(netip.Addr) (bool, error) { return false, nil })
+	if err != nil {
+		t.Fatalf("nextFree: %v", err)
+	}
+	if ip.IsValid() {
+		t.Errorf("nextFree = %s, want exhaustion", ip)
+	}
+}
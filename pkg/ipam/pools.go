@@ -0,0 +1,240 @@
+package ipam
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	ErrPoolNotFound = errors.New("address pool not found")
+	ErrPoolExists   = errors.New("address pool already exists")
+)
+
+// pool names end up as nebula cert groups
+var poolNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// names already used as groups by the server
+var reservedPoolNames = []string{"server", "client"}
+
+// Pool is a part of the overlay network dedicated to a tenant. It holds one
+// network per network in NetworkCIDR, in the same order.
+type Pool struct {
+	Name        string    `json:"name"`
+	NetworkCIDR string    `json:"network_cidr"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// CreatePool carves the networks in cidrList out of NetworkCIDR. They must
+// not overlap other pools or the server address.
+func (s IPAMService) CreatePool(name, cidrList string) (*Pool, error) {
+	if !poolNameRegex.MatchString(name) {
+		return nil, fmt.Errorf("invalid pool name %q", name)
+	}
+	for _, r := range reservedPoolNames {
+		if name == r {
+			return nil, fmt.Errorf("pool name %q is reserved", name)
+		}
+	}
+
+	networks, err := s.Networks()
+	if err != nil {
+		return nil, err
+	}
+	poolNets, err := ParseNetworks(cidrList)
+	if err != nil {
+		return nil, err
+	}
+	if len(poolNets) != len(networks) {
+		return nil, fmt.Errorf("pool needs one network for each of %s", s.NetworkCIDR)
+	}
+
+	serverAddr, err := s.ServerAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, n := range poolNets {
+		n = n.Masked()
+		poolNets[i] = n
+
+		overlay := networks[i].Masked()
+		if n.Addr().Is4() != overlay.Addr().Is4() || n.Bits() <= overlay.Bits() || !overlay.Contains(n.Addr()) {
+			return nil, fmt.Errorf("pool network %s is not a subnet of %s", n, overlay)
+		}
+		if n.Contains(netip.MustParseAddr(serverAddr)) {
+			return nil, fmt.Errorf("pool network %s contains the server address %s", n, serverAddr)
+		}
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// serialize pool creation so overlap checks can't race, with each other
+	// and with allocations outside of pools (see NextIPs)
+	if _, err = tx.Exec(`LOCK TABLE ip_pools IN EXCLUSIVE MODE`); err != nil {
+		return nil, fmt.Errorf("lock pools: %w", err)
+	}
+
+	existing, err := poolNetworks(tx)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range poolNets {
+		for _, e := range existing {
+			if n.Overlaps(e) {
+				return nil, fmt.Errorf("pool network %s overlaps pool network %s", n, e)
+			}
+		}
+	}
+
+	// addresses below the next default address may already be handed out
+	for i, n := range poolNets {
+		var nextStr string
+		row := tx.QueryRow(`SELECT next_available_ip FROM ip_state WHERE id = $1`, firstRowID+i)
+		err = row.Scan(&nextStr)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("read current IP: %w", err)
+		}
+		// an invalid address means the network is exhausted
+		next, err := netip.ParseAddr(nextStr)
+		if err != nil || n.Addr().Less(next) {
+			return nil, fmt.Errorf("pool network %s overlaps already allocated addresses (below %s)", n, nextStr)
+		}
+	}
+
+	cidrs := make([]string, 0, len(poolNets))
+	for _, n := range poolNets {
+		cidrs = append(cidrs, n.String())
+	}
+
+	var p Pool
+	row := tx.QueryRow(`INSERT
+			INTO ip_pools
+			(name, network_cidr)
+			VALUES
+			($1, $2)
+			ON CONFLICT (name) DO NOTHING
+			RETURNING name, network_cidr, created_at`,
+		name, strings.Join(cidrs, ","))
+	err = row.Scan(&p.Name, &p.NetworkCIDR, &p.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrPoolExists
+		}
+		return nil, fmt.Errorf("insert pool: %w", err)
+	}
+
+	for i, n := range poolNets {
+		_, err = tx.Exec(`INSERT
+				INTO ip_pool_state
+				(pool, id, network_cidr, next_available_ip)
+				VALUES
+				($1, $2, $3, $4)`,
+			name, firstRowID+i, n.String(), firstAddr(n).String())
+		if err != nil {
+			return nil, fmt.Errorf("insert pool state: %w", err)
+		}
+	}
+
+	return &p, tx.Commit()
+}
+
+func (s IPAMService) GetPool(name string) (*Pool, error) {
+	var p Pool
+	row := s.DB.QueryRow(`SELECT
+			name, network_cidr, created_at
+			FROM ip_pools
+			WHERE name = $1`,
+		name)
+	err := row.Scan(&p.Name, &p.NetworkCIDR, &p.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrPoolNotFound
+		}
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (s IPAMService) ListPools() ([]Pool, error) {
+	rows, err := s.DB.Query(`SELECT
+			name, network_cidr, created_at
+			FROM ip_pools
+			ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pools := []Pool{}
+	for rows.Next() {
+		var p Pool
+		if err := rows.Scan(&p.Name, &p.NetworkCIDR, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		pools = append(pools, p)
+	}
+	return pools, rows.Err()
+}
+
+func poolNetworks(tx *sql.Tx) ([]netip.Prefix, error) {
+	rows, err := tx.Query(`SELECT network_cidr FROM ip_pools`)
+	if err != nil {
+		return nil, fmt.Errorf("list pools: %w", err)
+	}
+	defer rows.Close()
+
+	var networks []netip.Prefix
+	for rows.Next() {
+		var cidrList string
+		if err := rows.Scan(&cidrList); err != nil {
+			return nil, err
+		}
+		nets, err := ParseNetworks(cidrList)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stored pool CIDR (%s): %w", cidrList, err)
+		}
+		networks = append(networks, nets...)
+	}
+	return networks, rows.Err()
+}
+
+// PoolContains reports whether all ips belong to the pool networks
+func (s IPAMService) PoolContains(name string, ips []string) (bool, error) {
+	pool, err := s.GetPool(name)
+	if err != nil {
+		return false, err
+	}
+	networks, err := ParseNetworks(pool.NetworkCIDR)
+	if err != nil {
+		return false, fmt.Errorf("invalid stored pool CIDR (%s): %w", pool.NetworkCIDR, err)
+	}
+
+	for _, ipStr := range ips {
+		ip, err := netip.ParseAddr(ipStr)
+		if err != nil {
+			return false, fmt.Errorf("invalid address %s: %w", ipStr, err)
+		}
+		contained := false
+		for _, n := range networks {
+			if Usable(ip, n) {
+				contained = true
+				break
+			}
+		}
+		if !contained {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,106 @@
+package ipam
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// Release hands addresses of removed nodes back, they are allocated again
+// before the allocation cursor moves on but not before reusableAt, when no
+// cert naming them is valid anymore. The server addresses can not be
+// released.
+func (s IPAMService) Release(tx *sql.Tx, ips []string, reusableAt time.Time) error {
+	serverIPs, err := s.ServerIPs()
+	if err != nil {
+		return err
+	}
+
+	for _, ipStr := range ips {
+		ip, err := netip.ParseAddr(ipStr)
+		if err != nil {
+			log.Printf("[WARN] not releasing invalid address %s", ipStr)
+			continue
+		}
+		if slices.Contains(serverIPs, ip.String()) {
+			continue
+		}
+
+		_, err = tx.Exec(`INSERT
+				INTO ip_released
+				(ip, reusable_at)
+				VALUES
+				($1, $2)
+				ON CONFLICT (ip) DO UPDATE
+				SET
+				reusable_at = GREATEST(ip_released.reusable_at, EXCLUDED.reusable_at)`,
+			ip.String(), reusableAt)
+		if err != nil {
+			return fmt.Errorf("release %s: %w", ip, err)
+		}
+	}
+
+	return nil
+}
+
+// takeReleased removes and returns the lowest released address of the
+// network outside of skip which isn't reserved, or an empty string
+func takeReleased(tx *sql.Tx, network netip.Prefix, skip []netip.Prefix) (string, error) {
+	released, err := releasedAddrs(tx, true, true)
+	if err != nil {
+		return "", err
+	}
+
+	for _, ip := range released {
+		if !Usable(ip, network) || inHoles(ip, skip) {
+			continue
+		}
+		reserved, err := hasReservation(tx, ip)
+		if err != nil {
+			return "", err
+		}
+		if reserved {
+			continue
+		}
+
+		if _, err := tx.Exec(`DELETE FROM ip_released WHERE ip = $1`, ip.String()); err != nil {
+			return "", fmt.Errorf("take released %s: %w", ip, err)
+		}
+		return ip.String(), nil
+	}
+
+	return "", nil
+}
+
+// releasedAddrs returns the released addresses in ascending order, only the
+// ones which may be handed out again right now if reusable is set
+func releasedAddrs(tx *sql.Tx, reusable, forUpdate bool) ([]netip.Addr, error) {
+	query := `SELECT ip FROM ip_released`
+	if reusable {
+		query += ` WHERE reusable_at <= NOW()`
+	}
+	if forUpdate {
+		query += ` FOR UPDATE`
+	}
+	rows, err := tx.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("read released addresses: %w", err)
+	}
+	defer rows.Close()
+
+	var ips []netip.Addr
+	for rows.Next() {
+		var ipStr string
+		if err := rows.Scan(&ipStr); err != nil {
+			return nil, err
+		}
+		if ip, err := netip.ParseAddr(ipStr); err == nil {
+			ips = append(ips, ip)
+		}
+	}
+	slices.SortFunc(ips, func(a, b netip.Addr) int { return a.Compare(b) })
+	return ips, rows.Err()
+}
@@ -0,0 +1,239 @@
+package ipam
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+var (
+	ErrReservationNotFound = errors.New("reservation not found")
+	ErrAddressReserved     = errors.New("address is already reserved")
+)
+
+// Reservation pins addresses to a node name or hardware ID. Operators pin
+// addresses explicitly, sticky reservations are recorded on enrollment so
+// a re-enrolling node gets its previous addresses back.
+type Reservation struct {
+	IPs        []string  `json:"ips"`
+	NodeName   string    `json:"node_name,omitempty"`
+	HardwareID string    `json:"hardware_id,omitempty"`
+	Sticky     bool      `json:"sticky"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func initReservationsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS ip_reservations (
+			ip TEXT NOT NULL PRIMARY KEY,
+			node_name TEXT NOT NULL DEFAULT '',
+			hardware_id TEXT NOT NULL DEFAULT '',
+			sticky BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS ip_reservations_node_name ON ip_reservations (node_name);
+		CREATE INDEX IF NOT EXISTS ip_reservations_hardware_id ON ip_reservations (hardware_id);
+	`)
+	return err
+}
+
+// Reserve stores r, which needs one usable address per network in
+// NetworkCIDR, in the same order. Explicit reservations replace sticky
+// ones for the same identity.
+func (s IPAMService) Reserve(r Reservation) error {
+	if r.NodeName == "" && r.HardwareID == "" {
+		return fmt.Errorf("reservation needs a node name or hardware ID")
+	}
+
+	networks, err := s.Networks()
+	if err != nil {
+		return err
+	}
+	if len(r.IPs) != len(networks) {
+		return fmt.Errorf("reservation needs one address for each of %s", s.NetworkCIDR)
+	}
+	serverAddr, err := s.ServerAddr()
+	if err != nil {
+		return err
+	}
+	for i, ipStr := range r.IPs {
+		ip, err := netip.ParseAddr(ipStr)
+		if err != nil {
+			return fmt.Errorf("invalid address %s: %w", ipStr, err)
+		}
+		if !Usable(ip, networks[i]) || ip.String() == serverAddr {
+			return fmt.Errorf("address %s can not be handed out from %s", ip, networks[i].Masked())
+		}
+		r.IPs[i] = ip.String()
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if !r.Sticky {
+		_, err = tx.Exec(`DELETE
+				FROM ip_reservations
+				WHERE sticky AND ((node_name = $1 AND $1 != '') OR (hardware_id = $2 AND $2 != ''))`,
+			r.NodeName, r.HardwareID)
+		if err != nil {
+			return fmt.Errorf("delete sticky reservations: %w", err)
+		}
+	}
+
+	for _, ip := range r.IPs {
+		res, err := tx.Exec(`INSERT
+				INTO ip_reservations
+				(ip, node_name, hardware_id, sticky)
+				VALUES
+				($1, $2, $3, $4)
+				ON CONFLICT (ip) DO NOTHING`,
+			ip, r.NodeName, r.HardwareID, r.Sticky)
+		if err != nil {
+			return fmt.Errorf("insert reservation: %w", err)
+		}
+		rowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsAffected == 0 {
+			return fmt.Errorf("%s: %w", ip, ErrAddressReserved)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// FindReservation returns the addresses reserved for the node name or,
+// failing that, for the hardware ID
+func (s IPAMService) FindReservation(nodeName, hardwareID string) (*Reservation, error) {
+	networks, err := s.Networks()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range []struct{ column, value string }{
+		{"node_name", nodeName},
+		{"hardware_id", hardwareID},
+	} {
+		if r.value == "" {
+			continue
+		}
+
+		reservations, err := s.queryReservations(`WHERE `+r.column+` = $1`, r.value)
+		if err != nil {
+			return nil, err
+		}
+		if len(reservations) == 0 {
+			continue
+		}
+
+		res := reservations[0]
+		if err := alignToNetworks(&res, networks); err != nil {
+			return nil, err
+		}
+		return &res, nil
+	}
+
+	return nil, ErrReservationNotFound
+}
+
+func (s IPAMService) ListReservations() ([]Reservation, error) {
+	return s.queryReservations("")
+}
+
+// DeleteReservation drops every address reserved for the identity
+func (s IPAMService) DeleteReservation(nodeName, hardwareID string) error {
+	res, err := s.DB.Exec(`DELETE
+			FROM ip_reservations
+			WHERE node_name = $1 AND hardware_id = $2`,
+		nodeName, hardwareID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrReservationNotFound
+	}
+	return nil
+}
+
+// DeleteStickyReservations drops the addresses recorded for the hardware ID
+// on enrollment, explicit reservations are kept
+func (s IPAMService) DeleteStickyReservations(tx *sql.Tx, hardwareID string) error {
+	_, err := tx.Exec(`DELETE
+			FROM ip_reservations
+			WHERE sticky AND hardware_id = $1`,
+		hardwareID)
+	return err
+}
+
+// queryReservations groups the reserved addresses by identity
+func (s IPAMService) queryReservations(where string, args ...any) ([]Reservation, error) {
+	rows, err := s.DB.Query(`SELECT
+			ip, node_name, hardware_id, sticky, created_at
+			FROM ip_reservations
+			`+where+`
+			ORDER BY node_name, hardware_id, ip`,
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reservations := []Reservation{}
+	for rows.Next() {
+		var ip string
+		var r Reservation
+		if err := rows.Scan(&ip, &r.NodeName, &r.HardwareID, &r.Sticky, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		last := len(reservations) - 1
+		if last >= 0 && reservations[last].NodeName == r.NodeName && reservations[last].HardwareID == r.HardwareID {
+			reservations[last].IPs = append(reservations[last].IPs, ip)
+			continue
+		}
+		r.IPs = []string{ip}
+		reservations = append(reservations, r)
+	}
+	return reservations, rows.Err()
+}
+
+// alignToNetworks orders the reserved addresses like the networks they
+// belong to
+func alignToNetworks(r *Reservation, networks []netip.Prefix) error {
+	ips := make([]string, 0, len(networks))
+	for _, n := range networks {
+		found := ""
+		for _, ipStr := range r.IPs {
+			ip, err := netip.ParseAddr(ipStr)
+			if err == nil && n.Masked().Contains(ip) {
+				found = ipStr
+				break
+			}
+		}
+		if found == "" {
+			return fmt.Errorf("reservation of %s %s has no address in %s", r.NodeName, r.HardwareID, n.Masked())
+		}
+		ips = append(ips, found)
+	}
+	r.IPs = ips
+	return nil
+}
+
+func hasReservation(tx *sql.Tx, ip netip.Addr) (bool, error) {
+	var exists bool
+	row := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM ip_reservations WHERE ip = $1)`, ip.String())
+	if err := row.Scan(&exists); err != nil {
+		return false, fmt.Errorf("check reservation of %s: %w", ip, err)
+	}
+	return exists, nil
+}
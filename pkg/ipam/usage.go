@@ -0,0 +1,294 @@
+package ipam
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"net/netip"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Usage describes the address usage of the overlay network
+type Usage struct {
+	NetworkCIDR string         `json:"network_cidr"`
+	ServerIPs   []string       `json:"server_ips"`
+	Networks    []NetworkUsage `json:"networks"`
+	Pools       []Pool         `json:"pools"`
+}
+
+// NetworkUsage describes one network of the default pool or a named pool.
+// Addresses are handed out sequentially, so Free counts the addresses ahead
+// of the allocation cursor and the released ones. Counts saturate at the
+// uint64 maximum.
+type NetworkUsage struct {
+	Pool        string   `json:"pool,omitempty"`
+	NetworkCIDR string   `json:"network_cidr"`
+	Total       uint64   `json:"total"`
+	Used        uint64   `json:"used"`
+	Free        uint64   `json:"free"`
+	Released    uint64   `json:"released" description:"addresses of removed nodes whose certs expired, waiting to be handed out again, part of free"`
+	Utilization float64  `json:"utilization" description:"percentage of the addresses that can't be handed out anymore"`
+	FreeRanges  []string `json:"free_ranges"`
+}
+
+// Usage reports the usage of every network, leases are the addresses held
+// by nodes
+func (s IPAMService) Usage(leases []string) (*Usage, error) {
+	serverIPs, err := s.ServerIPs()
+	if err != nil {
+		return nil, err
+	}
+	pools, err := s.ListPools()
+	if err != nil {
+		return nil, fmt.Errorf("list pools: %w", err)
+	}
+	reservations, err := s.ListReservations()
+	if err != nil {
+		return nil, fmt.Errorf("list reservations: %w", err)
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	cs, err := cursors(tx)
+	if err != nil {
+		return nil, err
+	}
+	poolNets, err := poolNetworks(tx)
+	if err != nil {
+		return nil, err
+	}
+	released, err := releasedAddrs(tx, true, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var reserved []netip.Addr
+	for _, r := range reservations {
+		for _, ipStr := range r.IPs {
+			if ip, err := netip.ParseAddr(ipStr); err == nil {
+				reserved = append(reserved, ip)
+			}
+		}
+	}
+	var leased []netip.Addr
+	for _, ipStr := range leases {
+		if ip, err := netip.ParseAddr(ipStr); err == nil {
+			leased = append(leased, ip)
+		}
+	}
+
+	u := &Usage{
+		NetworkCIDR: s.NetworkCIDR,
+		ServerIPs:   serverIPs,
+		Networks:    []NetworkUsage{},
+		Pools:       pools,
+	}
+	for _, c := range cs {
+		var carved []netip.Prefix
+		if c.pool == "" {
+			carved = poolNets
+		}
+		u.Networks = append(u.Networks, networkUsage(c, carved, reserved, leased, released))
+	}
+
+	return u, nil
+}
+
+// WatchUtilization checks the utilization every interval until stop is
+// closed. A network is warned about once it reaches AlertThreshold and
+// again only after it dropped below.
+func (s IPAMService) WatchUtilization(interval time.Duration, stop <-chan struct{}) {
+	if s.AlertThreshold <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	alerted := map[string]bool{}
+	for {
+		if err := s.checkUtilization(alerted); err != nil {
+			log.Printf("[WARN] checking ipam utilization: %v", err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkUtilization logs a warning for every network which reached
+// AlertThreshold since the last check, alerted tracks them by pool and
+// network
+func (s IPAMService) checkUtilization(alerted map[string]bool) error {
+	u, err := s.Usage(nil)
+	if err != nil {
+		return err
+	}
+	for _, n := range u.Networks {
+		name := "default pool"
+		if n.Pool != "" {
+			name = "pool " + n.Pool
+		}
+		key := n.Pool + " " + n.NetworkCIDR
+
+		switch {
+		case n.Utilization >= s.AlertThreshold && !alerted[key]:
+			log.Printf("[WARN] network %s of the %s is %.1f%% utilized (%d addresses left)",
+				n.NetworkCIDR, name, n.Utilization, n.Free)
+			alerted[key] = true
+		case n.Utilization < s.AlertThreshold && alerted[key]:
+			log.Printf("[INFO] network %s of the %s is back to %.1f%% utilized", n.NetworkCIDR, name, n.Utilization)
+			delete(alerted, key)
+		}
+	}
+	return nil
+}
+
+func networkUsage(c cursor, carved []netip.Prefix, reserved, leased, released []netip.Addr) NetworkUsage {
+	network := c.network.Masked()
+	first, last := usableRange(network)
+
+	// pools carved out of the network are not part of it
+	var holes []netip.Prefix
+	for _, p := range carved {
+		if network.Bits() < p.Bits() && network.Contains(p.Addr()) {
+			holes = append(holes, p.Masked())
+		}
+	}
+	sort.Slice(holes, func(i, j int) bool { return holes[i].Addr().Less(holes[j].Addr()) })
+
+	total := rangesSize(subtract(first, last, holes))
+
+	var free [][2]netip.Addr
+	if next, err := netip.ParseAddr(c.next); err == nil && !last.Less(next) {
+		if next.Less(first) {
+			next = first
+		}
+		free = subtract(next, last, holes)
+	}
+	freeCount := rangesSize(free)
+
+	freeRanges := []string{}
+	for _, r := range free {
+		freeRanges = append(freeRanges, r[0].String()+"-"+r[1].String())
+		for _, ip := range reserved {
+			if inRange(ip, r) {
+				freeCount.Sub(freeCount, big.NewInt(1))
+			}
+		}
+	}
+
+	releasedCount := uint64(0)
+	for _, ip := range released {
+		if Usable(ip, network) && !inHoles(ip, holes) && !slices.Contains(reserved, ip) {
+			releasedCount++
+		}
+	}
+	freeCount.Add(freeCount, new(big.Int).SetUint64(releasedCount))
+
+	used := uint64(0)
+	for _, ip := range leased {
+		if network.Contains(ip) && !inHoles(ip, holes) {
+			used++
+		}
+	}
+
+	utilization := 0.0
+	if total.Sign() > 0 {
+		f, _ := new(big.Float).Quo(
+			new(big.Float).SetInt(new(big.Int).Sub(total, freeCount)),
+			new(big.Float).SetInt(total),
+		).Float64()
+		utilization = math.Round(f*1000) / 10
+	}
+
+	return NetworkUsage{
+		Pool:        c.pool,
+		NetworkCIDR: network.String(),
+		Total:       saturate(total),
+		Used:        used,
+		Free:        saturate(freeCount),
+		Released:    releasedCount,
+		Utilization: utilization,
+		FreeRanges:  freeRanges,
+	}
+}
+
+// usableRange returns the first and last address Usable allows
+func usableRange(network netip.Prefix) (netip.Addr, netip.Addr) {
+	first := firstAddr(network)
+	last := lastAddr(network)
+	for isReserved(last, network) {
+		last = last.Prev()
+	}
+	return first, last
+}
+
+// subtract splits the range first-last around the sorted holes
+func subtract(first, last netip.Addr, holes []netip.Prefix) [][2]netip.Addr {
+	var ranges [][2]netip.Addr
+	start := first
+	for _, h := range holes {
+		hFirst, hLast := h.Addr(), lastAddr(h)
+		if hLast.Less(start) || last.Less(hFirst) {
+			continue
+		}
+		if start.Less(hFirst) {
+			ranges = append(ranges, [2]netip.Addr{start, hFirst.Prev()})
+		}
+		start = hLast.Next()
+		if !start.IsValid() {
+			return ranges
+		}
+	}
+	if !last.Less(start) {
+		ranges = append(ranges, [2]netip.Addr{start, last})
+	}
+	return ranges
+}
+
+func rangesSize(ranges [][2]netip.Addr) *big.Int {
+	size := new(big.Int)
+	for _, r := range ranges {
+		size.Add(size, new(big.Int).Sub(addrInt(r[1]), addrInt(r[0])))
+		size.Add(size, big.NewInt(1))
+	}
+	return size
+}
+
+func inRange(ip netip.Addr, r [2]netip.Addr) bool {
+	return !ip.Less(r[0]) && !r[1].Less(ip)
+}
+
+func inHoles(ip netip.Addr, holes []netip.Prefix) bool {
+	for _, h := range holes {
+		if h.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func addrInt(ip netip.Addr) *big.Int {
+	return new(big.Int).SetBytes(ip.AsSlice())
+}
+
+func saturate(n *big.Int) uint64 {
+	if n.Sign() < 0 {
+		return 0
+	}
+	if !n.IsUint64() {
+		return math.MaxUint64
+	}
+	return n.Uint64()
+}